@@ -0,0 +1,118 @@
+package chunker
+
+import (
+	"io"
+)
+
+const (
+	// no chunk is smaller, except the last one of a stream
+	MinSize = 512 * 1024
+	// past MinSize, a boundary is found every AverageSize bytes on average
+	AverageSize = 1024 * 1024
+	// a chunk is cut here when no boundary was found
+	MaxSize = 8 * 1024 * 1024
+)
+
+// a boundary is where the log2(AverageSize) high bits of the rolling hash are all zero,
+// the high bits depend on the last 64 bytes while the low ones only on the last few
+const boundaryMask = uint64(AverageSize-1) << (64 - 20)
+
+/**
+ * Gear table of the rolling hash. Generated from a fixed seed, chunk boundaries
+ * and therefore the deduplication of stored chunks depend on it never changing
+ */
+var gear = func() [256]uint64 {
+	table := [256]uint64{}
+	state := uint64(0x5eed5eed5eed5eed)
+	for index := range table {
+		// splitmix64
+		state += 0x9e3779b97f4a7c15
+		value := state
+		value = (value ^ (value >> 30)) * 0xbf58476d1ce4e5b9
+		value = (value ^ (value >> 27)) * 0x94d049bb133111eb
+		table[index] = value ^ (value >> 31)
+	}
+	return table
+}()
+
+/**
+ * Splits a stream into content-defined chunks with a gear rolling hash (FastCDC):
+ * a boundary only depends on the bytes before it, so inserting data in a file only changes the chunks around it
+ */
+type Chunker struct {
+	reader io.Reader
+	buffer []byte
+	// unread data is buffer[start:end]
+	start int
+	end   int
+	eof   bool
+}
+
+func New(reader io.Reader) *Chunker {
+	return &Chunker{
+		reader: reader,
+		buffer: make([]byte, MaxSize),
+	}
+}
+
+/**
+ * The next chunk, io.EOF once the stream is consumed.
+ * The chunk is only valid until the next call
+ */
+func (chunker *Chunker) Next() ([]byte, error) {
+	if err := chunker.fill(); err != nil {
+		return nil, err
+	}
+	if chunker.start == chunker.end {
+		return nil, io.EOF
+	}
+	length := cut(chunker.buffer[chunker.start:chunker.end])
+	chunk := chunker.buffer[chunker.start : chunker.start+length]
+	chunker.start += length
+	return chunk, nil
+}
+
+/**
+ * Read until a whole chunk is buffered or the stream ends
+ */
+func (chunker *Chunker) fill() error {
+	if chunker.eof || chunker.end-chunker.start >= MaxSize {
+		return nil
+	}
+	copy(chunker.buffer, chunker.buffer[chunker.start:chunker.end])
+	chunker.end -= chunker.start
+	chunker.start = 0
+	for chunker.end < len(chunker.buffer) {
+		read, err := chunker.reader.Read(chunker.buffer[chunker.end:])
+		chunker.end += read
+		if err == io.EOF {
+			chunker.eof = true
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/**
+ * Length of the chunk starting data
+ */
+func cut(data []byte) int {
+	if len(data) <= MinSize {
+		return len(data)
+	}
+	limit := len(data)
+	if limit > MaxSize {
+		limit = MaxSize
+	}
+	hash := uint64(0)
+	for index := MinSize; index < limit; index++ {
+		hash = (hash << 1) + gear[data[index]]
+		if hash&boundaryMask == 0 {
+			return index + 1
+		}
+	}
+	return limit
+}
@@ -0,0 +1,118 @@
+package chunker
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+/**
+ * Input of the tests, generated here so it never depends on another package
+ */
+func seededData(seed uint64, size int) []byte {
+	data := make([]byte, size)
+	state := seed
+	for index := 0; index < size; index += 8 {
+		// splitmix64
+		state += 0x9e3779b97f4a7c15
+		value := state
+		value = (value ^ (value >> 30)) * 0xbf58476d1ce4e5b9
+		value = (value ^ (value >> 27)) * 0x94d049bb133111eb
+		value ^= value >> 31
+		for shift := 0; shift < 8 && index+shift < size; shift++ {
+			data[index+shift] = byte(value >> (8 * shift))
+		}
+	}
+	return data
+}
+
+/**
+ * Offsets where the chunks of reader end
+ */
+func cutPoints(t *testing.T, reader io.Reader) []int {
+	t.Helper()
+	chunker := New(reader)
+	offsets := []int{}
+	offset := 0
+	for {
+		chunk, err := chunker.Next()
+		if err == io.EOF {
+			return offsets
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		offset += len(chunk)
+		offsets = append(offsets, offset)
+	}
+}
+
+/**
+ * Cut points of a fixed input. They must never change: stored chunks are only deduplicated
+ * against chunks cut at the same places, a change stores every repository again
+ */
+func TestCutPoints(t *testing.T) {
+	expected := []int{945548, 3224059, 7151977, 7705889, 8552522, 10898127, 12071991, 13516841, 14047382, 18039696, 21727948, 22528273, 24414890, 25165824}
+	offsets := cutPoints(t, bytes.NewReader(seededData(1, 24*1024*1024)))
+	if fmt.Sprint(offsets) != fmt.Sprint(expected) {
+		t.Errorf("cut at %v, expected %v", offsets, expected)
+	}
+	// the same points whatever the reads return
+	if short := cutPoints(t, iotest.HalfReader(bytes.NewReader(seededData(1, 24*1024*1024)))); fmt.Sprint(short) != fmt.Sprint(expected) {
+		t.Errorf("cut short reads at %v, expected %v", short, expected)
+	}
+}
+
+func TestChunkSizes(t *testing.T) {
+	tests := map[string][]byte{
+		"random": seededData(2, 32*1024*1024),
+		// no boundary is ever found
+		"zeros": make([]byte, 3*MaxSize+1),
+	}
+	for name, data := range tests {
+		t.Run(name, func(t *testing.T) {
+			offsets := cutPoints(t, bytes.NewReader(data))
+			previous := 0
+			for index, offset := range offsets {
+				size := offset - previous
+				last := index == len(offsets)-1
+				if size > MaxSize || (size < MinSize && !last) || size == 0 {
+					t.Errorf("chunk %d of %d bytes", index, size)
+				}
+				previous = offset
+			}
+			if previous != len(data) {
+				t.Errorf("chunked %d bytes of %d", previous, len(data))
+			}
+		})
+	}
+	if offsets := cutPoints(t, bytes.NewReader(seededData(3, MinSize))); fmt.Sprint(offsets) != fmt.Sprint([]int{MinSize}) {
+		t.Errorf("a small file cut at %v", offsets)
+	}
+	if offsets := cutPoints(t, bytes.NewReader(nil)); len(offsets) != 0 {
+		t.Errorf("an empty file cut at %v", offsets)
+	}
+}
+
+/**
+ * Data inserted in a file only changes the chunks around it, the later cut points only move by its length
+ */
+func TestInsertionLocality(t *testing.T) {
+	data := seededData(4, 24*1024*1024)
+	inserted := seededData(5, 1000)
+	edited := append(append(append([]byte{}, data[:100000]...), inserted...), data[100000:]...)
+
+	original := cutPoints(t, bytes.NewReader(data))
+	moved := map[int]bool{}
+	for _, offset := range cutPoints(t, bytes.NewReader(edited)) {
+		moved[offset-len(inserted)] = true
+	}
+	// the first chunk holds the insertion, at most the next one is cut elsewhere
+	for _, offset := range original[2:] {
+		if !moved[offset] {
+			t.Errorf("the cut point at %d moved", offset)
+		}
+	}
+}
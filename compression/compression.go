@@ -0,0 +1,104 @@
+package compression
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codecs objects can be compressed with, recorded on every compressed object
+const (
+	Gzip = "gzip"
+	Zstd = "zstd"
+)
+
+// Formats compressing their content already, compressing them again only costs time.
+// Formats based on zip (office documents, jar, epub) are recognized by their zip parent
+var compressedTypes = map[string]bool{
+	"application/zip":                       true,
+	"application/gzip":                      true,
+	"application/zstd":                      true,
+	"application/x-xz":                      true,
+	"application/x-bzip2":                   true,
+	"application/lzip":                      true,
+	"application/x-7z-compressed":           true,
+	"application/x-rar-compressed":          true,
+	"application/vnd.ms-cab-compressed":     true,
+	"application/vnd.debian.binary-package": true,
+	"application/x-rpm":                     true,
+	"application/pdf":                       true,
+	"application/ogg":                       true,
+	"font/woff":                             true,
+	"font/woff2":                            true,
+	"image/jpeg":                            true,
+	"image/png":                             true,
+	"image/gif":                             true,
+	"image/webp":                            true,
+	"image/heic":                            true,
+	"image/heic-sequence":                   true,
+	"image/heif":                            true,
+	"image/heif-sequence":                   true,
+	"image/jp2":                             true,
+	"image/jpx":                             true,
+	"image/jxl":                             true,
+	"image/bpg":                             true,
+}
+
+// uncompressed audio, every other audio and video format is compressed
+var rawAudioTypes = map[string]bool{
+	"audio/wav":   true,
+	"audio/aiff":  true,
+	"audio/basic": true,
+	"audio/midi":  true,
+}
+
+func Valid(codec string) bool {
+	return codec == "" || codec == Gzip || codec == Zstd
+}
+
+/**
+ * Whether content of mimeType is compressed already
+ */
+func Compressed(mimeType string) bool {
+	mimeType = strings.TrimSpace(strings.SplitN(mimeType, ";", 2)[0])
+	if compressedTypes[mimeType] {
+		return true
+	}
+	if strings.HasPrefix(mimeType, "video/") {
+		return true
+	}
+	return strings.HasPrefix(mimeType, "audio/") && !rawAudioTypes[mimeType]
+}
+
+/**
+ * Writer compressing into target with codec, Close flushes it without closing target
+ */
+func NewWriter(codec string, target io.Writer) (io.WriteCloser, error) {
+	switch codec {
+	case Gzip:
+		return gzip.NewWriter(target), nil
+	case Zstd:
+		return zstd.NewWriter(target)
+	}
+	return nil, fmt.Errorf("unknown compression %q", codec)
+}
+
+/**
+ * Reader decompressing what NewWriter produced with codec
+ */
+func NewReader(codec string, source io.Reader) (io.ReadCloser, error) {
+	switch codec {
+	case Gzip:
+		return gzip.NewReader(source)
+	case Zstd:
+		decoder, err := zstd.NewReader(source)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	}
+	return nil, fmt.Errorf("unknown compression %q", codec)
+}
@@ -0,0 +1,85 @@
+package compression
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	content := []byte(strings.Repeat("compressible content ", 10000))
+	for _, codec := range []string{Gzip, Zstd} {
+		t.Run(codec, func(t *testing.T) {
+			var compressed bytes.Buffer
+			writer, err := NewWriter(codec, &compressed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := writer.Write(content); err != nil {
+				t.Fatal(err)
+			}
+			if err := writer.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if compressed.Len() >= len(content) {
+				t.Errorf("compressed %d bytes to %d", len(content), compressed.Len())
+			}
+			reader, err := NewReader(codec, &compressed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer reader.Close()
+			decompressed, err := io.ReadAll(reader)
+			if err != nil || !bytes.Equal(decompressed, content) {
+				t.Errorf("decompressed %d bytes, %v", len(decompressed), err)
+			}
+		})
+	}
+	if _, err := NewWriter("lz4", io.Discard); err == nil {
+		t.Error("unknown codec accepted to compress")
+	}
+	if _, err := NewReader("lz4", strings.NewReader("")); err == nil {
+		t.Error("unknown codec accepted to decompress")
+	}
+	// another codec doesn't read it
+	var compressed bytes.Buffer
+	writer, _ := NewWriter(Zstd, &compressed)
+	writer.Write(content)
+	writer.Close()
+	if reader, err := NewReader(Gzip, &compressed); err == nil {
+		if _, err := io.ReadAll(reader); err == nil {
+			t.Error("zstd content read as gzip")
+		}
+	}
+}
+
+func TestCompressed(t *testing.T) {
+	tests := map[string]bool{
+		"application/zip":           true,
+		"application/gzip":          true,
+		"image/jpeg":                true,
+		"image/png":                 true,
+		"video/mp4":                 true,
+		"audio/mpeg":                true,
+		"audio/wav":                 false,
+		"text/plain; charset=utf-8": false,
+		"application/json":          false,
+		"application/x-tar":         false,
+		"image/bmp":                 false,
+		"application/octet-stream":  false,
+	}
+	for mimeType, expected := range tests {
+		if got := Compressed(mimeType); got != expected {
+			t.Errorf("Compressed(%q) = %v", mimeType, got)
+		}
+	}
+}
+
+func TestValid(t *testing.T) {
+	for codec, expected := range map[string]bool{"": true, Gzip: true, Zstd: true, "lz4": false, "GZIP": false} {
+		if got := Valid(codec); got != expected {
+			t.Errorf("Valid(%q) = %v", codec, got)
+		}
+	}
+}
@@ -2,24 +2,822 @@ package config
 
 import (
 	"fmt"
+	"os"
+	"strings"
+
+	"playus/server-backup/compression"
+	"playus/server-backup/retention"
+	"playus/server-backup/schedule"
 
 	"github.com/pelletier/go-toml"
 )
 
-var (
-	Conf = New()
+// Used when no -config flag is given
+const DefaultPath = "./config/config.toml"
+
+// Separates the destinations when one bucket setting lists several of them,
+// e.g. "my-bucket;file:///mnt/nas/backups"
+const DestinationSeparator = ";"
+
+/**
+ * Where and how to store a backup, shared by every section and directory job
+ */
+type StorageConfig struct {
+	Endpoint string
+	Key      string
+	Secret   string
+	Region   string
+	// static or chain, see readStorage
+	Credentials          string
+	Profile              string
+	RoleArn              string
+	RoleSessionName      string
+	ExternalId           string
+	WebIdentityTokenFile string
+	SFTPPassword         string
+	SFTPKeyFile          string
+	SFTPKeyPassphrase    string
+	SFTPHostKey          string
+	SFTPKnownHostsFile   string
+	// client side encryption, a passphrase or a key file encrypts new objects
+	EncryptionPassphrase string
+	EncryptionKeyFile    string
+	// former keys, only used to read what they encrypted
+	DecryptionKeyFiles []string
+}
+
+/**
+ * When a backup runs: a cron expression on a timezone, or every SecondsInterval without it
+ */
+type ScheduleConfig struct {
+	SecondsInterval int
+	Cron            string
+	Timezone        string
+	CatchUp         string
+	Overlap         string
+}
+
+/**
+ * Retries of failed transfers, delays in seconds doubling from Delay up to MaxDelay
+ */
+type RetryConfig struct {
+	Retries  int
+	Delay    int
+	MaxDelay int
+}
+
+/**
+ * Bandwidth limits in bytes per second, 0 for no limit.
+ * Hours restricts the limits to a HH:MM-HH:MM local time range, they always apply when empty
+ */
+type ThrottleConfig struct {
+	UploadLimit   int
+	DownloadLimit int
+	Hours         string
+}
+
+/**
+ * Optional lock object on every destination, see directory.RemoteLock
+ */
+type LockConfig struct {
+	Remote bool
+	// seconds before a lock that isn't refreshed can be taken over
+	TTL int
+}
+
+/**
+ * Snapshots kept by the retention of every rotation, see retention.Policy.
+ * KeepWithin is a duration such as 14d, snapshots newer than it are always kept
+ */
+type RotationConfig struct {
+	HourlyRotation  int
+	DailyRotation   int
+	WeeklyRotation  int
+	MonthlyRotation int
+	YearlyRotation  int
+	KeepWithin      string
+}
+
+type DatabaseConfig struct {
+	Enabled        bool
+	Databases      string
+	Hostname       string
+	Port           string
+	Username       string
+	Password       string
+	OutDir         string
+	DBThreshold    int
+	TableThreshold int
+	BatchSize      int
+	MySQLDumpPath  string
+	Verbosity      int
+	S3Backup       bool
+	Destinations   []string
+	S3Key          string
+	Schedule       ScheduleConfig
+	Lock           LockConfig
+	Retry          RetryConfig
+	Workers        int
+	Throttle       ThrottleConfig
+	Rotation       RotationConfig
+	Storage        StorageConfig
+}
+
+type DirBackupConfig struct {
+	Enabled    bool
+	IgnoreFile string
+	Schedule   ScheduleConfig
+	Lock       LockConfig
+	Retry      RetryConfig
+	Workers    int
+	Throttle   ThrottleConfig
+	Rotation   RotationConfig
+	Storage    StorageConfig
+	// store files as deduplicated chunks instead of full copies
+	Repository bool
+	// unreferenced chunks newer than it are kept, a duration such as 24h
+	ChunkGracePeriod string
+	// gzip or zstd to compress the uploaded files, none when empty
+	Compression string
+	Jobs        []DirectoryJob
+}
+
+/**
+ * A named directory backup, read from a [[dirbackup.jobs]] table or the legacy dirbackup.dirs string.
+ * Every setting not given on the job falls back to the [dirbackup] section
+ */
+type DirectoryJob struct {
+	Name         string
+	Destinations []string
+	Prefix       string
+	Directories  []string
+	IgnoreFile   string
+	Schedule     ScheduleConfig
+	Lock         LockConfig
+	Retry        RetryConfig
+	Workers      int
+	Throttle     ThrottleConfig
+	Rotation     RotationConfig
+	Storage      StorageConfig
+	Repository   bool
+	// see DirBackupConfig.ChunkGracePeriod
+	ChunkGracePeriod string
+	Compression      string
+}
+
+type TypesenseConfig struct {
+	Enabled         bool
+	TargetDir       string
+	TypesenseUrl    string
+	TypesenseApiKey string
+	Destinations    []string
+	BucketPrefix    string
+	Schedule        ScheduleConfig
+	Lock            LockConfig
+	Retry           RetryConfig
+	Workers         int
+	Throttle        ThrottleConfig
+	Rotation        RotationConfig
+	Storage         StorageConfig
+}
+
+type GeneralConfig struct {
+	// where the scheduler keeps the last run of every backup
+	StateDir string
+	// seconds running backups get to finish on SIGTERM or SIGINT before they are canceled
+	ShutdownTimeout int
+	// limits shared by every backup and restore
+	Throttle ThrottleConfig
+}
+
+type Config struct {
+	Path      string
+	General   GeneralConfig
+	Database  DatabaseConfig
+	DirBackup DirBackupConfig
+	Typesense TypesenseConfig
+}
+
+/**
+ * Every problem found while loading the configuration
+ */
+type ValidationError struct {
+	Path     string
+	Problems []string
+}
+
+func (err *ValidationError) Error() string {
+	return fmt.Sprintf("invalid configuration %s:\n  - %s", err.Path, strings.Join(err.Problems, "\n  - "))
+}
+
+/**
+ * Load, apply defaults and validate the configuration file.
+ * Returns a *ValidationError listing every missing or invalid key
+ */
+func Load(path string) (*Config, error) {
+	if path == "" {
+		path = DefaultPath
+	}
+	tree, err := toml.LoadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read configuration %s: %v", path, err)
+	}
+	problems := []string{}
+	conf := &Config{
+		Path:      path,
+		General:   readGeneral(tree, &problems),
+		Database:  readDatabase(tree, &problems),
+		DirBackup: readDirBackup(tree, &problems),
+		Typesense: readTypesense(tree, &problems),
+	}
+	if len(problems) > 0 {
+		return conf, &ValidationError{Path: path, Problems: problems}
+	}
+	return conf, nil
+}
+
+func section(tree *toml.Tree, name string, problems *[]string) *tomlReader {
+	if !tree.Has(name) {
+		return newTomlReader(nil, name, problems)
+	}
+	sectionTree, ok := tree.Get(name).(*toml.Tree)
+	if !ok {
+		*problems = append(*problems, fmt.Sprintf("%s: must be a table, use [%s]", name, name))
+		return newTomlReader(nil, name, problems)
+	}
+	return newTomlReader(sectionTree, name, problems)
+}
+
+func readStorage(reader *tomlReader, defaults StorageConfig) StorageConfig {
+	storage := StorageConfig{
+		Endpoint:             reader.String("endpoint", defaults.Endpoint),
+		Key:                  reader.Secret("key", defaults.Key),
+		Secret:               reader.Secret("secret", defaults.Secret),
+		Region:               reader.String("region", defaults.Region),
+		Credentials:          reader.String("credentials", defaults.Credentials),
+		Profile:              reader.String("profile", defaults.Profile),
+		RoleArn:              reader.String("roleArn", defaults.RoleArn),
+		RoleSessionName:      reader.String("roleSessionName", defaults.RoleSessionName),
+		ExternalId:           reader.String("externalId", defaults.ExternalId),
+		WebIdentityTokenFile: reader.String("webIdentityTokenFile", defaults.WebIdentityTokenFile),
+		SFTPPassword:         reader.Secret("sftpPassword", defaults.SFTPPassword),
+		SFTPKeyFile:          reader.String("sftpKeyFile", defaults.SFTPKeyFile),
+		SFTPKeyPassphrase:    reader.Secret("sftpKeyPassphrase", defaults.SFTPKeyPassphrase),
+		SFTPHostKey:          reader.String("sftpHostKey", defaults.SFTPHostKey),
+		SFTPKnownHostsFile:   reader.String("sftpKnownHostsFile", defaults.SFTPKnownHostsFile),
+		EncryptionPassphrase: reader.Secret("encryptionPassphrase", defaults.EncryptionPassphrase),
+		EncryptionKeyFile:    reader.String("encryptionKeyFile", defaults.EncryptionKeyFile),
+		DecryptionKeyFiles:   defaults.DecryptionKeyFiles,
+	}
+	if reader.Has("decryptionKeyFiles") {
+		storage.DecryptionKeyFiles = reader.Strings("decryptionKeyFiles")
+	}
+	if storage.EncryptionPassphrase != "" && storage.EncryptionKeyFile != "" {
+		reader.Problem("encryptionKeyFile", "set either encryptionPassphrase or encryptionKeyFile")
+	}
+	if storage.EncryptionKeyFile != "" {
+		requireFile(reader, "encryptionKeyFile", storage.EncryptionKeyFile)
+	}
+	for _, keyFile := range storage.DecryptionKeyFiles {
+		requireFile(reader, "decryptionKeyFiles", keyFile)
+	}
+	// keys on the table select static credentials unless told otherwise, no keys at all use the aws chain
+	if !reader.Has("credentials") && (reader.Has("key") || reader.Has("key_file")) {
+		storage.Credentials = staticCredentials
+	}
+	if storage.Credentials == "" {
+		storage.Credentials = chainCredentials
+		if storage.Key != "" {
+			storage.Credentials = staticCredentials
+		}
+	}
+	switch storage.Credentials {
+	case staticCredentials:
+		if storage.Profile != "" && reader.Has("profile") {
+			reader.Problem("profile", "only used with credentials = %q", chainCredentials)
+		}
+	case chainCredentials:
+	default:
+		reader.Problem("credentials", "must be %q or %q", staticCredentials, chainCredentials)
+	}
+	if storage.WebIdentityTokenFile != "" && storage.RoleArn == "" {
+		reader.Problem("webIdentityTokenFile", "requires roleArn")
+	}
+	return storage
+}
+
+func readRotation(reader *tomlReader, defaults RotationConfig) RotationConfig {
+	// keepDaily, keepWeekly and keepMonthly are the new names of the rotation counts
+	rotation := RotationConfig{
+		HourlyRotation:  reader.Int("keepHourly", defaults.HourlyRotation),
+		DailyRotation:   reader.Int("keepDaily", reader.Int("dailyrotation", defaults.DailyRotation)),
+		WeeklyRotation:  reader.Int("keepWeekly", reader.Int("weeklyrotation", defaults.WeeklyRotation)),
+		MonthlyRotation: reader.Int("keepMonthly", reader.Int("monthlyrotation", defaults.MonthlyRotation)),
+		YearlyRotation:  reader.Int("keepYearly", defaults.YearlyRotation),
+		KeepWithin:      reader.String("keepWithin", defaults.KeepWithin),
+	}
+	if rotation.HourlyRotation < 0 {
+		reader.Problem("keepHourly", "can't be negative")
+	}
+	if rotation.DailyRotation < 0 {
+		reader.Problem("dailyrotation", "can't be negative")
+	}
+	if rotation.WeeklyRotation < 0 {
+		reader.Problem("weeklyrotation", "can't be negative")
+	}
+	if rotation.MonthlyRotation < 0 {
+		reader.Problem("monthlyrotation", "can't be negative")
+	}
+	if rotation.YearlyRotation < 0 {
+		reader.Problem("keepYearly", "can't be negative")
+	}
+	if _, err := retention.ParseDuration(rotation.KeepWithin); err != nil {
+		reader.Problem("keepWithin", "%v", err)
+	}
+	return rotation
+}
+
+const (
+	staticCredentials = "static"
+	chainCredentials  = "chain"
 )
 
+var defaultStorage = StorageConfig{
+	Region: "us-east-1",
+}
+
+var defaultRotation = RotationConfig{
+	DailyRotation:   3,
+	WeeklyRotation:  2,
+	MonthlyRotation: 1,
+}
+
+var defaultSchedule = ScheduleConfig{
+	SecondsInterval: 3600,
+	CatchUp:         schedule.CatchUpSkip,
+	Overlap:         schedule.OverlapSkip,
+}
+
+var defaultRetry = RetryConfig{
+	Retries:  3,
+	Delay:    1,
+	MaxDelay: 30,
+}
+
+// uploads or downloads running at once per destination
+const defaultWorkers = 5
+
+// a run stores its chunks before its manifest references them, long runs need a longer period
+const defaultChunkGracePeriod = "24h"
+
+var defaultLock = LockConfig{
+	Remote: false,
+	TTL:    3600,
+}
+
+func readGeneral(tree *toml.Tree, problems *[]string) GeneralConfig {
+	reader := section(tree, "general", problems)
+	conf := GeneralConfig{
+		StateDir:        reader.String("stateDir", "./state"),
+		ShutdownTimeout: reader.Int("shutdownTimeout", 300),
+		Throttle:        readThrottle(reader, ThrottleConfig{}),
+	}
+	requireString(reader, "stateDir", conf.StateDir)
+	requirePositive(reader, "shutdownTimeout", conf.ShutdownTimeout)
+	return conf
+}
+
+func readSchedule(reader *tomlReader, defaults ScheduleConfig) ScheduleConfig {
+	conf := ScheduleConfig{
+		SecondsInterval: reader.Int("secondsInterval", defaults.SecondsInterval),
+		Cron:            reader.String("schedule", defaults.Cron),
+		Timezone:        reader.String("timezone", defaults.Timezone),
+		CatchUp:         reader.String("catchUp", defaults.CatchUp),
+		Overlap:         reader.String("overlap", defaults.Overlap),
+	}
+	if !schedule.ValidCatchUp(conf.CatchUp) {
+		reader.Problem("catchUp", "must be %q or %q", schedule.CatchUpSkip, schedule.CatchUpOnce)
+	}
+	if !schedule.ValidOverlap(conf.Overlap) {
+		reader.Problem("overlap", "must be %q, %q or %q", schedule.OverlapSkip, schedule.OverlapQueue, schedule.OverlapCancel)
+	}
+	return conf
+}
+
+func readRetry(reader *tomlReader, defaults RetryConfig) RetryConfig {
+	conf := RetryConfig{
+		Retries:  reader.Int("retries", defaults.Retries),
+		Delay:    reader.Int("retryDelay", defaults.Delay),
+		MaxDelay: reader.Int("retryMaxDelay", defaults.MaxDelay),
+	}
+	if conf.Retries < 0 {
+		reader.Problem("retries", "can't be negative")
+	}
+	if conf.Delay < 0 {
+		reader.Problem("retryDelay", "can't be negative")
+	}
+	if conf.MaxDelay < conf.Delay {
+		reader.Problem("retryMaxDelay", "can't be lower than retryDelay")
+	}
+	return conf
+}
+
+func readWorkers(reader *tomlReader, fallback int) int {
+	workers := reader.Int("workers", fallback)
+	requirePositive(reader, "workers", workers)
+	return workers
+}
+
 /**
- * The new configuration
- * @method New
+ * A duration such as 36h, 14d or 2w, see retention.ParseDuration
  */
-func New() *toml.Tree {
-	config, err := toml.LoadFile("./config/config.toml")
+func readDuration(reader *tomlReader, key string, fallback string) string {
+	value := reader.String(key, fallback)
+	if _, err := retention.ParseDuration(value); err != nil {
+		reader.Problem(key, "%v", err)
+	}
+	return value
+}
+
+func readCompression(reader *tomlReader, fallback string) string {
+	codec := reader.String("compression", fallback)
+	if !compression.Valid(codec) {
+		reader.Problem("compression", "must be %q or %q", compression.Gzip, compression.Zstd)
+	}
+	return codec
+}
+
+func readThrottle(reader *tomlReader, defaults ThrottleConfig) ThrottleConfig {
+	conf := ThrottleConfig{
+		UploadLimit:   reader.Int("uploadLimit", defaults.UploadLimit),
+		DownloadLimit: reader.Int("downloadLimit", defaults.DownloadLimit),
+		Hours:         reader.String("limitHours", defaults.Hours),
+	}
+	if conf.UploadLimit < 0 {
+		reader.Problem("uploadLimit", "can't be negative")
+	}
+	if conf.DownloadLimit < 0 {
+		reader.Problem("downloadLimit", "can't be negative")
+	}
+	if _, err := schedule.ParseWindow(conf.Hours); err != nil {
+		reader.Problem("limitHours", "%v", err)
+	}
+	return conf
+}
+
+func readLock(reader *tomlReader, defaults LockConfig) LockConfig {
+	conf := LockConfig{
+		Remote: reader.Bool("remoteLock", defaults.Remote),
+		TTL:    reader.Int("lockTTL", defaults.TTL),
+	}
+	requirePositive(reader, "lockTTL", conf.TTL)
+	return conf
+}
+
+func validateSchedule(reader *tomlReader, conf ScheduleConfig) {
+	if conf.Cron == "" {
+		requirePositive(reader, "secondsInterval", conf.SecondsInterval)
+		if conf.Timezone == "" || conf.SecondsInterval <= 0 {
+			return
+		}
+	}
+	if _, err := schedule.Parse(conf.Cron, conf.Timezone, conf.SecondsInterval); err != nil {
+		reader.Problem("schedule", "%v", err)
+	}
+}
 
+func readDatabase(tree *toml.Tree, problems *[]string) DatabaseConfig {
+	reader := section(tree, "database", problems)
+	conf := DatabaseConfig{
+		Enabled:        reader.Bool("enabled", false),
+		Databases:      reader.String("database", ""),
+		Hostname:       reader.String("hostname", "127.0.0.1"),
+		Port:           reader.String("port", "3306"),
+		Username:       reader.String("username", ""),
+		Password:       reader.Secret("password", ""),
+		OutDir:         reader.String("outdir", ""),
+		DBThreshold:    reader.Int("dbthreshold", 10000000),
+		TableThreshold: reader.Int("tablethreshold", 5000000),
+		BatchSize:      reader.Int("batchsize", 1000000),
+		MySQLDumpPath:  reader.String("mysqldumppath", "/usr/bin/mysqldump"),
+		Verbosity:      reader.Int("verbosity", 1),
+		Schedule:       readSchedule(reader, defaultSchedule),
+		Lock:           readLock(reader, defaultLock),
+		Retry:          readRetry(reader, defaultRetry),
+		Workers:        readWorkers(reader, defaultWorkers),
+		Throttle:       readThrottle(reader, ThrottleConfig{}),
+		S3Backup:       reader.Bool("s3Backup", false),
+		Destinations:   SplitDestinations(reader.String("bucket", "")),
+		S3Key:          reader.String("s3Key", "database"),
+		Rotation:       readRotation(reader, defaultRotation),
+		Storage:        readStorage(reader, defaultStorage),
+	}
+	if !conf.Enabled {
+		return conf
+	}
+	requireString(reader, "database", conf.Databases)
+	requireString(reader, "username", conf.Username)
+	requireString(reader, "outdir", conf.OutDir)
+	requireString(reader, "mysqldumppath", conf.MySQLDumpPath)
+	validateSchedule(reader, conf.Schedule)
+	if conf.Verbosity < 0 || conf.Verbosity > 2 {
+		reader.Problem("verbosity", "must be 0, 1 or 2")
+	}
+	if conf.S3Backup {
+		if len(conf.Destinations) == 0 {
+			reader.Problem("bucket", "is required when s3Backup is enabled")
+		}
+		requirePrefix(reader, "s3Key", conf.S3Key)
+		validateHourly(reader, conf.Rotation, conf.Destinations, false)
+	}
+	return conf
+}
+
+func readDirBackup(tree *toml.Tree, problems *[]string) DirBackupConfig {
+	reader := section(tree, "dirbackup", problems)
+	conf := DirBackupConfig{
+		Enabled:          reader.Bool("enabled", false),
+		Schedule:         readSchedule(reader, defaultSchedule),
+		Lock:             readLock(reader, defaultLock),
+		Retry:            readRetry(reader, defaultRetry),
+		Workers:          readWorkers(reader, defaultWorkers),
+		Throttle:         readThrottle(reader, ThrottleConfig{}),
+		IgnoreFile:       reader.String("ignoreFile", ""),
+		Rotation:         readRotation(reader, defaultRotation),
+		Storage:          readStorage(reader, defaultStorage),
+		Repository:       reader.Bool("repository", false),
+		ChunkGracePeriod: readDuration(reader, "chunkGracePeriod", defaultChunkGracePeriod),
+		Compression:      readCompression(reader, ""),
+		Jobs:             []DirectoryJob{},
+	}
+	defaults := DirectoryJob{
+		IgnoreFile:       conf.IgnoreFile,
+		Schedule:         conf.Schedule,
+		Lock:             conf.Lock,
+		Retry:            conf.Retry,
+		Workers:          conf.Workers,
+		Throttle:         conf.Throttle,
+		Rotation:         conf.Rotation,
+		Storage:          conf.Storage,
+		Repository:       conf.Repository,
+		ChunkGracePeriod: conf.ChunkGracePeriod,
+		Compression:      conf.Compression,
+	}
+	names := map[string]bool{}
+	addJob := func(job DirectoryJob, jobReader *tomlReader) {
+		if names[job.Name] {
+			jobReader.Problem("name", "duplicated job name %q", job.Name)
+			return
+		}
+		names[job.Name] = true
+		conf.Jobs = append(conf.Jobs, job)
+	}
+	for index, table := range reader.Tables("jobs") {
+		jobReader := newTomlReader(table, fmt.Sprintf("dirbackup.jobs[%d]", index), problems)
+		addJob(readDirectoryJob(jobReader, defaults, conf.Enabled), jobReader)
+	}
+	if reader.Has("dirs") {
+		if _, legacy := reader.tree.Get("dirs").(string); legacy {
+			for _, job := range readLegacyDirs(reader, defaults, conf.Enabled) {
+				addJob(job, reader)
+			}
+		} else {
+			reader.Problem("dirs", "must be a string, use [[dirbackup.jobs]] to list directories")
+		}
+	}
+	if !conf.Enabled {
+		return conf
+	}
+	if len(conf.Jobs) == 0 {
+		reader.Problem("jobs", "at least one [[dirbackup.jobs]] or a dirs entry is required")
+	}
+	return conf
+}
+
+func readDirectoryJob(reader *tomlReader, defaults DirectoryJob, validate bool) DirectoryJob {
+	job := DirectoryJob{
+		Name:             reader.String("name", ""),
+		Destinations:     SplitDestinations(reader.String("bucket", "")),
+		Prefix:           reader.String("prefix", ""),
+		Directories:      []string{},
+		IgnoreFile:       reader.String("ignoreFile", defaults.IgnoreFile),
+		Schedule:         readSchedule(reader, defaults.Schedule),
+		Lock:             readLock(reader, defaults.Lock),
+		Retry:            readRetry(reader, defaults.Retry),
+		Workers:          readWorkers(reader, defaults.Workers),
+		Throttle:         readThrottle(reader, defaults.Throttle),
+		Rotation:         readRotation(reader, defaults.Rotation),
+		Storage:          readStorage(reader, defaults.Storage),
+		Repository:       reader.Bool("repository", defaults.Repository),
+		ChunkGracePeriod: readDuration(reader, "chunkGracePeriod", defaults.ChunkGracePeriod),
+		Compression:      readCompression(reader, defaults.Compression),
+	}
+	for _, destination := range reader.Strings("destinations") {
+		job.Destinations = append(job.Destinations, SplitDestinations(destination)...)
+	}
+	job.Destinations = removeDuplicates(job.Destinations)
+	if dir := reader.String("dir", ""); dir != "" {
+		job.Directories = append(job.Directories, dir)
+	}
+	job.Directories = removeDuplicates(append(job.Directories, reader.Strings("dirs")...))
+	if validate {
+		validateDirectoryJob(reader, job)
+	}
+	return job
+}
+
+func validateDirectoryJob(reader *tomlReader, job DirectoryJob) {
+	requireString(reader, "name", job.Name)
+	if len(job.Destinations) == 0 {
+		reader.Problem("destinations", "bucket or destinations is required")
+	}
+	requirePrefix(reader, "prefix", job.Prefix)
+	if len(job.Directories) == 0 {
+		reader.Problem("dirs", "dir or dirs is required")
+	}
+	for _, dir := range job.Directories {
+		requireDirectory(reader, "dirs", dir)
+	}
+	if job.IgnoreFile != "" {
+		requireFile(reader, "ignoreFile", job.IgnoreFile)
+	}
+	validateSchedule(reader, job.Schedule)
+	validateHourly(reader, job.Rotation, job.Destinations, job.Repository)
+}
+
+/**
+ * Parse the legacy comma separated ${BucketName}|${prefix}|${dirPath} string,
+ * entries sharing destinations and prefix become one job named after the prefix
+ */
+func readLegacyDirs(reader *tomlReader, defaults DirectoryJob, validate bool) []DirectoryJob {
+	dirs := reader.String("dirs", "")
+	targetDirs := removeDuplicates(strings.Split(dirs, ","))
+
+	jobs := []DirectoryJob{}
+	jobIndex := map[string]int{}
+	for _, nextTarget := range targetDirs {
+		nextTarget = strings.TrimSpace(nextTarget)
+		if nextTarget == "" {
+			continue
+		}
+		parts := strings.SplitN(nextTarget, "|", 3)
+		if len(parts) != 3 {
+			reader.Problem("dirs", "entry %q, expected bucket|prefix|dir", nextTarget)
+			continue
+		}
+		destinations := SplitDestinations(parts[0])
+		prefix := strings.TrimSpace(parts[1])
+		targetDir := strings.TrimSpace(parts[2])
+
+		bucketKey := fmt.Sprintf("%s:%s", strings.Join(destinations, DestinationSeparator), prefix)
+		index, exists := jobIndex[bucketKey]
+		if !exists {
+			job := defaults
+			job.Name = prefix
+			job.Prefix = prefix
+			job.Destinations = destinations
+			job.Directories = []string{}
+			for suffix := 2; jobNameTaken(jobs, job.Name); suffix++ {
+				job.Name = fmt.Sprintf("%s-%d", prefix, suffix)
+			}
+			jobs = append(jobs, job)
+			index = len(jobs) - 1
+			jobIndex[bucketKey] = index
+		}
+		jobs[index].Directories = append(jobs[index].Directories, targetDir)
+	}
+	if validate {
+		for _, job := range jobs {
+			validateDirectoryJob(reader, job)
+		}
+	}
+	return jobs
+}
+
+func readTypesense(tree *toml.Tree, problems *[]string) TypesenseConfig {
+	reader := section(tree, "typesensebackup", problems)
+	conf := TypesenseConfig{
+		Enabled:         reader.Bool("enabled", false),
+		Schedule:        readSchedule(reader, defaultSchedule),
+		Lock:            readLock(reader, defaultLock),
+		Retry:           readRetry(reader, defaultRetry),
+		Workers:         readWorkers(reader, defaultWorkers),
+		Throttle:        readThrottle(reader, ThrottleConfig{}),
+		TargetDir:       reader.String("targetDir", ""),
+		TypesenseUrl:    reader.String("typesenseUrl", "http://localhost:8108"),
+		TypesenseApiKey: reader.Secret("typesenseApiKey", ""),
+		Destinations:    SplitDestinations(reader.String("bucket", "")),
+		BucketPrefix:    reader.String("bucketPrefix", ""),
+		Rotation:        readRotation(reader, defaultRotation),
+		Storage:         readStorage(reader, defaultStorage),
+	}
+	if !conf.Enabled {
+		return conf
+	}
+	validateSchedule(reader, conf.Schedule)
+	requireString(reader, "targetDir", conf.TargetDir)
+	requireString(reader, "typesenseUrl", conf.TypesenseUrl)
+	requireString(reader, "typesenseApiKey", conf.TypesenseApiKey)
+	if len(conf.Destinations) == 0 {
+		reader.Problem("bucket", "is required")
+	}
+	requirePrefix(reader, "bucketPrefix", conf.BucketPrefix)
+	validateHourly(reader, conf.Rotation, conf.Destinations, false)
+	return conf
+}
+
+/**
+ * Split a bucket setting into its destinations
+ */
+func SplitDestinations(value string) []string {
+	result := []string{}
+	for _, next := range strings.Split(value, DestinationSeparator) {
+		next = strings.TrimSpace(next)
+		if next == "" {
+			continue
+		}
+		result = append(result, next)
+	}
+	return removeDuplicates(result)
+}
+
+func requireString(reader *tomlReader, key string, value string) {
+	if strings.TrimSpace(value) == "" {
+		reader.Problem(key, "is required")
+	}
+}
+
+func requirePositive(reader *tomlReader, key string, value int) {
+	if value <= 0 {
+		reader.Problem(key, "must be greater than 0")
+	}
+}
+
+/**
+ * Hourly snapshots are copies of the whole daily snapshot made by every run. file:// and sftp:// destinations have no
+ * server side copy and would read and write everything again each time, only a repository copies its manifest instead
+ */
+func validateHourly(reader *tomlReader, rotation RotationConfig, destinations []string, repository bool) {
+	if rotation.HourlyRotation <= 0 || repository {
+		return
+	}
+	for _, destination := range destinations {
+		if strings.HasPrefix(destination, "file://") || strings.HasPrefix(destination, "sftp://") {
+			reader.Problem("keepHourly", "%s has no server side copy, every run would copy the whole snapshot; use repository = true or keepHourly = 0", destination)
+		}
+	}
+}
+
+func requirePrefix(reader *tomlReader, key string, value string) {
+	if strings.TrimSpace(value) == "" {
+		reader.Problem(key, "is required")
+		return
+	}
+	if strings.Contains(value, "/") {
+		reader.Problem(key, "can't contain /")
+	}
+}
+
+func requireDirectory(reader *tomlReader, key string, dir string) {
+	stat, err := os.Stat(dir)
+	if err != nil {
+		reader.Problem(key, "%v", err)
+		return
+	}
+	if !stat.IsDir() {
+		reader.Problem(key, "%s is not a directory", dir)
+	}
+}
+
+func requireFile(reader *tomlReader, key string, file string) {
+	stat, err := os.Stat(file)
 	if err != nil {
-		fmt.Println("TomlError ", err.Error())
+		reader.Problem(key, "%v", err)
+		return
 	}
+	if stat.IsDir() {
+		reader.Problem(key, "%s is a directory", file)
+	}
+}
+
+func jobNameTaken(jobs []DirectoryJob, name string) bool {
+	for _, job := range jobs {
+		if job.Name == name {
+			return true
+		}
+	}
+	return false
+}
 
-	return config
+func removeDuplicates(elements []string) []string {
+	encountered := map[string]bool{}
+	result := []string{}
+	for _, element := range elements {
+		if encountered[element] {
+			continue
+		}
+		encountered[element] = true
+		result = append(result, element)
+	}
+	return result
 }
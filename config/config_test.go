@@ -0,0 +1,53 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestKeepHourlyRequiresServerSideCopy(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name        string
+		destination string
+		repository  bool
+		problem     bool
+	}{
+		{"bucket", "my-bucket", false, false},
+		{"file", "file:///mnt/nas/backups", false, true},
+		{"sftp", "sftp://backup@nas/backups", false, true},
+		{"file repository", "file:///mnt/nas/backups", true, false},
+		{"sftp repository", "sftp://backup@nas/backups", true, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			repository := "false"
+			if test.repository {
+				repository = "true"
+			}
+			content := `
+[dirbackup]
+    enabled = true
+    keepHourly = 24
+
+[[dirbackup.jobs]]
+    name = "job"
+    dirs = ["` + dir + `"]
+    destinations = ["` + test.destination + `"]
+    prefix = "job"
+    repository = ` + repository + `
+`
+			path := filepath.Join(t.TempDir(), "config.toml")
+			if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			_, err := Load(path)
+			rejected := err != nil && strings.Contains(err.Error(), "keepHourly")
+			if rejected != test.problem {
+				t.Errorf("expected a keepHourly problem: %v, got %v", test.problem, err)
+			}
+		})
+	}
+}
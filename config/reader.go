@@ -0,0 +1,157 @@
+package config
+
+import (
+	"fmt"
+
+	"github.com/pelletier/go-toml"
+)
+
+/**
+ * Typed access to the optional keys of a toml table.
+ * Type errors are collected on problems with the full key name, so every one of them can be reported at once
+ */
+type tomlReader struct {
+	tree     *toml.Tree
+	section  string
+	problems *[]string
+}
+
+func newTomlReader(tree *toml.Tree, section string, problems *[]string) *tomlReader {
+	if tree == nil {
+		tree, _ = toml.TreeFromMap(map[string]interface{}{})
+	}
+	return &tomlReader{
+		tree:     tree,
+		section:  section,
+		problems: problems,
+	}
+}
+
+func (reader *tomlReader) Has(key string) bool {
+	return reader.tree.Has(key)
+}
+
+func (reader *tomlReader) String(key string, fallback string) string {
+	if !reader.tree.Has(key) {
+		return fallback
+	}
+	value, ok := reader.tree.Get(key).(string)
+	if !ok {
+		reader.fail(key, "a string")
+		return fallback
+	}
+	return reader.expand(key, value, fallback)
+}
+
+/**
+ * A credential given either inline as key or read from the file at key_file.
+ * Setting both on the same table is a problem, setting none keeps the fallback
+ * so a job inherits the credentials of its section
+ */
+func (reader *tomlReader) Secret(key string, fallback string) string {
+	fileKey := key + secretFileSuffix
+	if !reader.tree.Has(fileKey) {
+		return reader.String(key, fallback)
+	}
+	if reader.tree.Has(key) {
+		reader.Problem(fileKey, "can't be used together with %s", reader.name(key))
+		return fallback
+	}
+	path := reader.String(fileKey, "")
+	if path == "" {
+		reader.Problem(fileKey, "is empty")
+		return fallback
+	}
+	value, err := readSecretFile(path)
+	if err != nil {
+		reader.Problem(fileKey, "unable to read secret: %v", err)
+		return fallback
+	}
+	return value
+}
+
+func (reader *tomlReader) Int(key string, fallback int) int {
+	if !reader.tree.Has(key) {
+		return fallback
+	}
+	value, ok := reader.tree.Get(key).(int64)
+	if !ok {
+		reader.fail(key, "an integer")
+		return fallback
+	}
+	return int(value)
+}
+
+func (reader *tomlReader) Bool(key string, fallback bool) bool {
+	if !reader.tree.Has(key) {
+		return fallback
+	}
+	value, ok := reader.tree.Get(key).(bool)
+	if !ok {
+		reader.fail(key, "true or false")
+		return fallback
+	}
+	return value
+}
+
+func (reader *tomlReader) Strings(key string) []string {
+	result := []string{}
+	if !reader.tree.Has(key) {
+		return result
+	}
+	values, ok := reader.tree.Get(key).([]interface{})
+	if !ok {
+		reader.fail(key, "an array of strings")
+		return result
+	}
+	for _, next := range values {
+		value, ok := next.(string)
+		if !ok {
+			reader.fail(key, "an array of strings")
+			return []string{}
+		}
+		expanded, err := interpolate(value)
+		if err != nil {
+			reader.Problem(key, "%v", err)
+			continue
+		}
+		result = append(result, expanded)
+	}
+	return result
+}
+
+func (reader *tomlReader) Tables(key string) []*toml.Tree {
+	if !reader.tree.Has(key) {
+		return []*toml.Tree{}
+	}
+	tables, ok := reader.tree.Get(key).([]*toml.Tree)
+	if !ok {
+		reader.fail(key, fmt.Sprintf("an array of tables, use [[%s]]", reader.name(key)))
+		return []*toml.Tree{}
+	}
+	return tables
+}
+
+func (reader *tomlReader) Problem(key string, format string, args ...interface{}) {
+	*reader.problems = append(*reader.problems, fmt.Sprintf("%s: %s", reader.name(key), fmt.Sprintf(format, args...)))
+}
+
+func (reader *tomlReader) expand(key string, value string, fallback string) string {
+	expanded, err := interpolate(value)
+	if err != nil {
+		reader.Problem(key, "%v", err)
+		return fallback
+	}
+	return expanded
+}
+
+func (reader *tomlReader) fail(key string, expected string) {
+	reader.Problem(key, "must be %s", expected)
+}
+
+func (reader *tomlReader) name(key string) string {
+	if reader.section == "" {
+		return key
+	}
+	return fmt.Sprintf("%s.%s", reader.section, key)
+}
@@ -0,0 +1,82 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+/**
+ * Suffix of the keys reading a secret from a file, e.g. password_file
+ */
+const secretFileSuffix = "_file"
+
+/**
+ * Expand ${NAME} and ${NAME:-default} with the environment.
+ * $$ is a literal $, any other $ is kept as is so plain passwords don't need escaping.
+ * Expanded values are not expanded again
+ */
+func interpolate(value string) (string, error) {
+	if !strings.Contains(value, "$") {
+		return value, nil
+	}
+	var result strings.Builder
+	for index := 0; index < len(value); index++ {
+		if value[index] != '$' || index+1 == len(value) {
+			result.WriteByte(value[index])
+			continue
+		}
+		switch value[index+1] {
+		case '$':
+			result.WriteByte('$')
+			index++
+		case '{':
+			end := strings.IndexByte(value[index:], '}')
+			if end < 0 {
+				return "", fmt.Errorf("unterminated ${ in %q", value)
+			}
+			expression := value[index+2 : index+end]
+			name, fallback, hasFallback := strings.Cut(expression, ":-")
+			if !validEnvName(name) {
+				return "", fmt.Errorf("invalid environment variable name %q", name)
+			}
+			env, found := os.LookupEnv(name)
+			if !found || (env == "" && hasFallback) {
+				if !hasFallback {
+					return "", fmt.Errorf("environment variable %s is not set", name)
+				}
+				env = fallback
+			}
+			result.WriteString(env)
+			index += end
+		default:
+			result.WriteByte('$')
+		}
+	}
+	return result.String(), nil
+}
+
+func validEnvName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for index, char := range name {
+		letter := char == '_' || (char >= 'a' && char <= 'z') || (char >= 'A' && char <= 'Z')
+		digit := char >= '0' && char <= '9'
+		if !letter && !(digit && index > 0) {
+			return false
+		}
+	}
+	return true
+}
+
+/**
+ * Read a secret from a mounted file, trailing line breaks are removed
+ */
+func readSecretFile(path string) (string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(content), "\r\n"), nil
+}
@@ -0,0 +1,191 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pelletier/go-toml"
+)
+
+func TestInterpolate(t *testing.T) {
+	t.Setenv("BACKUP_USER", "nacho")
+	t.Setenv("BACKUP_EMPTY", "")
+	t.Setenv("BACKUP_NESTED", "${BACKUP_USER}")
+	os.Unsetenv("BACKUP_UNSET")
+
+	tests := []struct {
+		value    string
+		expected string
+		err      string
+	}{
+		{"plain", "plain", ""},
+		{"${BACKUP_USER}", "nacho", ""},
+		{"user=${BACKUP_USER}@host", "user=nacho@host", ""},
+		{"${BACKUP_UNSET:-fallback}", "fallback", ""},
+		{"${BACKUP_USER:-fallback}", "nacho", ""},
+		// an empty variable takes the default too
+		{"${BACKUP_EMPTY:-fallback}", "fallback", ""},
+		{"${BACKUP_EMPTY}", "", ""},
+		{"${BACKUP_UNSET:-}", "", ""},
+		// expanded values are not expanded again
+		{"${BACKUP_NESTED}", "${BACKUP_USER}", ""},
+		{"$${BACKUP_USER}", "${BACKUP_USER}", ""},
+		{"pa$$word", "pa$word", ""},
+		// a $ not starting an expression is kept, so plain passwords need no escaping
+		{"pa$word", "pa$word", ""},
+		{"trailing$", "trailing$", ""},
+		{"${BACKUP_UNSET}", "", "BACKUP_UNSET is not set"},
+		{"${BACKUP_USER", "", "unterminated"},
+		{"${}", "", "invalid environment variable name"},
+		{"${1USER}", "", "invalid environment variable name"},
+		{"${BACKUP-USER}", "", "invalid environment variable name"},
+		{"${BACKUP USER:-x}", "", "invalid environment variable name"},
+	}
+	for _, test := range tests {
+		got, err := interpolate(test.value)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("interpolate(%q): expected an error containing %q, got %q, %v", test.value, test.err, got, err)
+			}
+			continue
+		}
+		if err != nil || got != test.expected {
+			t.Errorf("interpolate(%q) = %q, %v, expected %q", test.value, got, err, test.expected)
+		}
+	}
+}
+
+func TestReadSecretFile(t *testing.T) {
+	tests := map[string]string{
+		"secret\n":             "secret",
+		"secret\r\n":           "secret",
+		"secret\n\n":           "secret",
+		"secret":               "secret",
+		"  spaced secret \n":   "  spaced secret ",
+		"first\nsecond line\n": "first\nsecond line",
+	}
+	dir := t.TempDir()
+	for content, expected := range tests {
+		path := filepath.Join(dir, "secret")
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		got, err := readSecretFile(path)
+		if err != nil || got != expected {
+			t.Errorf("readSecretFile(%q) = %q, %v, expected %q", content, got, err, expected)
+		}
+	}
+	if _, err := readSecretFile(filepath.Join(dir, "missing")); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
+
+func writeSecret(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func readerFor(t *testing.T, content string, problems *[]string) *tomlReader {
+	t.Helper()
+	tree, err := toml.Load(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newTomlReader(tree, "section", problems)
+}
+
+func TestSecret(t *testing.T) {
+	t.Setenv("BACKUP_SECRET", "from env")
+	secretFile := writeSecret(t, "from file\n")
+
+	tests := []struct {
+		name     string
+		toml     string
+		expected string
+		problem  string
+	}{
+		{"inline", `password = "inline"`, "inline", ""},
+		{"inline with the environment", `password = "${BACKUP_SECRET}"`, "from env", ""},
+		{"file", `password_file = "` + secretFile + `"`, "from file", ""},
+		{"nothing keeps the fallback", ``, "fallback", ""},
+		{"both set", `password = "inline"` + "\n" + `password_file = "` + secretFile + `"`, "fallback", "section.password_file: can't be used together with section.password"},
+		{"empty file path", `password_file = ""`, "fallback", "section.password_file: is empty"},
+		{"missing file", `password_file = "` + filepath.Join(t.TempDir(), "missing") + `"`, "fallback", "section.password_file: unable to read secret"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			problems := []string{}
+			got := readerFor(t, test.toml, &problems).Secret("password", "fallback")
+			if got != test.expected {
+				t.Errorf("got %q, expected %q", got, test.expected)
+			}
+			if test.problem == "" && len(problems) > 0 {
+				t.Errorf("unexpected problems %v", problems)
+			}
+			if test.problem != "" && (len(problems) != 1 || !strings.HasPrefix(problems[0], test.problem)) {
+				t.Errorf("expected the problem %q, got %v", test.problem, problems)
+			}
+		})
+	}
+}
+
+func TestJobSecretOverridesSection(t *testing.T) {
+	sectionFile := writeSecret(t, "section secret\n")
+	jobFile := writeSecret(t, "job secret\r\n")
+	content := `
+[dirbackup]
+    enabled = false
+    key = "section key"
+    secret_file = "` + sectionFile + `"
+
+[[dirbackup.jobs]]
+    name = "inherits"
+    dirs = ["/tmp"]
+    destinations = ["bucket"]
+    prefix = "inherits"
+
+[[dirbackup.jobs]]
+    name = "file"
+    dirs = ["/tmp"]
+    destinations = ["bucket"]
+    prefix = "file"
+    secret_file = "` + jobFile + `"
+
+[[dirbackup.jobs]]
+    name = "inline"
+    dirs = ["/tmp"]
+    destinations = ["bucket"]
+    prefix = "inline"
+    secret = "job inline"
+`
+	path := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	conf, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.DirBackup.Storage.Secret != "section secret" {
+		t.Errorf("section secret %q", conf.DirBackup.Storage.Secret)
+	}
+	expected := map[string]string{
+		"inherits": "section secret",
+		"file":     "job secret",
+		"inline":   "job inline",
+	}
+	for _, job := range conf.DirBackup.Jobs {
+		if job.Storage.Secret != expected[job.Name] {
+			t.Errorf("job %s: secret %q, expected %q", job.Name, job.Storage.Secret, expected[job.Name])
+		}
+		if job.Storage.Key != "section key" {
+			t.Errorf("job %s: key %q not inherited", job.Name, job.Storage.Key)
+		}
+	}
+}
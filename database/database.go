@@ -3,6 +3,7 @@ package database
 import (
 	"archive/tar"
 	"compress/gzip"
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
@@ -17,12 +18,8 @@ import (
 
 	"playus/server-backup/config"
 	"playus/server-backup/directory"
+	"playus/server-backup/retention"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/fatih/color"
 
 	_ "github.com/go-sql-driver/mysql"
@@ -45,19 +42,18 @@ type Options struct {
 	OutputDirectory          string
 	DefaultsProvidedByUser   bool
 	ExecutionStartDate       time.Time
-	DailyRotation            int
-	WeeklyRotation           int
-	MonthlyRotation          int
 }
 
 type DatabaseBackupWorker struct {
-	S3Enabled bool
-	Key       string
-	Secret    string
-	Region    string
-	Endpoint  string
-	S3Key     string
-	Bucket    string
+	Conf         config.DatabaseConfig
+	S3Enabled    bool
+	S3Key        string
+	Destinations []string
+	Storage      directory.StorageOptions
+	Lock         config.LockConfig
+	Retry        directory.RetryPolicy
+	Workers      int
+	Retention    retention.Policy
 }
 
 const (
@@ -71,58 +67,77 @@ const (
 	Error = 1 << iota // c == 4
 )
 
-var (
-	Worker = newDatabaseBackupWorker()
-)
-
-func newDatabaseBackupWorker() *DatabaseBackupWorker {
+func NewWorker(conf *config.Config) *DatabaseBackupWorker {
 	worker := &DatabaseBackupWorker{
-		S3Enabled: config.Conf.Get("database.s3Backup").(bool),
-		Key:       config.Conf.Get("database.key").(string),
-		Secret:    config.Conf.Get("database.secret").(string),
-		Region:    config.Conf.Get("database.region").(string),
-		Endpoint:  config.Conf.Get("database.endpoint").(string),
-		S3Key:     config.Conf.Get("database.s3Key").(string),
-		Bucket:    config.Conf.Get("database.bucket").(string),
+		Conf:         conf.Database,
+		S3Enabled:    conf.Database.S3Backup,
+		S3Key:        conf.Database.S3Key,
+		Destinations: conf.Database.Destinations,
+		Storage:      directory.NewStorageOptions(conf.Database.Storage, conf.Database.Throttle),
+		Lock:         conf.Database.Lock,
+		Retry:        directory.NewRetryPolicy(conf.Database.Retry),
+		Workers:      conf.Database.Workers,
+		Retention:    directory.NewRetentionPolicy(conf.Database.Rotation),
 	}
 	return worker
 }
 
-func (worker *DatabaseBackupWorker) DoBackup() {
+/**
+ * Apply the retention on every destination, see directory.Prune
+ */
+func (worker *DatabaseBackupWorker) DoPrune(ctx context.Context, dryRun bool) error {
+	if !worker.S3Enabled {
+		fmt.Println("Nothing to prune, s3Backup is disabled")
+		return nil
+	}
+	return directory.Prune(ctx, "database", worker.Destinations, worker.S3Key, worker.Storage, worker.Lock, worker.Retention, 0, time.Now, dryRun)
+}
+
+/**
+ * Dump and upload every configured database, returns a *directory.RunError unless every database succeeded
+ */
+func (worker *DatabaseBackupWorker) DoBackup(ctx context.Context) error {
+	conf := worker.Conf
 	options := NewOptions(
-		config.Conf.Get("database.hostname").(string),
-		config.Conf.Get("database.port").(string),
-		config.Conf.Get("database.username").(string),
-		config.Conf.Get("database.password").(string),
-		config.Conf.Get("database.database").(string), // comma separated,
-		"", // excluded databases
-		int(config.Conf.Get("database.dbthreshold").(int64)),    //dbthreshold
-		int(config.Conf.Get("database.tablethreshold").(int64)), // tablethreshold
-		int(config.Conf.Get("database.batchsize").(int64)),      // batchsize
+		conf.Hostname,
+		conf.Port,
+		conf.Username,
+		conf.Password,
+		conf.Databases, // comma separated,
+		"",             // excluded databases
+		conf.DBThreshold,
+		conf.TableThreshold,
+		conf.BatchSize,
 		false, // forcesplit
 		"",    // additionals
-		int(config.Conf.Get("database.verbosity").(int64)), // verbosity
-		config.Conf.Get("database.mysqldumppath").(string),
-		config.Conf.Get("database.outdir").(string),
-		true,
-		int(config.Conf.Get("database.dailyrotation").(int64)),
-		int(config.Conf.Get("database.weeklyrotation").(int64)),
-		int(config.Conf.Get("database.monthlyrotation").(int64)))
+		conf.Verbosity,
+		conf.MySQLDumpPath,
+		conf.OutDir,
+		true)
 
+	outcomes := []error{}
 	for _, db := range options.Databases {
+		if ctx.Err() != nil {
+			PrintMessage("Database backup canceled: "+ctx.Err().Error(), options.Verbosity, Error)
+			return directory.Summarize("database", append(outcomes, ctx.Err()))
+		}
 		PrintMessage("Processing Database : "+db, options.Verbosity, Info)
 
-		file, err := worker.GenerateSingleFileBackup(*options, db)
-		if file != nil && err == nil {
-			worker.upload(*file, *options)
+		file, err := worker.GenerateSingleFileBackup(ctx, *options, db)
+		if err == nil && file != nil {
+			err = worker.upload(ctx, *file, *options)
+		}
+		if err != nil {
+			err = fmt.Errorf("database %s: %w", db, err)
 		}
+		outcomes = append(outcomes, err)
 
 		PrintMessage("Processing done for database : "+db, options.Verbosity, Info)
 	}
-
+	return directory.Summarize("database", outcomes)
 }
 
-func (worker *DatabaseBackupWorker) GenerateSingleFileBackup(options Options, db string) (*string, error) {
+func (worker *DatabaseBackupWorker) GenerateSingleFileBackup(ctx context.Context, options Options, db string) (*string, error) {
 	PrintMessage("Generating single file backup : "+db, options.Verbosity, Info)
 
 	var args []string
@@ -145,7 +160,7 @@ func (worker *DatabaseBackupWorker) GenerateSingleFileBackup(options Options, db
 
 	PrintMessage("mysqldump is being executed with parameters : "+strings.Join(args, " "), options.Verbosity, Info)
 
-	cmd := exec.Command(options.MySQLDumpPath, args...)
+	cmd := exec.CommandContext(ctx, options.MySQLDumpPath, args...)
 	cmdOut, _ := cmd.StdoutPipe()
 	cmdErr, _ := cmd.StderrPipe()
 
@@ -241,7 +256,7 @@ func PrintMessage(message string, verbosity int, messageType int) {
 	}
 }
 
-func NewOptions(hostname string, bind string, username string, password string, databases string, excludeddatabases string, databasetreshold int, tablethreshold int, batchsize int, forcesplit bool, additionals string, verbosity int, mysqldumppath string, outputDirectory string, defaultsProvidedByUser bool, dailyrotation int, weeklyrotation int, monthlyrotation int) *Options {
+func NewOptions(hostname string, bind string, username string, password string, databases string, excludeddatabases string, databasetreshold int, tablethreshold int, batchsize int, forcesplit bool, additionals string, verbosity int, mysqldumppath string, outputDirectory string, defaultsProvidedByUser bool) *Options {
 
 	databases = strings.Replace(databases, " ", "", -1)
 	databases = strings.Replace(databases, " , ", ",", -1)
@@ -287,9 +302,6 @@ func NewOptions(hostname string, bind string, username string, password string,
 		OutputDirectory:          outputDirectory,
 		DefaultsProvidedByUser:   defaultsProvidedByUser,
 		ExecutionStartDate:       time.Now(),
-		DailyRotation:            dailyrotation,
-		WeeklyRotation:           weeklyrotation,
-		MonthlyRotation:          monthlyrotation,
 	}
 }
 
@@ -321,39 +333,20 @@ func GetDatabaseList(hostname string, bind string, username string, password str
 	return result
 }
 
-func (worker *DatabaseBackupWorker) upload(file string, dbOptions Options) {
+func (worker *DatabaseBackupWorker) upload(ctx context.Context, file string, dbOptions Options) error {
 	if !worker.S3Enabled {
-		return
-	}
-	session, err := session.NewSession(&aws.Config{
-		Region:      aws.String(worker.Region),
-		Credentials: credentials.NewStaticCredentials(worker.Key, worker.Secret, ""),
-		Endpoint:    aws.String(worker.Endpoint),
-	})
-	if checkErr(err) {
-		return
+		return nil
 	}
-
-	// Create S3 service client
-	s3Client := s3.New(session)
-	if s3Client == nil {
-		return
-	}
-
-	uploader := s3manager.NewUploader(session)
-	if uploader == nil {
-		return
-	}
-	downloader := s3manager.NewDownloader(session)
-	if downloader == nil {
-		return
-	}
-
-	addHandler := directory.NewAddHandler(worker.Bucket, worker.S3Key, path.Dir(file), s3Client, uploader, downloader, nil, dbOptions.DailyRotation, dbOptions.WeeklyRotation, dbOptions.MonthlyRotation)
-	addHandler.Handle()
-
-	removeHandler := directory.NewRemoveHandler(worker.Bucket, worker.S3Key, path.Dir(file), s3Client, uploader, downloader, dbOptions.DailyRotation, dbOptions.WeeklyRotation, dbOptions.MonthlyRotation)
-	removeHandler.Handle()
+	results := directory.Replicate(ctx, worker.Destinations, worker.S3Key, worker.Storage, directory.LockedRun(worker.S3Key, "database", worker.Lock, func(ctx context.Context, storage directory.Storage) error {
+		manifest := directory.NewManifestBuilder("database", time.Now(), nil)
+		addHandler := directory.NewAddHandler(storage, worker.S3Key, path.Dir(file), nil, worker.Retention, worker.Retry, worker.Workers, nil, manifest)
+		addErr := addHandler.Handle(ctx)
+
+		removeHandler := directory.NewRemoveHandler(storage, worker.S3Key, path.Dir(file), worker.Retention, manifest)
+		return errors.Join(addErr, removeHandler.Handle(ctx))
+	}))
+	directory.PrintReport(worker.S3Key, results)
+	return directory.ReplicationError(worker.S3Key, results)
 }
 
 func checkErr(err error) bool {
@@ -1,60 +1,109 @@
 package directory
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"os"
 	"path/filepath"
 	"sort"
 	"time"
 
-	ignore "github.com/sabhiram/go-gitignore"
+	"playus/server-backup/retention"
 
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	ignore "github.com/sabhiram/go-gitignore"
 )
 
 type AddHandler struct {
-	Bucket          string
-	Dir             string
-	Prefix          string
-	util            *S3Util
-	dailyRotation   int
-	weeklyRotation  int
-	monthlyRotation int
-	IgnoreObject    *ignore.GitIgnore
+	Dir     string
+	Prefix  string
+	Storage Storage
+	// a rotation is only written when the policy keeps some of its snapshots
+	Retention    retention.Policy
+	IgnoreObject *ignore.GitIgnore
+	Retry        RetryPolicy
+	// uploads running at once
+	Workers   int
+	CheckSums *ChecksumCache
+	// files and snapshots of the run, shared by the directories of a job
+	Manifest *ManifestBuilder
+	// store chunks instead of files when set
+	Repository *Repository
+	// codec compressing the uploaded files, none when empty
+	Compression string
 }
 
-func NewAddHandler(bucket string, prefix string, dir string, s3Client *s3.S3, uploader *s3manager.Uploader, downloader *s3manager.Downloader, ignoreObject *ignore.GitIgnore, dailyRotation int, weeklyRotation int, monthlyRotation int) *AddHandler {
+/**
+ * Handler uploading dir into the snapshot of manifest.ID. checkSums may be nil to only keep the checksums during the run
+ */
+func NewAddHandler(storage Storage, prefix string, dir string, ignoreObject *ignore.GitIgnore, policy retention.Policy, retry RetryPolicy, workers int, checkSums *ChecksumCache, manifest *ManifestBuilder) *AddHandler {
+	if checkSums == nil {
+		checkSums = newMemoryChecksumCache()
+	}
 	return &AddHandler{
-		Bucket:          bucket,
-		Dir:             dir,
-		Prefix:          prefix,
-		util:            NewS3Util(bucket, prefix, dir, s3Client, uploader, downloader),
-		dailyRotation:   dailyRotation,
-		weeklyRotation:  weeklyRotation,
-		monthlyRotation: monthlyRotation,
-		IgnoreObject:    ignoreObject,
+		Dir:          dir,
+		Prefix:       prefix,
+		Storage:      storage,
+		Retention:    policy,
+		IgnoreObject: ignoreObject,
+		Retry:        retry,
+		Workers:      workers,
+		CheckSums:    checkSums,
+		Manifest:     manifest,
 	}
 }
 
-func (handler *AddHandler) Handle() {
-	fmt.Printf("Starting add handler for bucket %s in directory %s \n", handler.Bucket, handler.Dir)
+func (handler *AddHandler) Handle(ctx context.Context) error {
+	fmt.Printf("Starting add handler for %s in directory %s \n", handler.Storage, handler.Dir)
 
-	handler.handleDailyRotation()
-	handler.handleRotations()
+	err := handler.handleDailyRotation(ctx)
+	if err != nil {
+		// weekly and monthly snapshots are copies of the daily one, promote it once complete
+		fmt.Printf("Not promoting %s/%s: the daily snapshot failed\n", handler.Storage, handler.Prefix)
+		handler.Manifest.Fail()
+		return err
+	}
+	err = handler.handleRotations(ctx)
+	if err != nil {
+		handler.Manifest.Fail()
+	}
+	return err
 }
 
-func (handler *AddHandler) handleRotations() {
-	handler.handleRotation(WEEKLY, 7)
-	handler.handleRotation(MONTHLY, 30)
+/**
+ * Promote the daily snapshot to the rotations the policy keeps, a count of 0 means the rotation isn't written
+ */
+func (handler *AddHandler) handleRotations(ctx context.Context) error {
+	var hourlyErr, weeklyErr, monthlyErr error
+	if handler.Retention.Hourly > 0 {
+		// the daily snapshot changes with every run of the day, keep each run as it was.
+		// A full copy per run, one CopyObject per file, see keepHourly in the README
+		hourlyErr = handler.promoteDaily(ctx, HOURLY)
+	}
+	if handler.Retention.Weekly > 0 {
+		weeklyErr = handler.handleRotation(ctx, WEEKLY, 7)
+	}
+	if handler.Retention.Monthly > 0 || handler.Retention.Yearly > 0 {
+		// yearly snapshots are the monthly ones kept longer
+		monthlyErr = handler.handleRotation(ctx, MONTHLY, 30)
+	}
+	return errors.Join(hourlyErr, weeklyErr, monthlyErr)
 }
 
-func (handler *AddHandler) handleRotation(key string, days int) {
-	previous := handler.util.GetTopDirectories(key)
+func (handler *AddHandler) handleRotation(ctx context.Context, key string, days int) error {
+	previous, err := ListSnapshotIDs(handler.Storage, handler.Prefix, key)
+	if checkErr(err) {
+		return err
+	}
 	previousList := []dirDate{}
 	if len(previous) > 0 {
 		for _, next := range previous {
-			dayTime, _ := time.Parse(RFC3339NoTime, next)
+			dayTime, err := ParseSnapshotID(next)
+			if err != nil {
+				fmt.Printf("Ignoring %s/%s/%s: not a snapshot, %v\n", handler.Prefix, key, next, err)
+				continue
+			}
 			previousList = append(previousList, dirDate{Value: next, DayTime: dayTime})
 		}
 	}
@@ -64,47 +113,179 @@ func (handler *AddHandler) handleRotation(key string, days int) {
 	if len(previousList) > 0 {
 		now := time.Now()
 		lastDate := previousList[(len(previousList) - 1)]
+		if lastDate.Value == handler.Manifest.ID {
+			// promoted earlier today, e.g. by another directory of the job, copy what is missing
+			return handler.promoteDaily(ctx, key)
+		}
 		diff := now.Sub(lastDate.DayTime)
 		elapsedDays := int(diff.Hours() / 24)
 		if elapsedDays > days {
 			// create a new entry for the month
 			// next run of removeHandler deletes based on rotation option
-			handler.uploadDirectory(key)
+			return handler.promoteDaily(ctx, key)
+		}
+		return nil
+	}
+	return handler.promoteDaily(ctx, key)
+}
+
+/**
+ * Build today's snapshot of the rotation by copying the files of the run from today's daily snapshot on the storage,
+ * so every rotation holds the same files and nothing is uploaded twice. Objects copied since their last upload are skipped
+ */
+func (handler *AddHandler) promoteDaily(ctx context.Context, rotation string) error {
+	if handler.Repository != nil {
+		// the manifest of the daily snapshot is written to the rotation too, with the same chunks
+		return handler.Manifest.Start(handler.Storage, handler.Prefix, rotation)
+	}
+	sourcePrefix := fmt.Sprintf("%s/%s/%s/", handler.Prefix, DAILY, handler.Manifest.ID)
+	targetPrefix := fmt.Sprintf("%s/%s/%s/", handler.Prefix, rotation, handler.Manifest.SnapshotID(rotation))
+	if err := handler.Manifest.Start(handler.Storage, handler.Prefix, rotation); checkErr(err) {
+		return err
+	}
+	var source, target SnapshotIndex
+	_, err := handler.Retry.Do(ctx, sourcePrefix, func() error {
+		var listErr error
+		source, listErr = ListSnapshot(handler.Storage, sourcePrefix)
+		if listErr != nil {
+			return listErr
+		}
+		target, listErr = ListSnapshot(handler.Storage, targetPrefix)
+		return listErr
+	})
+	if checkErr(err) {
+		return err
+	}
+	if len(source) == 0 {
+		// nothing to copy from, e.g. an empty directory
+		return handler.uploadDirectory(ctx, rotation)
+	}
+
+	fmt.Printf("Promoting %s/%s to %s\n", handler.Storage, sourcePrefix, targetPrefix)
+	pool := NewWorkerPool(ctx, handler.Workers)
+	var submitErr error
+	for sourceKey, object := range source {
+		relPath := sourceKey[len(sourcePrefix):]
+		if !handler.Manifest.Has(relPath) {
+			// deleted since, or another directory of the job not uploaded yet
+			continue
+		}
+		targetKey := targetPrefix + relPath
+		if copied, exists := target[targetKey]; exists && copied.Size == object.Size && !copied.LastModified.Before(object.LastModified) {
+			continue
+		}
+		if submitErr = pool.Submit(NewCopyWorker(sourceKey, targetKey, handler.Storage, handler.Retry)); submitErr != nil {
+			break
 		}
-	} else {
-		handler.uploadDirectory(key)
 	}
+	transfers := &TransferError{}
+	transfers.Add(pool.Wait())
+	return errors.Join(submitErr, transfers.Err())
 }
 
-func (handler *AddHandler) handleDailyRotation() {
-	handler.uploadDirectory(DAILY)
+func (handler *AddHandler) handleDailyRotation(ctx context.Context) error {
+	if handler.Repository != nil {
+		return handler.storeDirectory(ctx)
+	}
+	return handler.uploadDirectory(ctx, DAILY)
 }
 
-func (handler *AddHandler) uploadDirectory(rotation string) {
+/**
+ * Store the new and changed files of the directory in the repository
+ */
+func (handler *AddHandler) storeDirectory(ctx context.Context) error {
 	_, err := ioutil.ReadDir(handler.Dir)
 	if err != nil {
-		return
+		handler.Manifest.WalkFailed()
+		return err
+	}
+	if err := handler.Manifest.Start(handler.Storage, handler.Prefix, DAILY); checkErr(err) {
+		return err
+	}
+	pool := NewWorkerPool(ctx, handler.Workers)
+	walkErr := handler.walk(ctx, func(relPath string, absPath string, stat os.FileInfo) error {
+		if previous, unchanged := handler.Repository.Unchanged(relPath, stat); unchanged {
+			handler.Manifest.SetChunks(relPath, previous.SHA256, previous.Chunks)
+			return nil
+		}
+		return pool.Submit(NewChunkWorker(relPath, absPath, handler.Repository, handler.Manifest, handler.Retry))
+	})
+	if walkErr != nil {
+		handler.Manifest.WalkFailed()
+	}
+	transfers := &TransferError{}
+	transfers.Add(pool.Wait())
+	return errors.Join(walkErr, transfers.Err())
+}
+
+func (handler *AddHandler) uploadDirectory(ctx context.Context, rotation string) error {
+	_, err := ioutil.ReadDir(handler.Dir)
+	if err != nil {
+		handler.Manifest.WalkFailed()
+		return err
+	}
+	if err := handler.Manifest.Start(handler.Storage, handler.Prefix, rotation); checkErr(err) {
+		return err
+	}
+	pool := NewWorkerPool(ctx, handler.Workers)
+	walkErr := handler.submitUploads(ctx, pool, rotation)
+	if walkErr != nil {
+		handler.Manifest.WalkFailed()
 	}
-	workQueue := NewWorkerQueue()
+	transfers := &TransferError{}
+	transfers.Add(pool.Wait())
+	return errors.Join(walkErr, transfers.Err())
+}
+
+/**
+ * Walk the directory and submit an upload for every new or changed file
+ */
+func (handler *AddHandler) submitUploads(ctx context.Context, pool *WorkerPool, rotation string) error {
+	targetPrefix := fmt.Sprintf("%s/%s/", rotation, handler.Manifest.SnapshotID(rotation))
+	var snapshot SnapshotIndex
+	_, err := handler.Retry.Do(ctx, handler.Prefix+"/"+targetPrefix, func() error {
+		var listErr error
+		snapshot, listErr = ListSnapshot(handler.Storage, handler.Prefix+"/"+targetPrefix)
+		return listErr
+	})
+	if checkErr(err) {
+		return err
+	}
+
+	return handler.walk(ctx, func(relPath string, absPath string, stat os.FileInfo) error {
+		targetKey := handler.Prefix + "/" + targetPrefix + relPath
+		var previous *ManifestFile
+		if file, exists := handler.Manifest.Previous(rotation, relPath); exists {
+			previous = &file
+		}
+		if checkSum, upToDate := snapshot.UpToDate(handler.Storage, targetKey, absPath, stat, handler.CheckSums, previous); upToDate {
+			handler.Manifest.SetStored(relPath, checkSum, snapshot[targetKey].Size)
+			return nil
+		}
+		return pool.Submit(NewUploadWorker(relPath, targetKey, absPath, handler.Storage, handler.Manifest, handler.Retry, handler.CheckSums, handler.Compression))
+	})
+}
 
+/**
+ * Call fn for every file of the directory not ignored, once recorded on the manifest.
+ * relPath is slash separated and relative to the directory
+ */
+func (handler *AddHandler) walk(ctx context.Context, fn func(relPath string, absPath string, stat os.FileInfo) error) error {
 	queue := NewQueue()
 	queue.Enqueue(handler.Dir)
 
-	now := time.Now()
-	targetPrefix := fmt.Sprintf("%s/%s/", rotation, now.Format(RFC3339NoTime))
-
 	for !queue.Empty() {
-		if workQueue.Size() >= 5 { // TODO: Allow to configure workers
-			workQueue.DoWork()
+		if ctx.Err() != nil {
+			return ctx.Err()
 		}
 
 		nextDir, err := queue.Dequeue()
 		if err != nil {
-			return
+			return err
 		}
 		entries, err := ioutil.ReadDir(nextDir)
 		if err != nil {
-			return
+			return err
 		}
 		if checkErr(err) {
 			continue
@@ -121,22 +302,22 @@ func (handler *AddHandler) uploadDirectory(rotation string) {
 				queue.Enqueue(absPath)
 				continue
 			}
-			checkSum := FileSha256(absPath)
 			rel, err := filepath.Rel(handler.Dir, absPath)
 			if checkErr(err) {
+				handler.Manifest.WalkFailed()
 				continue
 			}
-			targetKey := handler.Prefix + "/" + targetPrefix + rel
-			objectInfo := handler.util.ObjectExists(targetKey, checkSum)
-			if !objectInfo.exists || !objectInfo.sameCheckSum {
-				if objectInfo.exists {
-					handler.util.DeleteFile(targetKey)
-				}
-				workQueue.Add(NewUploadWorker(targetKey, absPath, *handler.util))
+			stat, err := os.Stat(absPath)
+			if checkErr(err) {
+				handler.Manifest.WalkFailed()
+				continue
+			}
+			rel = filepath.ToSlash(rel)
+			handler.Manifest.Add(rel, absPath, stat)
+			if err := fn(rel, absPath, stat); err != nil {
+				return err
 			}
 		}
 	}
-	if workQueue.Size() > 0 {
-		workQueue.DoWork()
-	}
+	return nil
 }
@@ -0,0 +1,70 @@
+package directory
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+const (
+	// key and secret from the configuration
+	StaticCredentials = "static"
+	// standard aws chain: env vars, shared credentials file, web identity and instance roles
+	ChainCredentials = "chain"
+)
+
+/**
+ * How S3 destinations get their credentials
+ */
+type AWSOptions struct {
+	Credentials          string
+	Profile              string
+	RoleArn              string
+	RoleSessionName      string
+	ExternalId           string
+	WebIdentityTokenFile string
+}
+
+/**
+ * Build the aws session from static keys or the credential chain,
+ * then assume the configured role on top of it
+ */
+func NewAWSSession(options StorageOptions) (*session.Session, error) {
+	sessionOptions := session.Options{
+		Config: aws.Config{
+			Region: aws.String(options.Region),
+		},
+	}
+	switch options.AWS.Credentials {
+	case StaticCredentials, "":
+		sessionOptions.Config.Credentials = credentials.NewStaticCredentials(options.Key, options.Secret, "")
+	case ChainCredentials:
+		sessionOptions.SharedConfigState = session.SharedConfigEnable
+		sessionOptions.Profile = options.AWS.Profile
+	default:
+		return nil, fmt.Errorf("unknown aws credentials %q, expected %s or %s", options.AWS.Credentials, StaticCredentials, ChainCredentials)
+	}
+	awsSession, err := session.NewSessionWithOptions(sessionOptions)
+	if err != nil {
+		return nil, err
+	}
+	if options.AWS.RoleArn == "" {
+		return awsSession, nil
+	}
+
+	var roleCredentials *credentials.Credentials
+	if options.AWS.WebIdentityTokenFile != "" {
+		roleCredentials = stscreds.NewWebIdentityCredentials(awsSession, options.AWS.RoleArn, options.AWS.RoleSessionName, options.AWS.WebIdentityTokenFile)
+	} else {
+		roleCredentials = stscreds.NewCredentials(awsSession, options.AWS.RoleArn, func(provider *stscreds.AssumeRoleProvider) {
+			provider.RoleSessionName = options.AWS.RoleSessionName
+			if options.AWS.ExternalId != "" {
+				provider.ExternalID = aws.String(options.AWS.ExternalId)
+			}
+		})
+	}
+	return awsSession.Copy(&aws.Config{Credentials: roleCredentials}), nil
+}
@@ -0,0 +1,134 @@
+package directory
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// below the general state directory, one file per directory job
+const checkSumsDir = "checksums"
+
+type checkSumEntry struct {
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"`
+	Inode   uint64 `json:"inode"`
+	SHA256  string `json:"sha256"`
+}
+
+/**
+ * SHA-256 of local files kept between runs, an entry is used while the size, mtime and inode of the file didn't change.
+ * A nil cache hashes every file
+ */
+type ChecksumCache struct {
+	path    string
+	mutex   sync.Mutex
+	entries map[string]checkSumEntry
+}
+
+/**
+ * Path of the cache of a directory job
+ */
+func ChecksumCachePath(stateDir string, job string) string {
+	return filepath.Join(stateDir, checkSumsDir, url.PathEscape(job)+".json")
+}
+
+/**
+ * Load the cache, a missing or unreadable file starts an empty one
+ */
+func LoadChecksumCache(path string) *ChecksumCache {
+	cache := &ChecksumCache{
+		path:    path,
+		entries: map[string]checkSumEntry{},
+	}
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cache
+	}
+	if checkErr(err) {
+		return cache
+	}
+	if checkErr(json.Unmarshal(content, &cache.entries)) {
+		cache.entries = map[string]checkSumEntry{}
+	}
+	return cache
+}
+
+/**
+ * Cache kept for a single run, so a file is hashed once for all its uploads and its manifest entry
+ */
+func newMemoryChecksumCache() *ChecksumCache {
+	return &ChecksumCache{
+		entries: map[string]checkSumEntry{},
+	}
+}
+
+/**
+ * SHA-256 of the file, read only when it changed since it was last hashed. nil when it can't be read
+ */
+func (cache *ChecksumCache) Sum(filePath string) *string {
+	if cache == nil {
+		return FileSha256(filePath)
+	}
+	stat, err := os.Stat(filePath)
+	if checkErr(err) {
+		return nil
+	}
+	key := filePath
+	if abs, err := filepath.Abs(filePath); err == nil {
+		key = abs
+	}
+	current := checkSumEntry{
+		Size:    stat.Size(),
+		ModTime: stat.ModTime().UnixNano(),
+		Inode:   fileInode(stat),
+	}
+
+	cache.mutex.Lock()
+	entry, found := cache.entries[key]
+	cache.mutex.Unlock()
+	if found && entry.Size == current.Size && entry.ModTime == current.ModTime && entry.Inode == current.Inode {
+		return &entry.SHA256
+	}
+
+	checkSum := FileSha256(filePath)
+	if checkSum == nil {
+		return nil
+	}
+	current.SHA256 = *checkSum
+	cache.mutex.Lock()
+	cache.entries[key] = current
+	cache.mutex.Unlock()
+	return checkSum
+}
+
+/**
+ * Write the cache, dropping the files that no longer exist
+ */
+func (cache *ChecksumCache) Save() error {
+	if cache == nil || cache.path == "" {
+		return nil
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if err := os.MkdirAll(filepath.Dir(cache.path), os.ModePerm); err != nil {
+		return err
+	}
+	for key := range cache.entries {
+		if !CheckFileExists(key) {
+			delete(cache.entries, key)
+		}
+	}
+	content, err := json.Marshal(cache.entries)
+	if err != nil {
+		return err
+	}
+	tmp := cache.path + ".tmp"
+	if err := os.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, cache.path)
+}
@@ -0,0 +1,74 @@
+package directory
+
+import (
+	"context"
+	"io"
+	"os"
+
+	"playus/server-backup/compression"
+
+	"github.com/gabriel-vasile/mimetype"
+)
+
+// metadata of compressed objects: the codec and the size of the file before compression
+const CompressionMetadata = "Compression"
+const UncompressedSizeMetadata = "Uncompressedsize"
+
+/**
+ * Whether a file of mtype is compressed already, zip based formats included
+ */
+func alreadyCompressed(mtype *mimetype.MIME) bool {
+	for ; mtype != nil; mtype = mtype.Parent() {
+		if compression.Compressed(mtype.String()) {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+ * Compress file with codec into a temporary file, so its size is known before the upload.
+ * The caller closes and removes it with removeTemp
+ */
+func compressFile(ctx context.Context, file *os.File, codec string) (*os.File, int64, error) {
+	temp, err := os.CreateTemp("", "server-backup-*")
+	if err != nil {
+		return nil, 0, err
+	}
+	writer, err := compression.NewWriter(codec, temp)
+	if err == nil {
+		_, err = io.Copy(writer, newContextReader(ctx, file))
+		if closeErr := writer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	var size int64
+	if err == nil {
+		size, err = temp.Seek(0, io.SeekCurrent)
+	}
+	if err == nil {
+		_, err = temp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		removeTemp(temp)
+		return nil, 0, err
+	}
+	return temp, size, nil
+}
+
+func removeTemp(temp *os.File) {
+	temp.Close()
+	checkErr(os.Remove(temp.Name()))
+}
+
+/**
+ * Decompress the body of a compressed object, other objects are read as they are.
+ * Closing the reader doesn't close body
+ */
+func decompressBody(body io.Reader, info *ObjectInfo) (io.ReadCloser, error) {
+	codec, compressed := info.Metadata[CompressionMetadata]
+	if !compressed {
+		return io.NopCloser(body), nil
+	}
+	return compression.NewReader(codec, body)
+}
@@ -0,0 +1,117 @@
+package directory
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"playus/server-backup/compression"
+)
+
+/**
+ * Upload content with codec and download it back, returns what was stored
+ */
+func compressionRoundTrip(t *testing.T, content []byte, codec string) *ObjectInfo {
+	t.Helper()
+	storage, err := NewFileSystemStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	localPath := filepath.Join(dir, "file")
+	if err := os.WriteFile(localPath, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	key := "prefix/daily/2026-10-17/file"
+	if _, err := UploadFile(context.Background(), storage, localPath, key, newMemoryChecksumCache(), codec); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := storage.Head(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := filepath.Join(dir, "restored")
+	if err := DownloadFile(context.Background(), storage, key, target); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := os.ReadFile(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(restored, content) {
+		t.Errorf("restored %d bytes differing from the %d uploaded", len(restored), len(content))
+	}
+	return stored
+}
+
+func TestCompressedRoundTrip(t *testing.T) {
+	content := []byte(strings.Repeat("compressible content\n", 10000))
+	for _, codec := range []string{compression.Gzip, compression.Zstd} {
+		t.Run(codec, func(t *testing.T) {
+			stored := compressionRoundTrip(t, content, codec)
+			if stored.Metadata[CompressionMetadata] != codec {
+				t.Errorf("stored with the compression %q", stored.Metadata[CompressionMetadata])
+			}
+			if stored.Metadata[UncompressedSizeMetadata] != strconv.Itoa(len(content)) {
+				t.Errorf("stored with the uncompressed size %q", stored.Metadata[UncompressedSizeMetadata])
+			}
+			if stored.Size >= int64(len(content)) {
+				t.Errorf("stored %d bytes of %d", stored.Size, len(content))
+			}
+		})
+	}
+	t.Run("none", func(t *testing.T) {
+		stored := compressionRoundTrip(t, content, "")
+		if _, compressed := stored.Metadata[CompressionMetadata]; compressed || stored.Size != int64(len(content)) {
+			t.Errorf("stored compressed without codec: %+v", stored)
+		}
+	})
+}
+
+func TestCompressedFilesStoredAsTheyAre(t *testing.T) {
+	var archive bytes.Buffer
+	writer := gzip.NewWriter(&archive)
+	writer.Write([]byte(strings.Repeat("compressible content\n", 10000)))
+	writer.Close()
+	random := make([]byte, 64*1024)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	tests := map[string][]byte{
+		// detected as application/gzip, not compressed again
+		"archive": archive.Bytes(),
+		// not detected, but compressing it doesn't make it smaller
+		"random": random,
+	}
+	for name, content := range tests {
+		t.Run(name, func(t *testing.T) {
+			stored := compressionRoundTrip(t, content, compression.Zstd)
+			if _, compressed := stored.Metadata[CompressionMetadata]; compressed {
+				t.Errorf("stored compressed: %+v", stored.Metadata)
+			}
+			if stored.Size != int64(len(content)) {
+				t.Errorf("stored %d bytes of %d", stored.Size, len(content))
+			}
+		})
+	}
+}
+
+func TestDecompressBody(t *testing.T) {
+	plain, err := decompressBody(strings.NewReader("content"), &ObjectInfo{Metadata: map[string]string{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var read bytes.Buffer
+	read.ReadFrom(plain)
+	if read.String() != "content" {
+		t.Errorf("read %q", read.String())
+	}
+	if _, err := decompressBody(strings.NewReader("content"), &ObjectInfo{Metadata: map[string]string{CompressionMetadata: "lz4"}}); err == nil {
+		t.Error("decompressed with an unknown codec")
+	}
+}
@@ -0,0 +1,29 @@
+package directory
+
+import (
+	"context"
+	"io"
+)
+
+/**
+ * Reader failing with the context error once the context is done,
+ * so a canceled backup stops in the middle of a transfer whatever the storage
+ */
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func newContextReader(ctx context.Context, reader io.Reader) io.Reader {
+	return &contextReader{
+		ctx:    ctx,
+		reader: reader,
+	}
+}
+
+func (reader *contextReader) Read(p []byte) (int, error) {
+	if err := reader.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return reader.reader.Read(p)
+}
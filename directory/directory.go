@@ -1,6 +1,7 @@
 package directory
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/json"
 	"errors"
@@ -10,17 +11,11 @@ import (
 	"playus/server-backup/config"
 	"strings"
 	"time"
-
-	ignore "github.com/sabhiram/go-gitignore"
-
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 )
 
-const RFC3339NoTime = "2006-01-02" // parse date format
+const RFC3339NoTime = "2006-01-02"            // parse date format
+const SnapshotTimeFormat = "2006-01-02T1504Z" // ID of the hourly snapshots, UTC
+const HOURLY = "hourly"
 const DAILY = "daily"
 const WEEKLY = "weekly"
 const MONTHLY = "monthly"
@@ -46,148 +41,107 @@ func (dirDate dirDateList) Swap(i, j int) {
 	dirDate[i], dirDate[j] = dirDate[j], dirDate[i]
 }
 
-type BackupDirectories struct {
-	Bucket      string
-	Prefix      string
-	Directories []string
-}
-
 type DirectoryBackupWorker struct {
-	Key             string
-	Secret          string
-	Region          string
-	Endpoint        string
-	Dirs            []BackupDirectories
-	DailyRotation   int
-	WeeklyRotation  int
-	MonthlyRotation int
-	Running         bool
-	IgnoreObject    *ignore.GitIgnore
+	Jobs []DirectoryJob
 }
 
-var (
-	Worker = newDirectoryBackupWorker()
-)
-
-func newDirectoryBackupWorker() *DirectoryBackupWorker {
-	object, err := ignore.CompileIgnoreFile(config.Conf.Get("dirbackup.ignoreFile").(string))
-	checkErr(err)
+/**
+ * Build the worker for every configured [[dirbackup.jobs]]
+ */
+func NewWorker(conf *config.Config) (*DirectoryBackupWorker, error) {
 	worker := &DirectoryBackupWorker{
-		Key:             config.Conf.Get("dirbackup.key").(string),
-		Secret:          config.Conf.Get("dirbackup.secret").(string),
-		Region:          config.Conf.Get("dirbackup.region").(string),
-		Endpoint:        config.Conf.Get("dirbackup.endpoint").(string),
-		Dirs:            getDirectories(config.Conf.Get("dirbackup.dirs").(string)),
-		DailyRotation:   int(config.Conf.Get("dirbackup.dailyrotation").(int64)),
-		WeeklyRotation:  int(config.Conf.Get("dirbackup.weeklyrotation").(int64)),
-		MonthlyRotation: int(config.Conf.Get("dirbackup.monthlyrotation").(int64)),
-		Running:         false,
-		IgnoreObject:    object,
-	}
-	return worker
-}
-
-func (worker *DirectoryBackupWorker) DoBackup() {
-	if worker.Running {
-		fmt.Printf("Dir backup already running")
-		return
+		Jobs: []DirectoryJob{},
 	}
-	defer notRunning(worker)
-
-	// create new aws session
-	session, err := session.NewSession(&aws.Config{
-		Region:      aws.String(worker.Region),
-		Credentials: credentials.NewStaticCredentials(worker.Key, worker.Secret, ""),
-		Endpoint:    aws.String(worker.Endpoint),
-	})
-	if checkErr(err) {
-		return
+	for _, jobConf := range conf.DirBackup.Jobs {
+		job, err := NewDirectoryJob(jobConf)
+		if err != nil {
+			return nil, err
+		}
+		job.CheckSumsPath = ChecksumCachePath(conf.General.StateDir, job.Name)
+		worker.Jobs = append(worker.Jobs, job)
 	}
+	return worker, nil
+}
 
-	// Create S3 service client
-	s3Client := s3.New(session)
-	if s3Client == nil {
-		return
+/**
+ * Find a job by name
+ */
+func (worker *DirectoryBackupWorker) Job(name string) (DirectoryJob, bool) {
+	for _, job := range worker.Jobs {
+		if job.Name == name {
+			return job, true
+		}
 	}
+	return DirectoryJob{}, false
+}
 
-	uploader := s3manager.NewUploader(session)
-	if uploader == nil {
-		return
-	}
-	downloader := s3manager.NewDownloader(session)
-	if downloader == nil {
-		return
+/**
+ * Run every configured job
+ */
+func (worker *DirectoryBackupWorker) DoBackup(ctx context.Context) error {
+	outcomes := []error{}
+	for _, job := range worker.Jobs {
+		outcomes = append(outcomes, worker.DoJobBackup(ctx, job))
 	}
+	return Summarize("dirbackup", outcomes)
+}
 
-	for _, nextBucket := range worker.Dirs {
-		targetBucketName := nextBucket.Bucket
-		targetPrefix := nextBucket.Prefix
-		if len(nextBucket.Directories) <= 0 {
-			break
+/**
+ * Back up the job to every destination, returns a *RunError unless every destination succeeded
+ */
+func (worker *DirectoryBackupWorker) DoJobBackup(ctx context.Context, job DirectoryJob) error {
+	var checkSums *ChecksumCache
+	if job.CheckSumsPath != "" {
+		checkSums = LoadChecksumCache(job.CheckSumsPath)
+		defer func() {
+			checkErr(checkSums.Save())
+		}()
+	}
+	started := time.Now()
+	results := Replicate(ctx, job.Destinations, job.Prefix, job.Storage, LockedRun(job.Prefix, job.Name, job.Lock, func(ctx context.Context, storage Storage) error {
+		// every directory goes to the same snapshot, delete and write the manifest once all are uploaded
+		manifest := NewManifestBuilder(job.Name, started, checkSums)
+		var repository *Repository
+		if job.Repository {
+			var err error
+			if repository, err = OpenRepository(storage, job.Prefix); checkErr(err) {
+				return err
+			}
+			manifest.Repository = true
 		}
-		for j := range nextBucket.Directories {
-			nextDir := nextBucket.Directories[j]
-
-			addHandler := NewAddHandler(targetBucketName, targetPrefix, nextDir, s3Client, uploader, downloader, worker.IgnoreObject, worker.DailyRotation, worker.WeeklyRotation, worker.MonthlyRotation)
-			addHandler.Handle()
-
-			removeHandler := NewRemoveHandler(targetBucketName, targetPrefix, nextDir, s3Client, uploader, downloader, worker.DailyRotation, worker.WeeklyRotation, worker.MonthlyRotation)
-			removeHandler.Handle()
+		outcomes := []error{}
+		for _, nextDir := range job.Directories {
+			addHandler := NewAddHandler(storage, job.Prefix, nextDir, job.IgnoreObject, job.Retention, job.Retry, job.Workers, checkSums, manifest)
+			addHandler.Repository = repository
+			addHandler.Compression = job.Compression
+			outcomes = append(outcomes, wrapDirError(nextDir, addHandler.Handle(ctx)))
 		}
-	}
+		removeHandler := NewRemoveHandler(storage, job.Prefix, strings.Join(job.Directories, ", "), job.Retention, manifest)
+		removeHandler.RemoteLock = job.Lock.Remote
+		removeHandler.ChunkGracePeriod = job.ChunkGracePeriod
+		outcomes = append(outcomes, removeHandler.Handle(ctx))
+		return Summarize(storage.String(), outcomes)
+	}))
+	PrintReport(job.Name, results)
+	return ReplicationError(job.Name, results)
 }
 
-func getDirectories(dirs string) []BackupDirectories {
-	dirs = strings.Replace(dirs, " , ", ",", -1)
-	dirs = strings.Replace(dirs, ", ", ",", -1)
-	dirs = strings.Replace(dirs, " ,", ",", -1)
-	targetDirs := strings.Split(dirs, ",")
-	targetDirs = removeDuplicates(targetDirs)
-
-	buckets := make(map[string]BackupDirectories)
-
-	for n := range targetDirs {
-		nextTarget := targetDirs[n]
-		separator := strings.Index(nextTarget, "|")
-		if separator < 0 {
-			fmt.Printf("Invalid directory %s no bucket specified", nextTarget)
-		}
-		bucket := nextTarget[0:(separator)]
+/**
+ * Apply the retention of the job on every destination, see Prune
+ */
+func (worker *DirectoryBackupWorker) DoJobPrune(ctx context.Context, job DirectoryJob, dryRun bool) error {
+	return Prune(ctx, job.Name, job.Destinations, job.Prefix, job.Storage, job.Lock, job.Retention, job.ChunkGracePeriod, time.Now, dryRun)
+}
 
-		remaining := nextTarget[(separator + 1):]
-		separator = strings.Index(remaining, "|")
-		if separator < 0 {
-			fmt.Printf("Invalid directory %s no bucket prefix specified", nextTarget)
-		}
-		prefix := remaining[0:(separator)]
-		targetDir := remaining[(separator + 1):]
-		if !isDirectory(targetDir) {
-			continue
-		}
+// package level
 
-		bucketKey := fmt.Sprintf("%s:%s", bucket, prefix)
-		targetBucket, exists := buckets[bucketKey]
-		if !exists {
-			targetBucket = BackupDirectories{
-				Bucket:      bucket,
-				Prefix:      prefix,
-				Directories: []string{},
-			}
-			targetBucket.Directories = append(targetBucket.Directories, targetDir)
-			buckets[bucketKey] = targetBucket
-		} else {
-			targetBucket.Directories = append(targetBucket.Directories, targetDir)
-		}
-	}
-	result := []BackupDirectories{}
-	for _, val := range buckets {
-		result = append(result, val)
+func wrapDirError(dir string, err error) error {
+	if err == nil {
+		return nil
 	}
-	return result
+	return fmt.Errorf("%s: %w", dir, err)
 }
 
-// package level
-
 func isDirectory(dir string) bool {
 	exists := CheckFileExists(dir)
 	if !exists {
@@ -208,25 +162,6 @@ func isDirectory(dir string) bool {
 	return true
 }
 
-func removeDuplicates(elements []string) []string {
-	// Use map to record duplicates as we find them.
-	encountered := map[string]bool{}
-	result := []string{}
-
-	for v := range elements {
-		if encountered[elements[v]] {
-			// Do not add duplicate.
-		} else {
-			// Record this element as an encountered element.
-			encountered[elements[v]] = true
-			// Append to result slice.
-			result = append(result, elements[v])
-		}
-	}
-	// Return the new slice.
-	return result
-}
-
 func checkErr(err error) bool {
 	if err != nil {
 		fmt.Println(fmt.Printf("[ERROR] %s", err))
@@ -235,10 +170,6 @@ func checkErr(err error) bool {
 	return false
 }
 
-func notRunning(worker *DirectoryBackupWorker) {
-	worker.Running = false
-}
-
 func CheckFileExists(filePath string) bool {
 	_, error := os.Stat(filePath)
 	return !errors.Is(error, os.ErrNotExist)
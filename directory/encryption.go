@@ -0,0 +1,378 @@
+package directory
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"playus/server-backup/encryption"
+)
+
+// metadata of encrypted objects: the algorithm, the ID of the key, the size of the plaintext
+// and every other metadata of the object sealed with the key
+const EncryptionMetadata = "Encryption"
+const KeyIDMetadata = "Encryptionkeyid"
+const PlainSizeMetadata = "Plainsize"
+const SealedMetadata = "Sealedmetadata"
+
+// salt and parameters of the passphrase keys of a prefix, <prefix>/.encryption.json, stored in plaintext
+const encryptionParamsName = ".encryption.json"
+
+/**
+ * Keys of a destination, either a passphrase or a key file encrypts new objects.
+ * DecryptionKeyFiles are former keys, still able to read what they encrypted
+ */
+type EncryptionOptions struct {
+	Passphrase         string
+	KeyFile            string
+	DecryptionKeyFiles []string
+}
+
+/**
+ * Load the configured keys, current is nil when nothing encrypts new objects
+ */
+func LoadSecrets(options EncryptionOptions) (*encryption.Secret, []*encryption.Secret, error) {
+	var current *encryption.Secret
+	var err error
+	if options.Passphrase != "" {
+		current, err = encryption.PassphraseSecret(options.Passphrase)
+	} else if options.KeyFile != "" {
+		current, err = encryption.LoadKeyFile(options.KeyFile)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	others := []*encryption.Secret{}
+	for _, keyFile := range options.DecryptionKeyFiles {
+		secret, err := encryption.LoadKeyFile(keyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		others = append(others, secret)
+	}
+	return current, others, nil
+}
+
+/**
+ * Storage encrypting the content of Put with the current key and decrypting Get with the key the object names.
+ * Objects stored in plaintext are read as they are. Sizes are reported as the plaintext sizes,
+ * so unchanged files are still detected from a listing. Every prefix has its own keys: passphrases
+ * are stretched with the salt of the prefix
+ */
+type encryptedStorage struct {
+	Storage
+	current *encryption.Secret
+	others  []*encryption.Secret
+	mutex   sync.Mutex
+	// keys by prefix, see keyring
+	keyrings map[string]*prefixKeyring
+}
+
+type prefixKeyring struct {
+	*encryption.Keyring
+	// false while a passphrase key is missing, the prefix had no salt yet
+	complete bool
+}
+
+func encryptStorage(storage Storage, current *encryption.Secret, others []*encryption.Secret) Storage {
+	return &encryptedStorage{
+		Storage:  storage,
+		current:  current,
+		others:   others,
+		keyrings: map[string]*prefixKeyring{},
+	}
+}
+
+/**
+ * Prefix of a key, every object of a backup is below its prefix
+ */
+func keyPrefix(key string) string {
+	prefix, _, _ := strings.Cut(key, "/")
+	return prefix
+}
+
+/**
+ * Keys of a prefix. Passphrase keys need the salt of the prefix, create writes a new one when it has none
+ */
+func (storage *encryptedStorage) keyring(prefix string, create bool) (*encryption.Keyring, error) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	cached, exists := storage.keyrings[prefix]
+	if exists && (cached.complete || !create) {
+		return cached.Keyring, nil
+	}
+	secrets := append([]*encryption.Secret{storage.current}, storage.others...)
+	var params *encryption.KDFParams
+	for _, secret := range secrets {
+		if secret == nil || !secret.NeedsParams() {
+			continue
+		}
+		var err error
+		if params, err = storage.readParams(prefix); err != nil {
+			return nil, err
+		}
+		if params == nil && create && storage.current != nil && storage.current.NeedsParams() {
+			if params, err = storage.writeParams(prefix); err != nil {
+				return nil, err
+			}
+		}
+		break
+	}
+	keys := []*encryption.Key{}
+	complete := true
+	for _, secret := range secrets {
+		if secret == nil {
+			keys = append(keys, nil)
+			continue
+		}
+		if secret.NeedsParams() && params == nil {
+			// nothing of the prefix is encrypted with it yet
+			keys = append(keys, nil)
+			complete = false
+			continue
+		}
+		key, err := secret.Key(params)
+		if err != nil {
+			return nil, fmt.Errorf("%s/%s: %v", storage, prefix, err)
+		}
+		keys = append(keys, key)
+	}
+	keyring := encryption.NewKeyring(keys[0], keys[1:]...)
+	storage.keyrings[prefix] = &prefixKeyring{Keyring: keyring, complete: complete}
+	return keyring, nil
+}
+
+func (storage *encryptedStorage) readParams(prefix string) (*encryption.KDFParams, error) {
+	body, _, err := storage.Storage.Get(path.Join(prefix, encryptionParamsName))
+	if errors.Is(err, ErrObjectNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	params := &encryption.KDFParams{}
+	if err := json.NewDecoder(body).Decode(params); err != nil {
+		return nil, fmt.Errorf("invalid %s/%s: %v", prefix, encryptionParamsName, err)
+	}
+	return params, nil
+}
+
+/**
+ * Store a new salt for the prefix. It is read back, another host writing its own at the same time may have won
+ */
+func (storage *encryptedStorage) writeParams(prefix string) (*encryption.KDFParams, error) {
+	params, err := encryption.NewKDFParams()
+	if err != nil {
+		return nil, err
+	}
+	content, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+	key := path.Join(prefix, encryptionParamsName)
+	fmt.Printf("Writing the encryption salt of %s/%s\n", storage, prefix)
+	err = storage.Storage.Put(key, bytes.NewReader(content), ObjectInfo{Key: key, Size: int64(len(content)), ContentType: "application/json"})
+	if err != nil {
+		return nil, err
+	}
+	return storage.readParams(prefix)
+}
+
+/**
+ * Metadata of an encrypted object only readable with its key
+ */
+type sealedMetadata struct {
+	ContentType string            `json:"contentType,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+}
+
+func (storage *encryptedStorage) Put(key string, body io.Reader, info ObjectInfo) error {
+	if storage.current == nil {
+		return storage.Storage.Put(key, body, info)
+	}
+	keyring, err := storage.keyring(keyPrefix(key), true)
+	if err != nil {
+		return err
+	}
+	current := keyring.Current
+	// checksums and types would tell what the objects hold, only the key reads them
+	content, err := json.Marshal(sealedMetadata{ContentType: info.ContentType, Metadata: info.Metadata})
+	if err != nil {
+		return err
+	}
+	sealed, err := current.Seal(content)
+	if err != nil {
+		return err
+	}
+	info.Metadata = map[string]string{
+		EncryptionMetadata: encryption.Algorithm,
+		KeyIDMetadata:      current.ID,
+		PlainSizeMetadata:  strconv.FormatInt(info.Size, 10),
+		SealedMetadata:     base64.StdEncoding.EncodeToString(sealed),
+	}
+	info.ContentType = "application/octet-stream"
+	info.Size = encryption.EncryptedSize(info.Size)
+	return storage.Storage.Put(key, current.Encrypt(body), info)
+}
+
+func (storage *encryptedStorage) Get(key string) (io.ReadCloser, *ObjectInfo, error) {
+	body, info, err := storage.Storage.Get(key)
+	if err != nil {
+		return body, info, err
+	}
+	decryptionKey, err := storage.decryptionKey(key, info)
+	if err != nil {
+		body.Close()
+		return nil, nil, err
+	}
+	if decryptionKey == nil {
+		return body, info, nil
+	}
+	return &decryptedReadCloser{
+		Reader: decryptionKey.Decrypt(body),
+		closer: body,
+	}, info, nil
+}
+
+type decryptedReadCloser struct {
+	io.Reader
+	closer io.Closer
+}
+
+func (reader *decryptedReadCloser) Close() error {
+	return reader.closer.Close()
+}
+
+/**
+ * The metadata of an encrypted object is only unsealed with its key, without it only the size is known
+ */
+func (storage *encryptedStorage) Head(key string) (*ObjectInfo, error) {
+	info, err := storage.Storage.Head(key)
+	if err != nil {
+		return info, err
+	}
+	if _, decryptErr := storage.decryptionKey(key, info); decryptErr != nil {
+		plainSize(info)
+	}
+	return info, nil
+}
+
+func (storage *encryptedStorage) List(prefix string, fn func(ObjectInfo) error) error {
+	return storage.Storage.List(prefix, func(object ObjectInfo) error {
+		if object.Key == path.Join(keyPrefix(object.Key), encryptionParamsName) {
+			// not part of any backup
+			return nil
+		}
+		if storage.current != nil {
+			// listings carry no metadata, every object is expected to be encrypted.
+			// A plaintext object gets a size no file has and is uploaded again, encrypted
+			object.Size = encryption.PlainSize(object.Size)
+		}
+		return fn(object)
+	})
+}
+
+/**
+ * Key of an encrypted object, nil for a plaintext one. The plaintext size and sealed metadata of info are restored
+ */
+func (storage *encryptedStorage) decryptionKey(key string, info *ObjectInfo) (*encryption.Key, error) {
+	algorithm, encrypted := info.Metadata[EncryptionMetadata]
+	if !encrypted {
+		return nil, nil
+	}
+	if algorithm != encryption.Algorithm {
+		return nil, fmt.Errorf("%s is encrypted with %s, not supported", key, algorithm)
+	}
+	keyring, err := storage.keyring(keyPrefix(key), false)
+	if err != nil {
+		return nil, err
+	}
+	keyID := info.Metadata[KeyIDMetadata]
+	decryptionKey, exists := keyring.Key(keyID)
+	if !exists {
+		return nil, fmt.Errorf("%s is encrypted with key %s, which isn't configured", key, keyID)
+	}
+	if err := unsealMetadata(decryptionKey, info); err != nil {
+		return nil, fmt.Errorf("%s: %v", key, err)
+	}
+	plainSize(info)
+	return decryptionKey, nil
+}
+
+func unsealMetadata(key *encryption.Key, info *ObjectInfo) error {
+	value, exists := info.Metadata[SealedMetadata]
+	if !exists {
+		return nil
+	}
+	sealed, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return fmt.Errorf("invalid sealed metadata, %v", err)
+	}
+	content, err := key.Open(sealed)
+	if err != nil {
+		return err
+	}
+	metadata := sealedMetadata{}
+	if err := json.Unmarshal(content, &metadata); err != nil {
+		return fmt.Errorf("invalid sealed metadata, %v", err)
+	}
+	info.ContentType = metadata.ContentType
+	for name, value := range metadata.Metadata {
+		info.Metadata[name] = value
+	}
+	delete(info.Metadata, SealedMetadata)
+	return nil
+}
+
+/**
+ * Report the plaintext size of an encrypted object
+ */
+func plainSize(info *ObjectInfo) {
+	if _, encrypted := info.Metadata[EncryptionMetadata]; !encrypted {
+		return
+	}
+	if size, err := strconv.ParseInt(info.Metadata[PlainSizeMetadata], 10, 64); err == nil {
+		info.Size = size
+	}
+}
+
+/**
+ * Name of a chunk of the prefix. On an encrypted storage it is a hash keyed with the encryption key,
+ * so the names of the chunks don't tell what they hold, and their SHA-256 otherwise.
+ * stored is the chunk as read back, named with the key that encrypted it, nil for a chunk to store
+ */
+func ChunkID(storage Storage, prefix string, chunk []byte, stored *ObjectInfo) (string, error) {
+	encrypted, isEncrypted := storage.(*encryptedStorage)
+	if !isEncrypted {
+		return fmt.Sprintf("%x", sha256.Sum256(chunk)), nil
+	}
+	var key *encryption.Key
+	if stored == nil && encrypted.current != nil {
+		keyring, err := encrypted.keyring(prefix, true)
+		if err != nil {
+			return "", err
+		}
+		key = keyring.Current
+	} else if stored != nil {
+		if _, isChunkEncrypted := stored.Metadata[EncryptionMetadata]; isChunkEncrypted {
+			keyring, err := encrypted.keyring(prefix, false)
+			if err != nil {
+				return "", err
+			}
+			key, _ = keyring.Key(stored.Metadata[KeyIDMetadata])
+		}
+	}
+	if key == nil {
+		return fmt.Sprintf("%x", sha256.Sum256(chunk)), nil
+	}
+	return key.Hash(chunk), nil
+}
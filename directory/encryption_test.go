@@ -0,0 +1,163 @@
+package directory
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"playus/server-backup/encryption"
+)
+
+func newEncryptedStorage(t *testing.T, root string, options EncryptionOptions) (Storage, Storage) {
+	t.Helper()
+	fsStorage, err := NewFileSystemStorage(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, others, err := LoadSecrets(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encryptStorage(fsStorage, current, others), fsStorage
+}
+
+func TestEncryptedStorage(t *testing.T) {
+	root := t.TempDir()
+	storage, raw := newEncryptedStorage(t, root, EncryptionOptions{Passphrase: "correct horse"})
+	content := "secret content"
+	metadata := map[string]string{SHA256: fmt.Sprintf("%x", sha256.Sum256([]byte(content)))}
+	for _, key := range []string{"first/daily/2026-10-17/file.txt", "second/daily/2026-10-17/file.txt"} {
+		err := storage.Put(key, strings.NewReader(content), ObjectInfo{Key: key, Size: int64(len(content)), ContentType: "text/plain", Metadata: metadata})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the destination only sees the algorithm, the key ID and the size
+	stored, err := raw.Head("first/daily/2026-10-17/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, leaked := stored.Metadata[SHA256]; leaked || stored.ContentType != "application/octet-stream" {
+		t.Errorf("plaintext metadata stored: %+v", stored)
+	}
+	other, err := raw.Head("second/daily/2026-10-17/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Metadata[KeyIDMetadata] == other.Metadata[KeyIDMetadata] {
+		t.Error("the same passphrase gave the same key on two prefixes")
+	}
+	for _, prefix := range []string{"first", "second"} {
+		if _, err := os.Stat(filepath.Join(root, prefix, encryptionParamsName)); err != nil {
+			t.Errorf("no salt stored for %s: %v", prefix, err)
+		}
+	}
+
+	// a new process reads the salt back
+	reopened, _ := newEncryptedStorage(t, root, EncryptionOptions{Passphrase: "correct horse"})
+	body, info, err := reopened.Get("first/daily/2026-10-17/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, err := io.ReadAll(body)
+	body.Close()
+	if err != nil || string(read) != content {
+		t.Fatalf("got %q, %v", read, err)
+	}
+	if info.Metadata[SHA256] != metadata[SHA256] || info.ContentType != "text/plain" || info.Size != int64(len(content)) {
+		t.Errorf("metadata not restored: %+v", info)
+	}
+	info, err = reopened.Head("first/daily/2026-10-17/file.txt")
+	if err != nil || info.Metadata[SHA256] != metadata[SHA256] {
+		t.Errorf("head: %+v, %v", info, err)
+	}
+	listed := []string{}
+	err = reopened.List("first/", func(object ObjectInfo) error {
+		listed = append(listed, object.Key)
+		if object.Size != int64(len(content)) {
+			t.Errorf("listed %s with %d bytes", object.Key, object.Size)
+		}
+		return nil
+	})
+	if err != nil || strings.Join(listed, ",") != "first/daily/2026-10-17/file.txt" {
+		t.Errorf("listed %v, %v", listed, err)
+	}
+
+	// without key the size is still known, the content and metadata are not
+	keyless, _ := newEncryptedStorage(t, root, EncryptionOptions{})
+	info, err = keyless.Head("first/daily/2026-10-17/file.txt")
+	if err != nil || info.Size != int64(len(content)) {
+		t.Errorf("head without key: %+v, %v", info, err)
+	}
+	if _, leaked := info.Metadata[SHA256]; leaked {
+		t.Error("metadata unsealed without key")
+	}
+	if _, _, err := keyless.Get("first/daily/2026-10-17/file.txt"); err == nil || !strings.Contains(err.Error(), "isn't configured") {
+		t.Errorf("get without key: %v", err)
+	}
+	wrong, _ := newEncryptedStorage(t, root, EncryptionOptions{Passphrase: "wrong horse"})
+	if _, _, err := wrong.Get("first/daily/2026-10-17/file.txt"); err == nil {
+		t.Error("decrypted with another passphrase")
+	}
+}
+
+func TestChunkID(t *testing.T) {
+	chunk := []byte("chunk content")
+	plainID := fmt.Sprintf("%x", sha256.Sum256(chunk))
+	keyFile := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(keyFile, []byte(strings.Repeat("ab", 32)), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	plain, _ := newEncryptedStorage(t, t.TempDir(), EncryptionOptions{})
+	if id, err := ChunkID(plain, "prefix", chunk, nil); err != nil || id != plainID {
+		t.Errorf("plaintext chunk named %s, %v", id, err)
+	}
+
+	for name, options := range map[string]EncryptionOptions{"passphrase": {Passphrase: "correct horse"}, "key file": {KeyFile: keyFile}} {
+		t.Run(name, func(t *testing.T) {
+			storage, _ := newEncryptedStorage(t, t.TempDir(), options)
+			id, err := ChunkID(storage, "prefix", chunk, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id == plainID || len(id) != len(plainID) {
+				t.Errorf("encrypted chunk named %s", id)
+			}
+			if again, _ := ChunkID(storage, "prefix", chunk, nil); again != id {
+				t.Errorf("chunk named %s then %s", id, again)
+			}
+			key := ChunkKey("prefix", id)
+			if err := storage.Put(key, strings.NewReader(string(chunk)), ObjectInfo{Key: key, Size: int64(len(chunk))}); err != nil {
+				t.Fatal(err)
+			}
+			body, info, err := storage.Get(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body.Close()
+			if verified, err := ChunkID(storage, "prefix", chunk, info); err != nil || verified != id {
+				t.Errorf("stored chunk verified as %s, %v", verified, err)
+			}
+		})
+	}
+}
+
+func TestKDFParamsSalt(t *testing.T) {
+	first, err := encryption.NewKDFParams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := encryption.NewKDFParams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(first.Salt) == string(second.Salt) {
+		t.Error("two repositories got the same salt")
+	}
+}
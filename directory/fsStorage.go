@@ -0,0 +1,265 @@
+package directory
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Directory below the storage root that keeps the metadata of every stored file
+const fsMetadataDir = ".server-backup-meta"
+
+type fsMetadata struct {
+	ContentType string            `json:"contentType"`
+	Metadata    map[string]string `json:"metadata"`
+}
+
+/**
+ * Storage on a local or mounted (NAS) directory.
+ * Objects are plain files below Root using the same key layout as S3,
+ * content type and metadata are kept on json side files below Root/.server-backup-meta
+ */
+type FileSystemStorage struct {
+	Root string
+}
+
+func NewFileSystemStorage(root string) (*FileSystemStorage, error) {
+	if root == "" {
+		return nil, fmt.Errorf("file system storage requires a root directory")
+	}
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(root, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	if !isDirectory(root) {
+		return nil, fmt.Errorf("file system storage root %s is not a directory", root)
+	}
+	return &FileSystemStorage{
+		Root: root,
+	}, nil
+}
+
+func (storage *FileSystemStorage) String() string {
+	return fmt.Sprintf("%s%s", fileScheme, storage.Root)
+}
+
+func (storage *FileSystemStorage) Close() error {
+	return nil
+}
+
+func (storage *FileSystemStorage) Put(key string, body io.Reader, info ObjectInfo) error {
+	targetPath, err := storage.filePath(key)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(targetPath), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	// write next to the target and rename so readers never see a partial file
+	tmpFile, err := ioutil.TempFile(filepath.Dir(targetPath), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	_, err = io.Copy(tmpFile, body)
+	if err != nil {
+		tmpFile.Close()
+		return err
+	}
+	err = tmpFile.Close()
+	if err != nil {
+		return err
+	}
+	err = storage.writeMetadata(key, fsMetadata{ContentType: info.ContentType, Metadata: info.Metadata})
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), targetPath)
+}
+
+func (storage *FileSystemStorage) Get(key string) (io.ReadCloser, *ObjectInfo, error) {
+	info, err := storage.Head(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	targetPath, err := storage.filePath(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	file, err := os.Open(targetPath)
+	if err != nil {
+		return nil, nil, storage.translateError(err)
+	}
+	return file, info, nil
+}
+
+func (storage *FileSystemStorage) Head(key string) (*ObjectInfo, error) {
+	targetPath, err := storage.filePath(key)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := os.Stat(targetPath)
+	if err != nil {
+		return nil, storage.translateError(err)
+	}
+	if stat.IsDir() {
+		return nil, ErrObjectNotFound
+	}
+	metadata := storage.readMetadata(key)
+	return &ObjectInfo{
+		Key:          key,
+		Size:         stat.Size(),
+		LastModified: stat.ModTime(),
+		ContentType:  metadata.ContentType,
+		Metadata:     metadata.Metadata,
+	}, nil
+}
+
+func (storage *FileSystemStorage) List(prefix string, fn func(ObjectInfo) error) error {
+	// only walk the deepest directory fully contained in the prefix
+	startDir := path.Dir(prefix)
+	if strings.HasSuffix(prefix, "/") {
+		startDir = strings.TrimSuffix(prefix, "/")
+	}
+	startPath, err := storage.filePath(startDir)
+	if err != nil {
+		return err
+	}
+	if !CheckFileExists(startPath) {
+		return nil
+	}
+	return filepath.Walk(startPath, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if info.Name() == fsMetadataDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasPrefix(info.Name(), ".tmp-") {
+			return nil
+		}
+		rel, err := filepath.Rel(storage.Root, filePath)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		return fn(ObjectInfo{
+			Key:          key,
+			Size:         info.Size(),
+			LastModified: info.ModTime(),
+		})
+	})
+}
+
+func (storage *FileSystemStorage) Delete(key string) error {
+	targetPath, err := storage.filePath(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(targetPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	metadataPath, err := storage.metadataPath(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(metadataPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	storage.removeEmptyParents(filepath.Dir(targetPath))
+	storage.removeEmptyParents(filepath.Dir(metadataPath))
+	return nil
+}
+
+func (storage *FileSystemStorage) Copy(sourceKey string, targetKey string) error {
+	body, info, err := storage.Get(sourceKey)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	return storage.Put(targetKey, body, *info)
+}
+
+func (storage *FileSystemStorage) filePath(key string) (string, error) {
+	cleanKey := path.Clean("/" + key)
+	if cleanKey == "/" {
+		return storage.Root, nil
+	}
+	return filepath.Join(storage.Root, filepath.FromSlash(cleanKey[1:])), nil
+}
+
+func (storage *FileSystemStorage) metadataPath(key string) (string, error) {
+	cleanKey := path.Clean("/" + key)
+	if cleanKey == "/" {
+		return "", fmt.Errorf("invalid key %q", key)
+	}
+	return filepath.Join(storage.Root, fsMetadataDir, filepath.FromSlash(cleanKey[1:])+".json"), nil
+}
+
+func (storage *FileSystemStorage) writeMetadata(key string, metadata fsMetadata) error {
+	metadataPath, err := storage.metadataPath(key)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(metadataPath), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(metadataPath, data, 0644)
+}
+
+func (storage *FileSystemStorage) readMetadata(key string) fsMetadata {
+	metadata := fsMetadata{}
+	metadataPath, err := storage.metadataPath(key)
+	if err != nil {
+		return metadata
+	}
+	data, err := ioutil.ReadFile(metadataPath)
+	if err != nil {
+		return metadata
+	}
+	checkErr(json.Unmarshal(data, &metadata))
+	return metadata
+}
+
+/**
+ * Remove empty directories left behind by deletions, stopping at the storage root
+ */
+func (storage *FileSystemStorage) removeEmptyParents(dir string) {
+	for strings.HasPrefix(dir, storage.Root+string(filepath.Separator)) {
+		if os.Remove(dir) != nil {
+			// not empty
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+func (storage *FileSystemStorage) translateError(err error) error {
+	if os.IsNotExist(err) {
+		return ErrObjectNotFound
+	}
+	return err
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+
+package directory
+
+import (
+	"os"
+	"syscall"
+)
+
+/**
+ * Inode of the file, so a file replaced by another one with the same size and mtime isn't taken as unchanged
+ */
+func fileInode(stat os.FileInfo) uint64 {
+	if sys, ok := stat.Sys().(*syscall.Stat_t); ok {
+		return uint64(sys.Ino)
+	}
+	return 0
+}
@@ -0,0 +1,12 @@
+//go:build windows
+
+package directory
+
+import "os"
+
+/**
+ * Windows has no inode in os.FileInfo, files are only compared by size and mtime
+ */
+func fileInode(stat os.FileInfo) uint64 {
+	return 0
+}
@@ -0,0 +1,145 @@
+package directory
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"playus/server-backup/config"
+	"playus/server-backup/retention"
+
+	ignore "github.com/sabhiram/go-gitignore"
+)
+
+/**
+ * A configured directory job ready to run, see config.DirectoryJob
+ */
+type DirectoryJob struct {
+	Name         string
+	Destinations []string
+	Prefix       string
+	Directories  []string
+	IgnoreObject *ignore.GitIgnore
+	Schedule     config.ScheduleConfig
+	Lock         config.LockConfig
+	Retry        RetryPolicy
+	Workers      int
+	Retention    retention.Policy
+	// file of the job's ChecksumCache, no cache when empty
+	CheckSumsPath string
+	Storage       StorageOptions
+	// store deduplicated chunks, see Repository
+	Repository bool
+	// see CollectChunks
+	ChunkGracePeriod time.Duration
+	// codec compressing the uploaded files, none when empty
+	Compression string
+}
+
+func NewDirectoryJob(conf config.DirectoryJob) (DirectoryJob, error) {
+	job := DirectoryJob{
+		Name:         conf.Name,
+		Destinations: conf.Destinations,
+		Prefix:       conf.Prefix,
+		Directories:  conf.Directories,
+		Schedule:     conf.Schedule,
+		Lock:         conf.Lock,
+		Retry:        NewRetryPolicy(conf.Retry),
+		Workers:      conf.Workers,
+		Retention:    NewRetentionPolicy(conf.Rotation),
+		Storage:      NewStorageOptions(conf.Storage, conf.Throttle),
+		Repository:   conf.Repository,
+		Compression:  conf.Compression,
+	}
+	if conf.IgnoreFile != "" {
+		object, err := ignore.CompileIgnoreFile(conf.IgnoreFile)
+		if err != nil {
+			return job, fmt.Errorf("dirbackup job %s: invalid ignoreFile %s: %v", conf.Name, conf.IgnoreFile, err)
+		}
+		job.IgnoreObject = object
+	}
+	gracePeriod, err := retention.ParseDuration(conf.ChunkGracePeriod)
+	if err != nil {
+		return job, fmt.Errorf("dirbackup job %s: invalid chunkGracePeriod: %v", conf.Name, err)
+	}
+	job.ChunkGracePeriod = gracePeriod
+	return job, nil
+}
+
+/**
+ * Storage options from the credentials and bandwidth limits of a config section or job
+ */
+func NewStorageOptions(conf config.StorageConfig, throttle config.ThrottleConfig) StorageOptions {
+	return StorageOptions{
+		Key:      conf.Key,
+		Secret:   conf.Secret,
+		Region:   conf.Region,
+		Endpoint: conf.Endpoint,
+		AWS: AWSOptions{
+			Credentials:          conf.Credentials,
+			Profile:              conf.Profile,
+			RoleArn:              conf.RoleArn,
+			RoleSessionName:      conf.RoleSessionName,
+			ExternalId:           conf.ExternalId,
+			WebIdentityTokenFile: conf.WebIdentityTokenFile,
+		},
+		SFTP: SFTPOptions{
+			Password:       conf.SFTPPassword,
+			KeyFile:        conf.SFTPKeyFile,
+			KeyPassphrase:  conf.SFTPKeyPassphrase,
+			HostKey:        conf.SFTPHostKey,
+			KnownHostsFile: conf.SFTPKnownHostsFile,
+		},
+		Throttle: NewThrottle(throttle),
+		Encryption: EncryptionOptions{
+			Passphrase:         conf.EncryptionPassphrase,
+			KeyFile:            conf.EncryptionKeyFile,
+			DecryptionKeyFiles: conf.DecryptionKeyFiles,
+		},
+	}
+}
+
+/**
+ * What reading back the backups of a job needs, see Restore and BackupView
+ */
+type JobAccess struct {
+	Storage StorageOptions
+	Retry   RetryPolicy
+	Workers int
+}
+
+/**
+ * Access to the backups of a configured job: database, typesensebackup, a directory job by its name or as dirbackup/<name>,
+ * or the [dirbackup] section when name is empty. Jobs with their own credentials or keys are only readable with theirs
+ */
+func ResolveJobAccess(conf *config.Config, name string) (JobAccess, error) {
+	switch name {
+	case "":
+		return JobAccess{
+			Storage: NewStorageOptions(conf.DirBackup.Storage, conf.DirBackup.Throttle),
+			Retry:   NewRetryPolicy(conf.DirBackup.Retry),
+			Workers: conf.DirBackup.Workers,
+		}, nil
+	case "database":
+		return JobAccess{
+			Storage: NewStorageOptions(conf.Database.Storage, conf.Database.Throttle),
+			Retry:   NewRetryPolicy(conf.Database.Retry),
+			Workers: conf.Database.Workers,
+		}, nil
+	case "typesensebackup":
+		return JobAccess{
+			Storage: NewStorageOptions(conf.Typesense.Storage, conf.Typesense.Throttle),
+			Retry:   NewRetryPolicy(conf.Typesense.Retry),
+			Workers: conf.Typesense.Workers,
+		}, nil
+	}
+	worker, err := NewWorker(conf)
+	if err != nil {
+		return JobAccess{}, err
+	}
+	job, exists := worker.Job(strings.TrimPrefix(name, "dirbackup/"))
+	if !exists {
+		return JobAccess{}, fmt.Errorf("unknown backup job %s, expected database, typesensebackup or a directory job name", name)
+	}
+	return JobAccess{Storage: job.Storage, Retry: job.Retry, Workers: job.Workers}, nil
+}
@@ -0,0 +1,255 @@
+package directory
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"playus/server-backup/config"
+)
+
+// Lock object of a prefix, <prefix>/.lock
+const lockName = ".lock"
+
+// Time between writing the lock object and reading it back to make sure no other host wrote it meanwhile,
+// shortened by the tests
+var lockSettleDelay = 2 * time.Second
+
+// ErrLocked is returned when another run holds the lock of the prefix
+var ErrLocked = errors.New("prefix locked by another run")
+
+// ErrLockLost is returned when another run took the lock over while the run held it
+var ErrLockLost = errors.New("lock taken over by another run")
+
+/**
+ * Content of the lock object
+ */
+type lockInfo struct {
+	ID      string    `json:"id"`
+	Owner   string    `json:"owner"`
+	Job     string    `json:"job"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+}
+
+/**
+ * Lock object kept on a destination while a run writes or prunes a prefix,
+ * so two hosts sharing the prefix can't work on it at once.
+ * Best effort: storages have no atomic create, the lock is written then read back after lockSettleDelay.
+ * A lock not refreshed before it expires, e.g. left by a crashed host, is taken over
+ */
+type RemoteLock struct {
+	storage Storage
+	key     string
+	ttl     time.Duration
+	info    lockInfo
+	mutex   sync.Mutex
+	stop    chan struct{}
+	done    chan struct{}
+	// current time, expirations are compared with it
+	clock func() time.Time
+	// time between writing the lock and reading it back
+	settle time.Duration
+	// called once when another run took the lock over, nothing is refreshed afterwards
+	lost func()
+}
+
+/**
+ * Take the lock of the prefix, lost is called if another run takes it over before Release
+ */
+func AcquireRemoteLock(storage Storage, prefix string, job string, ttl time.Duration, lost func()) (*RemoteLock, error) {
+	lock, err := newRemoteLock(storage, prefix, job, ttl, lost)
+	if err != nil {
+		return nil, err
+	}
+	if err := lock.acquire(); err != nil {
+		return nil, err
+	}
+	return lock, nil
+}
+
+func newRemoteLock(storage Storage, prefix string, job string, ttl time.Duration, lost func()) (*RemoteLock, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	hostname, _ := os.Hostname()
+	return &RemoteLock{
+		storage: storage,
+		key:     fmt.Sprintf("%s/%s", prefix, lockName),
+		ttl:     ttl,
+		info: lockInfo{
+			ID:    hex.EncodeToString(id),
+			Owner: fmt.Sprintf("%s:%d", hostname, os.Getpid()),
+			Job:   job,
+		},
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+		clock:  time.Now,
+		settle: lockSettleDelay,
+		lost:   lost,
+	}, nil
+}
+
+func (lock *RemoteLock) acquire() error {
+	now := lock.clock().UTC()
+	lock.info.Created = now
+	lock.info.Expires = now.Add(lock.ttl)
+
+	current, err := lock.read()
+	if err != nil && !errors.Is(err, ErrObjectNotFound) {
+		return err
+	}
+	if current != nil && now.Before(current.Expires) {
+		return lock.lockedBy(current)
+	}
+	if current != nil {
+		fmt.Printf("Taking over expired lock %s of %s held by %s\n", lock.key, lock.storage, current.Owner)
+	}
+	if err := lock.write(); err != nil {
+		return err
+	}
+	time.Sleep(lock.settle)
+	current, err = lock.read()
+	if err != nil {
+		return err
+	}
+	if current.ID != lock.info.ID {
+		return lock.lockedBy(current)
+	}
+	go lock.keepAlive()
+	return nil
+}
+
+/**
+ * Stop refreshing and delete the lock object if it's still ours
+ */
+func (lock *RemoteLock) Release() error {
+	close(lock.stop)
+	<-lock.done
+	current, err := lock.read()
+	if errors.Is(err, ErrObjectNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if current.ID != lock.info.ID {
+		return fmt.Errorf("lock %s of %s was taken over by %s", lock.key, lock.storage, current.Owner)
+	}
+	return lock.storage.Delete(lock.key)
+}
+
+/**
+ * Push the expiration while the run goes on, until another run takes the lock over
+ */
+func (lock *RemoteLock) keepAlive() {
+	defer close(lock.done)
+	ticker := time.NewTicker(lock.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-lock.stop:
+			return
+		case <-ticker.C:
+			if !lock.refresh() {
+				return
+			}
+		}
+	}
+}
+
+/**
+ * Rewrite the lock with a new expiration, false once it isn't ours anymore.
+ * A run late to refresh it may have seen it expire and taken it over, writing it again would let both go on
+ */
+func (lock *RemoteLock) refresh() bool {
+	current, err := lock.read()
+	if errors.Is(err, ErrObjectNotFound) || (err == nil && current.ID != lock.info.ID) {
+		owner := "nobody, it was deleted"
+		if current != nil {
+			owner = current.Owner
+		}
+		fmt.Printf("[ERROR] lock %s of %s is now held by %s, stopping the run\n", lock.key, lock.storage, owner)
+		if lock.lost != nil {
+			lock.lost()
+		}
+		return false
+	}
+	// unable to read it, keep it alive anyway
+	checkErr(err)
+	lock.mutex.Lock()
+	lock.info.Expires = lock.clock().UTC().Add(lock.ttl)
+	lock.mutex.Unlock()
+	checkErr(lock.write())
+	return true
+}
+
+func (lock *RemoteLock) lockedBy(current *lockInfo) error {
+	return fmt.Errorf("%w: %s of %s is held by %s for %s until %s", ErrLocked, lock.key, lock.storage, current.Owner, current.Job, current.Expires.Local().Format(time.RFC3339))
+}
+
+func (lock *RemoteLock) read() (*lockInfo, error) {
+	body, _, err := lock.storage.Get(lock.key)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	content, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	info := &lockInfo{}
+	if err := json.Unmarshal(content, info); err != nil {
+		return nil, fmt.Errorf("invalid lock %s: %v", lock.key, err)
+	}
+	return info, nil
+}
+
+func (lock *RemoteLock) write() error {
+	lock.mutex.Lock()
+	content, err := json.Marshal(lock.info)
+	lock.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	return lock.storage.Put(lock.key, bytes.NewReader(content), ObjectInfo{
+		Key:         lock.key,
+		Size:        int64(len(content)),
+		ContentType: "application/json",
+		Metadata:    map[string]string{},
+	})
+}
+
+/**
+ * Wrap a replication run so it holds the lock of the prefix on every destination while it runs.
+ * The run is canceled if another one takes the lock over meanwhile
+ */
+func LockedRun(prefix string, job string, conf config.LockConfig, run func(ctx context.Context, storage Storage) error) func(ctx context.Context, storage Storage) error {
+	if !conf.Remote {
+		return run
+	}
+	return func(ctx context.Context, storage Storage) error {
+		ctx, cancel := context.WithCancelCause(ctx)
+		defer cancel(nil)
+		lock, err := AcquireRemoteLock(storage, prefix, job, time.Duration(conf.TTL)*time.Second, func() {
+			cancel(ErrLockLost)
+		})
+		if err != nil {
+			return err
+		}
+		err = run(ctx, storage)
+		if errors.Is(context.Cause(ctx), ErrLockLost) {
+			err = errors.Join(err, ErrLockLost)
+		}
+		return errors.Join(err, lock.Release())
+	}
+}
@@ -0,0 +1,273 @@
+package directory
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"playus/server-backup/config"
+)
+
+/**
+ * Storage keeping its objects in memory
+ */
+type memoryStorage struct {
+	mutex   sync.Mutex
+	objects map[string][]byte
+	infos   map[string]ObjectInfo
+}
+
+func newMemoryStorage() *memoryStorage {
+	return &memoryStorage{objects: map[string][]byte{}, infos: map[string]ObjectInfo{}}
+}
+
+func (storage *memoryStorage) Put(key string, body io.Reader, info ObjectInfo) error {
+	content, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	info.Key = key
+	info.Size = int64(len(content))
+	info.LastModified = time.Now()
+	storage.objects[key] = content
+	storage.infos[key] = info
+	return nil
+}
+
+func (storage *memoryStorage) Get(key string) (io.ReadCloser, *ObjectInfo, error) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	content, exists := storage.objects[key]
+	if !exists {
+		return nil, nil, ErrObjectNotFound
+	}
+	info := storage.infos[key]
+	return io.NopCloser(bytes.NewReader(content)), &info, nil
+}
+
+func (storage *memoryStorage) Head(key string) (*ObjectInfo, error) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	info, exists := storage.infos[key]
+	if !exists {
+		return nil, ErrObjectNotFound
+	}
+	return &info, nil
+}
+
+func (storage *memoryStorage) List(prefix string, fn func(ObjectInfo) error) error {
+	storage.mutex.Lock()
+	keys := []string{}
+	for key := range storage.infos {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	storage.mutex.Unlock()
+	sort.Strings(keys)
+	for _, key := range keys {
+		info, err := storage.Head(key)
+		if err != nil {
+			continue
+		}
+		if err := fn(*info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (storage *memoryStorage) Delete(key string) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	delete(storage.objects, key)
+	delete(storage.infos, key)
+	return nil
+}
+
+func (storage *memoryStorage) Copy(sourceKey string, targetKey string) error {
+	body, info, err := storage.Get(sourceKey)
+	if err != nil {
+		return err
+	}
+	return storage.Put(targetKey, body, *info)
+}
+
+func (storage *memoryStorage) String() string {
+	return "memory://"
+}
+
+func (storage *memoryStorage) Close() error {
+	return nil
+}
+
+/**
+ * Clock only moving forward when told to
+ */
+type fakeClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+func (clock *fakeClock) Now() time.Time {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+	return clock.now
+}
+
+func (clock *fakeClock) Advance(duration time.Duration) {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+	clock.now = clock.now.Add(duration)
+}
+
+func newTestLock(t *testing.T, storage Storage, clock *fakeClock, ttl time.Duration, lost func()) *RemoteLock {
+	t.Helper()
+	lock, err := newRemoteLock(storage, "prefix", "test", ttl, lost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lock.clock = clock.Now
+	lock.settle = 0
+	return lock
+}
+
+func storedLock(t *testing.T, storage Storage) lockInfo {
+	t.Helper()
+	body, _, err := storage.Get("prefix/" + lockName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+	info := lockInfo{}
+	if err := json.NewDecoder(body).Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
+/**
+ * Lock of another host, as it writes it
+ */
+func writeOtherLock(t *testing.T, storage Storage, expires time.Time) {
+	t.Helper()
+	content, err := json.Marshal(lockInfo{ID: "other", Owner: "other-host:1", Job: "test", Created: expires.Add(-time.Hour), Expires: expires})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Put("prefix/"+lockName, bytes.NewReader(content), ObjectInfo{Key: "prefix/" + lockName}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRemoteLockTakeover(t *testing.T) {
+	storage := newMemoryStorage()
+	clock := &fakeClock{now: time.Date(2026, 10, 17, 3, 0, 0, 0, time.UTC)}
+	writeOtherLock(t, storage, clock.Now().Add(time.Minute))
+
+	if err := newTestLock(t, storage, clock, time.Hour, nil).acquire(); !errors.Is(err, ErrLocked) {
+		t.Fatalf("acquired a lock held by another host: %v", err)
+	}
+	// the other host stopped refreshing it
+	clock.Advance(time.Minute)
+	lock := newTestLock(t, storage, clock, time.Hour, nil)
+	if err := lock.acquire(); err != nil {
+		t.Fatalf("expired lock not taken over: %v", err)
+	}
+	if stored := storedLock(t, storage); stored.ID != lock.info.ID || !stored.Expires.Equal(clock.Now().Add(time.Hour)) {
+		t.Errorf("stored lock %+v", stored)
+	}
+	if err := newTestLock(t, storage, clock, time.Hour, nil).acquire(); !errors.Is(err, ErrLocked) {
+		t.Errorf("acquired a lock held by this host: %v", err)
+	}
+	if err := lock.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.Head("prefix/" + lockName); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("lock not deleted on release: %v", err)
+	}
+}
+
+func TestRemoteLockKeepAlive(t *testing.T) {
+	storage := newMemoryStorage()
+	clock := &fakeClock{now: time.Date(2026, 10, 17, 3, 0, 0, 0, time.UTC)}
+	lock := newTestLock(t, storage, clock, 150*time.Millisecond, func() {
+		t.Error("lock lost")
+	})
+	if err := lock.acquire(); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Hour)
+	// refreshed every ttl/3
+	deadline := time.Now().Add(5 * time.Second)
+	for !storedLock(t, storage).Expires.Equal(clock.Now().Add(150 * time.Millisecond)) {
+		if time.Now().After(deadline) {
+			t.Fatalf("lock not refreshed: %+v", storedLock(t, storage))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := lock.Release(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRemoteLockLost(t *testing.T) {
+	storage := newMemoryStorage()
+	clock := &fakeClock{now: time.Date(2026, 10, 17, 3, 0, 0, 0, time.UTC)}
+	lost := make(chan struct{})
+	lock := newTestLock(t, storage, clock, 150*time.Millisecond, func() {
+		close(lost)
+	})
+	if err := lock.acquire(); err != nil {
+		t.Fatal(err)
+	}
+	// another host saw it expire and took it over
+	writeOtherLock(t, storage, clock.Now().Add(time.Hour))
+	select {
+	case <-lost:
+	case <-time.After(5 * time.Second):
+		t.Fatal("takeover not detected")
+	}
+	// no refresh overwrites the lock of the other host
+	time.Sleep(200 * time.Millisecond)
+	if stored := storedLock(t, storage); stored.ID != "other" {
+		t.Errorf("lock overwritten after the takeover: %+v", stored)
+	}
+	if err := lock.Release(); err == nil || !strings.Contains(err.Error(), "taken over") {
+		t.Errorf("released a lock taken over: %v", err)
+	}
+	if stored := storedLock(t, storage); stored.ID != "other" {
+		t.Errorf("release deleted the lock of the other host")
+	}
+}
+
+func TestLockedRunCanceledOnTakeover(t *testing.T) {
+	settle := lockSettleDelay
+	lockSettleDelay = 0
+	defer func() {
+		lockSettleDelay = settle
+	}()
+	storage := newMemoryStorage()
+	run := LockedRun("prefix", "test", config.LockConfig{Remote: true, TTL: 1}, func(ctx context.Context, storage Storage) error {
+		writeOtherLock(t, storage, time.Now().Add(time.Hour))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(10 * time.Second):
+			return nil
+		}
+	})
+	err := run(context.Background(), storage)
+	if !errors.Is(err, ErrLockLost) {
+		t.Errorf("run went on after losing its lock: %v", err)
+	}
+}
@@ -0,0 +1,383 @@
+package directory
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Manifests of a prefix are kept apart from the snapshots, <prefix>/.manifests/<rotation>/<date>.json
+const manifestsDir = ".manifests"
+
+const manifestExtension = ".json"
+
+/**
+ * A file of a snapshot, Path is relative to the snapshot
+ */
+type ManifestFile struct {
+	Path    string      `json:"path"`
+	Size    int64       `json:"size"`
+	SHA256  string      `json:"sha256"`
+	Mode    os.FileMode `json:"mode"`
+	ModTime time.Time   `json:"mtime"`
+	// local inode, a file replaced by another one with the same size and mtime isn't taken as unchanged
+	Inode uint64 `json:"inode,omitempty"`
+	// size of the object as listed, below Size when it is stored compressed
+	StoredSize int64 `json:"storedSize,omitempty"`
+	// content of the file in a repository, in order
+	Chunks []string `json:"chunks,omitempty"`
+}
+
+/**
+ * Written once every file of a snapshot is stored, a snapshot without manifest is incomplete
+ */
+type Manifest struct {
+	Job      string    `json:"job"`
+	Host     string    `json:"host"`
+	Rotation string    `json:"rotation"`
+	ID       string    `json:"id"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	// files are stored as chunks of the repository, the snapshot has no other object
+	Repository bool           `json:"repository,omitempty"`
+	Files      []ManifestFile `json:"files"`
+}
+
+/**
+ * Collects the files of a run on one destination and writes the manifest of every snapshot the run completed
+ */
+type ManifestBuilder struct {
+	Job string
+	// snapshot written by the run, the date it started
+	ID string
+	// hourly snapshot written by the run, the time it started
+	HourlyID string
+	// the run stores chunks, see Repository
+	Repository bool
+	Started    time.Time
+	mutex      sync.Mutex
+	files      map[string]ManifestFile
+	// local file of every entry, hashed on Save
+	localPaths map[string]string
+	checkSums  *ChecksumCache
+	// a directory couldn't be walked, the file list is partial
+	walkFailed bool
+	// a transfer failed, the snapshots aren't complete
+	failed bool
+	// rotations written by the run
+	rotations map[string]bool
+	// files of the manifest the run replaces by rotation, see Previous
+	previous map[string]map[string]ManifestFile
+}
+
+/**
+ * Builder for a run starting now, checkSums may be nil to hash every file on Save
+ */
+func NewManifestBuilder(job string, started time.Time, checkSums *ChecksumCache) *ManifestBuilder {
+	return &ManifestBuilder{
+		Job:        job,
+		ID:         started.Format(RFC3339NoTime),
+		HourlyID:   started.UTC().Format(SnapshotTimeFormat),
+		Started:    started,
+		files:      map[string]ManifestFile{},
+		localPaths: map[string]string{},
+		checkSums:  checkSums,
+		rotations:  map[string]bool{},
+		previous:   map[string]map[string]ManifestFile{},
+	}
+}
+
+/**
+ * Snapshot of the rotation written by the run
+ */
+func (builder *ManifestBuilder) SnapshotID(rotation string) string {
+	if rotation == HOURLY {
+		return builder.HourlyID
+	}
+	return builder.ID
+}
+
+/**
+ * Record a local file stored at relPath in the snapshot
+ */
+func (builder *ManifestBuilder) Add(relPath string, localPath string, stat os.FileInfo) {
+	builder.mutex.Lock()
+	defer builder.mutex.Unlock()
+	builder.files[relPath] = ManifestFile{
+		Path:    relPath,
+		Size:    stat.Size(),
+		Mode:    stat.Mode(),
+		ModTime: stat.ModTime().UTC(),
+		Inode:   fileInode(stat),
+	}
+	builder.localPaths[relPath] = localPath
+}
+
+/**
+ * Record the checksum of a file stored or found up to date, and the size of its object
+ */
+func (builder *ManifestBuilder) SetStored(relPath string, checkSum string, storedSize int64) {
+	builder.mutex.Lock()
+	defer builder.mutex.Unlock()
+	file := builder.files[relPath]
+	file.SHA256 = checkSum
+	file.StoredSize = storedSize
+	builder.files[relPath] = file
+}
+
+/**
+ * Entry of relPath in the manifest the run replaces, as the previous run of the snapshot stored it
+ */
+func (builder *ManifestBuilder) Previous(rotation string, relPath string) (ManifestFile, bool) {
+	builder.mutex.Lock()
+	defer builder.mutex.Unlock()
+	file, exists := builder.previous[rotation][relPath]
+	return file, exists
+}
+
+/**
+ * Record the checksum and chunks of a file stored in a repository
+ */
+func (builder *ManifestBuilder) SetChunks(relPath string, checkSum string, chunks []string) {
+	builder.mutex.Lock()
+	defer builder.mutex.Unlock()
+	file := builder.files[relPath]
+	file.SHA256 = checkSum
+	file.Chunks = chunks
+	builder.files[relPath] = file
+}
+
+func (builder *ManifestBuilder) Has(relPath string) bool {
+	builder.mutex.Lock()
+	defer builder.mutex.Unlock()
+	_, exists := builder.files[relPath]
+	return exists
+}
+
+func (builder *ManifestBuilder) WalkFailed() {
+	builder.mutex.Lock()
+	defer builder.mutex.Unlock()
+	builder.walkFailed = true
+}
+
+func (builder *ManifestBuilder) Fail() {
+	builder.mutex.Lock()
+	defer builder.mutex.Unlock()
+	builder.failed = true
+}
+
+/**
+ * Whether every local file made it to the file list, only then remote files missing from it can be deleted
+ */
+func (builder *ManifestBuilder) Complete() bool {
+	builder.mutex.Lock()
+	defer builder.mutex.Unlock()
+	return !builder.walkFailed
+}
+
+/**
+ * Whether every file was walked and stored
+ */
+func (builder *ManifestBuilder) Succeeded() bool {
+	builder.mutex.Lock()
+	defer builder.mutex.Unlock()
+	return !builder.walkFailed && !builder.failed
+}
+
+/**
+ * Rotations the run wrote to, sorted
+ */
+func (builder *ManifestBuilder) Rotations() []string {
+	builder.mutex.Lock()
+	defer builder.mutex.Unlock()
+	rotations := []string{}
+	for rotation := range builder.rotations {
+		rotations = append(rotations, rotation)
+	}
+	sort.Strings(rotations)
+	return rotations
+}
+
+/**
+ * Remove the manifest of the rotation's snapshot before the run changes it,
+ * so a run stopping halfway leaves it incomplete. Its files are kept as Previous first,
+ * the objects are what it describes until the run changes them.
+ * A repository snapshot is only its manifest, the previous one stays valid until Save replaces it
+ */
+func (builder *ManifestBuilder) Start(storage Storage, prefix string, rotation string) error {
+	builder.mutex.Lock()
+	started := builder.rotations[rotation]
+	builder.rotations[rotation] = true
+	builder.mutex.Unlock()
+	if started || builder.Repository {
+		return nil
+	}
+	id := builder.SnapshotID(rotation)
+	previous, err := ReadManifest(storage, prefix, rotation, id)
+	if err == nil {
+		files := map[string]ManifestFile{}
+		for _, file := range previous.Files {
+			files[file.Path] = file
+		}
+		builder.mutex.Lock()
+		builder.previous[rotation] = files
+		builder.mutex.Unlock()
+	} else if !errors.Is(err, ErrObjectNotFound) {
+		// unchanged files are compared by checksum instead
+		checkErr(err)
+	}
+	return DeleteManifest(storage, prefix, rotation, id)
+}
+
+/**
+ * Write the manifest of every snapshot the run wrote, call it only when the whole run succeeded
+ */
+func (builder *ManifestBuilder) Save(storage Storage, prefix string) error {
+	builder.mutex.Lock()
+	defer builder.mutex.Unlock()
+	hostname, _ := os.Hostname()
+	manifest := Manifest{
+		Job:        builder.Job,
+		Host:       hostname,
+		Started:    builder.Started.UTC(),
+		Finished:   time.Now().UTC(),
+		Repository: builder.Repository,
+		Files:      []ManifestFile{},
+	}
+	for relPath, file := range builder.files {
+		if file.SHA256 != "" {
+			// hashed while storing it
+			manifest.Files = append(manifest.Files, file)
+			continue
+		}
+		checkSum := builder.checkSums.Sum(builder.localPaths[relPath])
+		if checkSum == nil {
+			return fmt.Errorf("unable to hash %s for the manifest", builder.localPaths[relPath])
+		}
+		file.SHA256 = *checkSum
+		manifest.Files = append(manifest.Files, file)
+	}
+	sort.Slice(manifest.Files, func(i, j int) bool {
+		return manifest.Files[i].Path < manifest.Files[j].Path
+	})
+	rotations := []string{}
+	for rotation := range builder.rotations {
+		rotations = append(rotations, rotation)
+	}
+	sort.Strings(rotations)
+
+	var failures error
+	for _, rotation := range rotations {
+		manifest.Rotation = rotation
+		manifest.ID = builder.SnapshotID(rotation)
+		content, err := json.Marshal(manifest)
+		if err != nil {
+			return err
+		}
+		key := ManifestKey(prefix, rotation, manifest.ID)
+		err = storage.Put(key, bytes.NewReader(content), ObjectInfo{Key: key, Size: int64(len(content)), ContentType: "application/json"})
+		checkErr(err)
+		failures = errors.Join(failures, err)
+	}
+	return failures
+}
+
+func ManifestKey(prefix string, rotation string, id string) string {
+	return fmt.Sprintf("%s/%s/%s/%s%s", prefix, manifestsDir, rotation, id, manifestExtension)
+}
+
+/**
+ * Delete the manifest of a snapshot, a missing one is not an error
+ */
+func DeleteManifest(storage Storage, prefix string, rotation string, id string) error {
+	err := storage.Delete(ManifestKey(prefix, rotation, id))
+	if errors.Is(err, ErrObjectNotFound) {
+		return nil
+	}
+	return err
+}
+
+func ReadManifest(storage Storage, prefix string, rotation string, id string) (*Manifest, error) {
+	body, _, err := storage.Get(ManifestKey(prefix, rotation, id))
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	manifest := &Manifest{}
+	if err := json.NewDecoder(body).Decode(manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest %s: %v", ManifestKey(prefix, rotation, id), err)
+	}
+	return manifest, nil
+}
+
+/**
+ * Snapshots of the rotation having a manifest
+ */
+func ListManifests(storage Storage, prefix string, rotation string) (map[string]bool, error) {
+	manifestPrefix := fmt.Sprintf("%s/%s/%s/", prefix, manifestsDir, rotation)
+	ids := map[string]bool{}
+	err := storage.List(manifestPrefix, func(object ObjectInfo) error {
+		name := object.Key[len(manifestPrefix):]
+		if strings.HasSuffix(name, manifestExtension) && !strings.Contains(name, "/") {
+			ids[strings.TrimSuffix(name, manifestExtension)] = true
+		}
+		return nil
+	})
+	return ids, err
+}
+
+/**
+ * Whether every snapshot of the rotation is complete. Snapshots older than the first manifest of the rotation
+ * were written before manifests existed and count as complete, so upgrading doesn't prune the history
+ */
+func SnapshotsComplete(storage Storage, prefix string, rotation string, ids []string) (map[string]bool, error) {
+	manifests, err := ListManifests(storage, prefix, rotation)
+	if err != nil {
+		return nil, err
+	}
+	var oldest time.Time
+	for id := range manifests {
+		taken, err := ParseSnapshotID(id)
+		if err == nil && (oldest.IsZero() || taken.Before(oldest)) {
+			oldest = taken
+		}
+	}
+	complete := map[string]bool{}
+	for _, id := range ids {
+		if manifests[id] || oldest.IsZero() {
+			complete[id] = true
+			continue
+		}
+		taken, err := ParseSnapshotID(id)
+		complete[id] = err == nil && taken.Before(oldest)
+	}
+	return complete, nil
+}
+
+/**
+ * Snapshots of the rotation, the directories below it and the snapshots only made of a manifest, sorted
+ */
+func ListSnapshotIDs(storage Storage, prefix string, rotation string) ([]string, error) {
+	ids, err := GetTopDirectories(storage, fmt.Sprintf("%s/%s/", prefix, rotation))
+	if err != nil {
+		return nil, err
+	}
+	manifests, err := ListManifests(storage, prefix, rotation)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		delete(manifests, id)
+	}
+	for id := range manifests {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
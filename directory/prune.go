@@ -0,0 +1,83 @@
+package directory
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"playus/server-backup/config"
+	"playus/server-backup/retention"
+)
+
+/**
+ * Time a snapshot was taken from its directory name, a date or a UTC time such as 2026-10-17T0300Z
+ */
+func ParseSnapshotID(id string) (time.Time, error) {
+	taken, err := time.Parse(SnapshotTimeFormat, id)
+	if err == nil {
+		return taken, nil
+	}
+	taken, dateErr := time.Parse(RFC3339NoTime, id)
+	if dateErr != nil {
+		return time.Time{}, fmt.Errorf("invalid snapshot id %q, expected a date such as 2026-10-17 or a time such as 2026-10-17T0300Z", id)
+	}
+	return taken, nil
+}
+
+/**
+ * Retention policy of a config section or job, keepWithin is validated when the config is loaded
+ */
+func NewRetentionPolicy(conf config.RotationConfig) retention.Policy {
+	within, err := retention.ParseDuration(conf.KeepWithin)
+	checkErr(err)
+	return retention.Policy{
+		Hourly:  conf.HourlyRotation,
+		Daily:   conf.DailyRotation,
+		Weekly:  conf.WeeklyRotation,
+		Monthly: conf.MonthlyRotation,
+		Yearly:  conf.YearlyRotation,
+		Within:  within,
+	}
+}
+
+/**
+ * The part of the policy applying to a rotation: every rotation keeps its own count of snapshots,
+ * the monthly one also keeps the yearly snapshots, and keepWithin applies to all of them.
+ * A rotation with a count of 0 keeps none, except the daily one always keeping its newest snapshot:
+ * every run writes it and the next one only uploads what changed since
+ */
+func TierPolicy(tier string, policy retention.Policy) retention.Policy {
+	tierPolicy := retention.Policy{Within: policy.Within}
+	switch tier {
+	case HOURLY:
+		tierPolicy.Hourly = policy.Hourly
+	case DAILY:
+		tierPolicy.Daily = max(policy.Daily, 1)
+	case WEEKLY:
+		tierPolicy.Weekly = policy.Weekly
+	case MONTHLY:
+		tierPolicy.Monthly = policy.Monthly
+		tierPolicy.Yearly = policy.Yearly
+	}
+	return tierPolicy
+}
+
+/**
+ * Apply the retention policy on every destination without backing anything up, clock is the current time of the retention.
+ * A dry run only prints what would be deleted and takes no lock
+ */
+func Prune(ctx context.Context, name string, destinations []string, prefix string, options StorageOptions, lock config.LockConfig, policy retention.Policy, chunkGracePeriod time.Duration, clock func() time.Time, dryRun bool) error {
+	run := func(ctx context.Context, storage Storage) error {
+		handler := NewRemoveHandler(storage, prefix, "", policy, nil)
+		handler.Clock = clock
+		handler.RemoteLock = lock.Remote
+		handler.ChunkGracePeriod = chunkGracePeriod
+		return handler.Prune(ctx, dryRun)
+	}
+	if !dryRun {
+		run = LockedRun(prefix, name, lock, run)
+	}
+	results := Replicate(ctx, destinations, prefix, options, run)
+	PrintReport(name, results)
+	return ReplicationError(name, results)
+}
@@ -0,0 +1,130 @@
+package directory
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"playus/server-backup/config"
+	"playus/server-backup/retention"
+)
+
+/**
+ * Destination holding a file in every snapshot, by rotation
+ */
+func newSnapshotsDestination(t *testing.T, snapshots map[string][]string) string {
+	t.Helper()
+	root := t.TempDir()
+	for rotation, ids := range snapshots {
+		for _, id := range ids {
+			dir := filepath.Join(root, "prefix", rotation, id)
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(dir, "file.txt"), []byte(id), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return root
+}
+
+func remainingSnapshots(t *testing.T, root string, rotation string) string {
+	t.Helper()
+	entries, err := os.ReadDir(filepath.Join(root, "prefix", rotation))
+	if os.IsNotExist(err) {
+		return ""
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []string{}
+	for _, entry := range entries {
+		ids = append(ids, entry.Name())
+	}
+	return strings.Join(ids, ",")
+}
+
+func TestPrune(t *testing.T) {
+	root := newSnapshotsDestination(t, map[string][]string{
+		HOURLY:  {"2026-10-16T2300Z", "2026-10-17T0100Z", "2026-10-17T0200Z"},
+		DAILY:   {"2026-10-14", "2026-10-15", "2026-10-16", "2026-10-17"},
+		WEEKLY:  {"2026-09-28", "2026-10-05", "2026-10-12"},
+		MONTHLY: {"2025-12-01", "2026-09-01", "2026-10-01"},
+	})
+	policy := retention.Policy{Daily: 2, Monthly: 1, Yearly: 2, Within: 36 * time.Hour}
+	clock := func() time.Time {
+		return time.Date(2026, 10, 17, 3, 0, 0, 0, time.UTC)
+	}
+	err := Prune(context.Background(), "test", []string{fileScheme + root}, "prefix", StorageOptions{}, config.LockConfig{}, policy, 0, clock, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		// keepHourly is 0, only keepWithin keeps them
+		HOURLY: "2026-10-16T2300Z,2026-10-17T0100Z,2026-10-17T0200Z",
+		DAILY:  "2026-10-16,2026-10-17",
+		// keepWeekly is 0 and they are older than keepWithin
+		WEEKLY:  "",
+		MONTHLY: "2025-12-01,2026-10-01",
+	}
+	for rotation, snapshots := range expected {
+		if got := remainingSnapshots(t, root, rotation); got != snapshots {
+			t.Errorf("%s: kept %q, expected %q", rotation, got, snapshots)
+		}
+	}
+}
+
+func TestPruneKeepsTheNewestDailySnapshot(t *testing.T) {
+	root := newSnapshotsDestination(t, map[string][]string{
+		DAILY:  {"2026-10-16", "2026-10-17"},
+		WEEKLY: {"2026-10-05", "2026-10-12"},
+	})
+	clock := func() time.Time {
+		return time.Date(2026, 10, 17, 3, 0, 0, 0, time.UTC)
+	}
+	err := Prune(context.Background(), "test", []string{fileScheme + root}, "prefix", StorageOptions{}, config.LockConfig{}, retention.Policy{Weekly: 1}, 0, clock, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := remainingSnapshots(t, root, DAILY); got != "2026-10-17" {
+		t.Errorf("daily: kept %q", got)
+	}
+	if got := remainingSnapshots(t, root, WEEKLY); got != "2026-10-12" {
+		t.Errorf("weekly: kept %q", got)
+	}
+}
+
+func TestPruneWithoutPolicy(t *testing.T) {
+	root := newSnapshotsDestination(t, map[string][]string{
+		DAILY: {"2026-10-16", "2026-10-17"},
+	})
+	err := Prune(context.Background(), "test", []string{fileScheme + root}, "prefix", StorageOptions{}, config.LockConfig{}, retention.Policy{}, 0, time.Now, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := remainingSnapshots(t, root, DAILY); got != "2026-10-16,2026-10-17" {
+		t.Errorf("kept %q", got)
+	}
+}
+
+func TestTierPolicy(t *testing.T) {
+	policy := retention.Policy{Hourly: 24, Daily: 7, Weekly: 4, Monthly: 6, Yearly: 2, Within: time.Hour}
+	tests := map[string]retention.Policy{
+		HOURLY:  {Hourly: 24, Within: time.Hour},
+		DAILY:   {Daily: 7, Within: time.Hour},
+		WEEKLY:  {Weekly: 4, Within: time.Hour},
+		MONTHLY: {Monthly: 6, Yearly: 2, Within: time.Hour},
+	}
+	for tier, expected := range tests {
+		if got := TierPolicy(tier, policy); got != expected {
+			t.Errorf("%s: %+v, expected %+v", tier, got, expected)
+		}
+	}
+	if got := TierPolicy(DAILY, retention.Policy{Weekly: 1}); got.Daily != 1 {
+		t.Errorf("keepDaily = 0 keeps %d daily snapshots", got.Daily)
+	}
+}
@@ -1,99 +1,147 @@
 package directory
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"path/filepath"
-	"sort"
+	"strings"
 	"time"
 
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"playus/server-backup/retention"
 )
 
 type RemoveHandler struct {
-	Bucket          string
-	Dir             string
-	Prefix          string
-	util            *S3Util
-	dailyRotation   int
-	weeklyRotation  int
-	monthlyRotation int
+	Dir       string
+	Prefix    string
+	Storage   Storage
+	Retention retention.Policy
+	// current time of the retention, time.Now unless replaced
+	Clock func() time.Time
+	// files of the run, nil when only pruning
+	Manifest *ManifestBuilder
+	// the run holds the remote lock of the prefix, unreferenced chunks are only deleted then
+	RemoteLock bool
+	// unreferenced chunks stored more recently are kept, a run may not have written the manifest using them yet
+	ChunkGracePeriod time.Duration
 }
 
-func NewRemoveHandler(bucket string, prefix string, dir string, s3Client *s3.S3, uploader *s3manager.Uploader, downloader *s3manager.Downloader, dailyRotation int, weeklyRotation int, monthlyRotation int) *RemoveHandler {
+func NewRemoveHandler(storage Storage, prefix string, dir string, policy retention.Policy, manifest *ManifestBuilder) *RemoveHandler {
 	return &RemoveHandler{
-		Bucket:          bucket,
-		Dir:             dir,
-		Prefix:          prefix,
-		util:            NewS3Util(bucket, prefix, dir, s3Client, uploader, downloader),
-		dailyRotation:   dailyRotation,
-		weeklyRotation:  weeklyRotation,
-		monthlyRotation: monthlyRotation,
+		Dir:       dir,
+		Prefix:    prefix,
+		Storage:   storage,
+		Retention: policy,
+		Clock:     time.Now,
+		Manifest:  manifest,
 	}
 }
 
-func (handler *RemoveHandler) Handle() {
-	fmt.Printf("Starting remove handler for bucket %s in directory %s \n", handler.Bucket, handler.Dir)
+func (handler *RemoveHandler) Handle(ctx context.Context) error {
+	// never delete anything for a canceled run
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	fmt.Printf("Starting remove handler for %s in directory %s \n", handler.Storage, handler.Dir)
 
-	handler.handleFileSystemDeletions()
-	handler.handleRotations()
+	err := handler.handleFileSystemDeletions()
+	if err == nil && handler.Manifest.Succeeded() {
+		// every file is stored, the snapshots of the run are complete
+		err = handler.Manifest.Save(handler.Storage, handler.Prefix)
+	}
+	return errors.Join(err, handler.Prune(ctx, false))
 }
 
 /**
- * Delete files on remote that were deleted on file system
+ * Delete files on remote that are not part of the run, i.e. deleted on file system
  */
-func (handler *RemoveHandler) handleFileSystemDeletions() {
-	// only sync todays dir
-	targetDatePrefix := fmt.Sprintf("/%s/", time.Now().Format(RFC3339NoTime))
-	targetPrefix := fmt.Sprintf("%s/daily%s", handler.util.Prefix, targetDatePrefix)
-	prefixUtil := NewS3Util(handler.util.Bucket, targetPrefix, handler.Dir, handler.util.client, handler.util.uploader, handler.util.downloader)
-	for prefixUtil.HasMore() {
-		for _, next := range *prefixUtil.GetNextPage() {
-			if next == nil {
-				continue
-			}
-			remotePath := *next.Key
-			extractedSuffix, err := prefixUtil.ExtractTargetSuffix(remotePath)
-			if checkErr(err) {
-				continue
-			}
-			suffix := *extractedSuffix
-			targetPath := filepath.Join(handler.Dir, suffix)
-
-			if !CheckFileExists(targetPath) {
-				// file does not exist, delete from remote
-				prefixUtil.DeleteFile(remotePath)
+func (handler *RemoveHandler) handleFileSystemDeletions() error {
+	if !handler.Manifest.Complete() {
+		// a directory wasn't walked, its files would look deleted
+		fmt.Printf("Not deleting from %s/%s: the file list of the run is partial\n", handler.Storage, handler.Prefix)
+		return nil
+	}
+	deleted := []string{}
+	for _, rotation := range handler.Manifest.Rotations() {
+		// only sync the snapshots of the run
+		targetPrefix := fmt.Sprintf("%s/%s/%s/", handler.Prefix, rotation, handler.Manifest.SnapshotID(rotation))
+		err := handler.Storage.List(targetPrefix, func(next ObjectInfo) error {
+			if !handler.Manifest.Has(next.Key[len(targetPrefix):]) {
+				deleted = append(deleted, next.Key)
 			}
+			return nil
+		})
+		if checkErr(err) {
+			return err
 		}
 	}
+	return DeleteObjects(handler.Storage, deleted)
 }
 
 /**
- * Make sure we don't keep more backups from what was specified on config file
+ * Delete the snapshots of every rotation the retention policy doesn't keep,
+ * dryRun only prints what would be deleted
  */
-func (handler *RemoveHandler) handleRotations() {
-	handler.handleMaxRotation(DAILY, handler.dailyRotation)
-	handler.handleMaxRotation(WEEKLY, handler.weeklyRotation)
-	handler.handleMaxRotation(MONTHLY, handler.monthlyRotation)
+func (handler *RemoveHandler) Prune(ctx context.Context, dryRun bool) error {
+	if handler.Retention.Empty() {
+		// every count set to 0, nothing says what to keep
+		fmt.Printf("Not pruning %s/%s: no retention policy\n", handler.Storage, handler.Prefix)
+		return nil
+	}
+	var failures error
+	for _, tier := range []string{HOURLY, DAILY, WEEKLY, MONTHLY} {
+		if ctx.Err() != nil {
+			return errors.Join(failures, ctx.Err())
+		}
+		failures = errors.Join(failures, handler.pruneTier(tier, dryRun))
+	}
+	if ctx.Err() != nil {
+		return errors.Join(failures, ctx.Err())
+	}
+	// chunks of a repository are only referenced by manifests, drop the ones of pruned snapshots
+	return errors.Join(failures, CollectChunks(handler.Storage, handler.Prefix, handler.Clock().Add(-handler.ChunkGracePeriod), handler.RemoteLock, dryRun))
 }
 
-func (handler *RemoveHandler) handleMaxRotation(key string, rotation int) {
-	previous := handler.util.GetTopDirectories(key)
-	previousList := []dirDate{}
-	if len(previous) > 0 {
-		for _, next := range previous {
-			dayTime, _ := time.Parse(RFC3339NoTime, next)
-			previousList = append(previousList, dirDate{Value: next, DayTime: dayTime})
+func (handler *RemoveHandler) pruneTier(tier string, dryRun bool) error {
+	tierPrefix := fmt.Sprintf("%s/%s/", handler.Prefix, tier)
+	ids, err := ListSnapshotIDs(handler.Storage, handler.Prefix, tier)
+	if checkErr(err) {
+		return err
+	}
+	complete, err := SnapshotsComplete(handler.Storage, handler.Prefix, tier, ids)
+	if checkErr(err) {
+		return err
+	}
+	snapshots := []retention.Snapshot{}
+	for _, id := range ids {
+		taken, err := ParseSnapshotID(id)
+		if err != nil {
+			// never delete what isn't a snapshot of ours
+			fmt.Printf("Keeping %s%s: not a snapshot, %v\n", tierPrefix, id, err)
+			continue
 		}
+		snapshots = append(snapshots, retention.Snapshot{ID: id, Time: taken, Incomplete: !complete[id]})
 	}
 
-	sort.Sort(dirDateList(previousList)) // asc order
-
-	if len(previousList) > rotation {
-		index := 0
-		for index < rotation {
-			next := previousList[index]
-			handler.util.CleanFiles(fmt.Sprintf("%s/%s", key, next.Value))
+	var failures error
+	for _, decision := range retention.Apply(TierPolicy(tier, handler.Retention), snapshots, handler.Clock()) {
+		snapshotPrefix := tierPrefix + decision.Snapshot.ID + "/"
+		if decision.Keep {
+			if dryRun {
+				fmt.Printf("Keep %s/%s (%s)\n", handler.Storage, snapshotPrefix, strings.Join(decision.Reasons, ", "))
+			}
+			continue
+		}
+		if dryRun {
+			fmt.Printf("Would delete %s/%s\n", handler.Storage, snapshotPrefix)
+			continue
+		}
+		fmt.Printf("Deleting %s/%s\n", handler.Storage, snapshotPrefix)
+		cleanErr := CleanFiles(handler.Storage, snapshotPrefix)
+		if cleanErr == nil {
+			cleanErr = DeleteManifest(handler.Storage, handler.Prefix, tier, decision.Snapshot.ID)
 		}
+		checkErr(cleanErr)
+		failures = errors.Join(failures, cleanErr)
 	}
+	return failures
 }
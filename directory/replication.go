@@ -0,0 +1,90 @@
+package directory
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+ * Outcome of a backup run on a single destination
+ */
+type DestinationResult struct {
+	Destination string
+	Prefix      string
+	Err         error
+	Duration    time.Duration
+}
+
+/**
+ * Run the same backup against every destination concurrently.
+ * Each destination opens its own storage and keeps its own rotation,
+ * a failure on one of them does not stop the others
+ */
+func Replicate(ctx context.Context, destinations []string, prefix string, options StorageOptions, run func(ctx context.Context, storage Storage) error) []DestinationResult {
+	results := make([]DestinationResult, len(destinations))
+	wg := &sync.WaitGroup{}
+	for index, destination := range destinations {
+		wg.Add(1)
+		go func(index int, destination string) {
+			defer wg.Done()
+			start := time.Now()
+			results[index] = DestinationResult{
+				Destination: destination,
+				Prefix:      prefix,
+				Err:         replicateTo(ctx, destination, options, run),
+				Duration:    time.Since(start),
+			}
+		}(index, destination)
+	}
+	wg.Wait()
+	return results
+}
+
+func replicateTo(ctx context.Context, destination string, options StorageOptions, run func(ctx context.Context, storage Storage) error) error {
+	storage, err := OpenStorage(ctx, destination, options)
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+	return run(ctx, storage)
+}
+
+/**
+ * Outcome of the run on every destination, nil when all of them succeeded, see Summarize
+ */
+func ReplicationError(name string, results []DestinationResult) error {
+	outcomes := []error{}
+	for _, result := range results {
+		if result.Err != nil {
+			outcomes = append(outcomes, fmt.Errorf("%s/%s: %w", result.Destination, result.Prefix, result.Err))
+			continue
+		}
+		outcomes = append(outcomes, nil)
+	}
+	return Summarize(name, outcomes)
+}
+
+/**
+ * Print one line per destination
+ */
+func PrintReport(name string, results []DestinationResult) {
+	fmt.Printf("Backup report for %s:\n", name)
+	for _, result := range results {
+		if result.Err != nil {
+			failed := FailedFiles(result.Err)
+			if len(failed) == 0 {
+				fmt.Printf("  [%s] %s/%s after %s: %s\n", strings.ToUpper(string(StatusOf(result.Err))), result.Destination, result.Prefix, result.Duration.Round(time.Millisecond), result.Err)
+				continue
+			}
+			fmt.Printf("  [%s] %s/%s after %s, %d files failed:\n", strings.ToUpper(string(StatusOf(result.Err))), result.Destination, result.Prefix, result.Duration.Round(time.Millisecond), len(failed))
+			for _, file := range failed {
+				fmt.Printf("    %s\n", file)
+			}
+			continue
+		}
+		fmt.Printf("  [OK] %s/%s in %s\n", result.Destination, result.Prefix, result.Duration.Round(time.Millisecond))
+	}
+}
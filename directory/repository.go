@@ -0,0 +1,278 @@
+package directory
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"playus/server-backup/chunker"
+)
+
+// Chunks of a repository are stored once by ID, <prefix>/chunks/<first two hex digits>/<id>, see ChunkID
+const chunksDir = "chunks"
+
+/**
+ * Deduplicated storage of a prefix: files are split in content-defined chunks stored once,
+ * a snapshot is only a manifest listing the chunks of every file
+ */
+type Repository struct {
+	Storage Storage
+	Prefix  string
+	mutex   sync.Mutex
+	// chunks stored under the prefix
+	chunks map[string]bool
+	// files of the newest daily snapshot, unchanged files reuse their chunks without being read
+	previous map[string]ManifestFile
+}
+
+/**
+ * List the stored chunks and read the newest daily snapshot of the prefix
+ */
+func OpenRepository(storage Storage, prefix string) (*Repository, error) {
+	repository := &Repository{
+		Storage:  storage,
+		Prefix:   prefix,
+		chunks:   map[string]bool{},
+		previous: map[string]ManifestFile{},
+	}
+	err := storage.List(fmt.Sprintf("%s/%s/", prefix, chunksDir), func(object ObjectInfo) error {
+		repository.chunks[object.Key[strings.LastIndex(object.Key, "/")+1:]] = true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	manifests, err := ListManifests(storage, prefix, DAILY)
+	if err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	for id := range manifests {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for index := len(ids) - 1; index >= 0; index-- {
+		manifest, err := ReadManifest(storage, prefix, DAILY, ids[index])
+		if err != nil {
+			return nil, err
+		}
+		if !manifest.Repository {
+			continue
+		}
+		for _, file := range manifest.Files {
+			repository.previous[file.Path] = file
+		}
+		break
+	}
+	return repository, nil
+}
+
+/**
+ * Key of a chunk by its ID, see ChunkID
+ */
+func ChunkKey(prefix string, id string) string {
+	return fmt.Sprintf("%s/%s/%s/%s", prefix, chunksDir, id[:2], id)
+}
+
+func (repository *Repository) hasChunk(id string) bool {
+	repository.mutex.Lock()
+	defer repository.mutex.Unlock()
+	return repository.chunks[id]
+}
+
+func (repository *Repository) addChunk(id string) {
+	repository.mutex.Lock()
+	defer repository.mutex.Unlock()
+	repository.chunks[id] = true
+}
+
+/**
+ * The entry of the previous snapshot when the file didn't change since and all its chunks are stored.
+ * Like UpToDate, a file replaced by another one with the same size and mtime has another inode
+ */
+func (repository *Repository) Unchanged(relPath string, stat os.FileInfo) (ManifestFile, bool) {
+	previous, exists := repository.previous[relPath]
+	if !exists || previous.Size != stat.Size() || !previous.ModTime.Equal(stat.ModTime().UTC()) || previous.Inode != fileInode(stat) {
+		return ManifestFile{}, false
+	}
+	for _, chunk := range previous.Chunks {
+		if !repository.hasChunk(chunk) {
+			return ManifestFile{}, false
+		}
+	}
+	return previous, true
+}
+
+/**
+ * Split a local file in chunks and upload the ones not stored yet,
+ * returns the checksum of the file and its chunks. Failures are returned as *FileError
+ */
+func (repository *Repository) StoreFile(ctx context.Context, localPath string) (string, []string, error) {
+	checkSum, chunks, err := repository.storeFile(ctx, localPath)
+	if err != nil {
+		return "", nil, &FileError{Op: "upload", Key: localPath, Err: err}
+	}
+	return checkSum, chunks, nil
+}
+
+func (repository *Repository) storeFile(ctx context.Context, localPath string) (string, []string, error) {
+	file, err := os.Open(localPath)
+	if checkErr(err) {
+		return "", nil, err
+	}
+	defer file.Close()
+
+	fileHash := sha256.New()
+	chunks := []string{}
+	stored := 0
+	reader := chunker.New(newContextReader(ctx, file))
+	for {
+		chunk, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if checkErr(err) {
+			return "", nil, err
+		}
+		fileHash.Write(chunk)
+		id, err := ChunkID(repository.Storage, repository.Prefix, chunk, nil)
+		if checkErr(err) {
+			return "", nil, err
+		}
+		chunks = append(chunks, id)
+		if repository.hasChunk(id) {
+			continue
+		}
+		key := ChunkKey(repository.Prefix, id)
+		err = repository.Storage.Put(key, bytes.NewReader(chunk), ObjectInfo{Key: key, Size: int64(len(chunk)), ContentType: "application/octet-stream"})
+		if checkErr(err) {
+			return "", nil, err
+		}
+		repository.addChunk(id)
+		stored++
+	}
+	fmt.Printf("Stored %s: %d chunks, %d new\n", localPath, len(chunks), stored)
+	return fmt.Sprintf("%x", fileHash.Sum(nil)), chunks, nil
+}
+
+/**
+ * Rebuild a file of a repository snapshot from its chunks, every chunk is verified.
+ * Failures are returned as *FileError
+ */
+func RestoreChunks(ctx context.Context, storage Storage, prefix string, file ManifestFile, targetFile string) error {
+	if err := restoreChunks(ctx, storage, prefix, file, targetFile); err != nil {
+		return &FileError{Op: "download", Key: file.Path, Err: err}
+	}
+	return nil
+}
+
+func restoreChunks(ctx context.Context, storage Storage, prefix string, file ManifestFile, targetFile string) error {
+	target, err := os.Create(targetFile)
+	if checkErr(err) {
+		return err
+	}
+	defer target.Close()
+
+	fmt.Println("Downloading: ", target.Name())
+	for _, id := range file.Chunks {
+		if err := restoreChunk(ctx, storage, prefix, id, target); err != nil {
+			checkErr(err)
+			return err
+		}
+	}
+	fmt.Println("Downloaded: ", target.Name(), file.Size, "bytes")
+	return nil
+}
+
+func restoreChunk(ctx context.Context, storage Storage, prefix string, id string, target io.Writer) error {
+	key := ChunkKey(prefix, id)
+	body, info, err := storage.Get(key)
+	if err != nil {
+		return fmt.Errorf("unable to download chunk %s, %v", key, err)
+	}
+	defer body.Close()
+	var chunk bytes.Buffer
+	if _, err := io.Copy(&chunk, newContextReader(ctx, body)); err != nil {
+		return fmt.Errorf("unable to download chunk %s, %v", key, err)
+	}
+	stored, err := ChunkID(storage, prefix, chunk.Bytes(), info)
+	if err != nil {
+		return err
+	}
+	if stored != id {
+		return fmt.Errorf("chunk %s is corrupted, its checksum doesn't match", key)
+	}
+	_, err = target.Write(chunk.Bytes())
+	return err
+}
+
+/**
+ * Delete the chunks no manifest of the prefix references anymore and stored before olderThan, dryRun only counts them.
+ * A backup running meanwhile may reuse an unreferenced chunk, so they are only deleted while holding the remote lock.
+ * Nothing is deleted when a manifest can't be read
+ */
+func CollectChunks(storage Storage, prefix string, olderThan time.Time, locked bool, dryRun bool) error {
+	referenced := map[string]bool{}
+	for _, rotation := range []string{HOURLY, DAILY, WEEKLY, MONTHLY} {
+		manifests, err := ListManifests(storage, prefix, rotation)
+		if err != nil {
+			return err
+		}
+		for id := range manifests {
+			manifest, err := ReadManifest(storage, prefix, rotation, id)
+			if err != nil {
+				return err
+			}
+			for _, file := range manifest.Files {
+				for _, chunk := range file.Chunks {
+					referenced[chunk] = true
+				}
+			}
+		}
+	}
+	unreferenced := []string{}
+	size := int64(0)
+	recent := 0
+	err := storage.List(fmt.Sprintf("%s/%s/", prefix, chunksDir), func(object ObjectInfo) error {
+		if referenced[object.Key[strings.LastIndex(object.Key, "/")+1:]] {
+			return nil
+		}
+		if !object.LastModified.Before(olderThan) {
+			// maybe stored by a run still writing its snapshots
+			recent++
+			return nil
+		}
+		unreferenced = append(unreferenced, object.Key)
+		size += object.Size
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if recent > 0 {
+		fmt.Printf("Keeping %d unreferenced chunks of %s/%s stored since %s\n", recent, storage, prefix, olderThan.Format(time.RFC3339))
+	}
+	if len(unreferenced) == 0 {
+		return nil
+	}
+	if dryRun {
+		fmt.Printf("Would delete %d unreferenced chunks of %s/%s, %d bytes\n", len(unreferenced), storage, prefix, size)
+		if !locked {
+			fmt.Println("Unreferenced chunks are only deleted with remoteLock = true")
+		}
+		return nil
+	}
+	if !locked {
+		fmt.Printf("Keeping %d unreferenced chunks of %s/%s, %d bytes: deleting them requires remoteLock = true\n", len(unreferenced), storage, prefix, size)
+		return nil
+	}
+	fmt.Printf("Deleting %d unreferenced chunks of %s/%s, %d bytes\n", len(unreferenced), storage, prefix, size)
+	return DeleteObjects(storage, unreferenced)
+}
@@ -0,0 +1,213 @@
+package directory
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"playus/server-backup/chunker"
+)
+
+func TestCollectChunks(t *testing.T) {
+	now := time.Date(2026, 10, 17, 3, 0, 0, 0, time.UTC)
+	referenced := strings.Repeat("a", 64)
+	orphan := strings.Repeat("b", 64)
+	recent := strings.Repeat("c", 64)
+
+	open := func(t *testing.T) Storage {
+		root := t.TempDir()
+		storage, err := NewFileSystemStorage(root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		manifest, err := json.Marshal(Manifest{ID: "2026-10-16", Rotation: DAILY, Repository: true, Files: []ManifestFile{{Path: "file.txt", Chunks: []string{referenced}}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		key := ManifestKey("prefix", DAILY, "2026-10-16")
+		if err := storage.Put(key, bytes.NewReader(manifest), ObjectInfo{Key: key, Size: int64(len(manifest))}); err != nil {
+			t.Fatal(err)
+		}
+		stored := map[string]time.Time{referenced: now.Add(-72 * time.Hour), orphan: now.Add(-48 * time.Hour), recent: now.Add(-time.Hour)}
+		for checkSum, modified := range stored {
+			key := ChunkKey("prefix", checkSum)
+			if err := storage.Put(key, strings.NewReader(checkSum), ObjectInfo{Key: key, Size: 64}); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(filepath.Join(root, key), modified, modified); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return storage
+	}
+	exists := func(t *testing.T, storage Storage, checkSum string) bool {
+		t.Helper()
+		_, err := storage.Head(ChunkKey("prefix", checkSum))
+		if err != nil && !errors.Is(err, ErrObjectNotFound) {
+			t.Fatal(err)
+		}
+		return err == nil
+	}
+
+	t.Run("locked", func(t *testing.T) {
+		storage := open(t)
+		if err := CollectChunks(storage, "prefix", now.Add(-24*time.Hour), true, false); err != nil {
+			t.Fatal(err)
+		}
+		if !exists(t, storage, referenced) || exists(t, storage, orphan) || !exists(t, storage, recent) {
+			t.Errorf("expected only the old unreferenced chunk to be deleted")
+		}
+	})
+	t.Run("dry run", func(t *testing.T) {
+		storage := open(t)
+		if err := CollectChunks(storage, "prefix", now.Add(-24*time.Hour), true, true); err != nil {
+			t.Fatal(err)
+		}
+		if !exists(t, storage, orphan) {
+			t.Errorf("a dry run deleted a chunk")
+		}
+	})
+	t.Run("without lock", func(t *testing.T) {
+		storage := open(t)
+		if err := CollectChunks(storage, "prefix", now.Add(-24*time.Hour), false, false); err != nil {
+			t.Fatal(err)
+		}
+		if !exists(t, storage, orphan) {
+			t.Errorf("an unreferenced chunk was deleted without holding the lock")
+		}
+	})
+	t.Run("no grace period", func(t *testing.T) {
+		storage := open(t)
+		if err := CollectChunks(storage, "prefix", now, true, false); err != nil {
+			t.Fatal(err)
+		}
+		if !exists(t, storage, referenced) || exists(t, storage, orphan) || exists(t, storage, recent) {
+			t.Errorf("expected every unreferenced chunk to be deleted")
+		}
+	})
+}
+
+func TestRepositoryUnchanged(t *testing.T) {
+	dir := t.TempDir()
+	localPath := filepath.Join(dir, "file.txt")
+	if err := os.WriteFile(localPath, []byte("first content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	stat, err := os.Stat(localPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunk := strings.Repeat("a", 64)
+	repository := &Repository{
+		Prefix: "prefix",
+		chunks: map[string]bool{chunk: true},
+		previous: map[string]ManifestFile{"file.txt": {
+			Path:    "file.txt",
+			Size:    stat.Size(),
+			ModTime: stat.ModTime().UTC(),
+			Inode:   fileInode(stat),
+			Chunks:  []string{chunk},
+		}},
+	}
+	if _, unchanged := repository.Unchanged("file.txt", stat); !unchanged {
+		t.Error("the same file taken as changed")
+	}
+
+	// replaced by another file with the same size and mtime
+	replacement := filepath.Join(dir, "replacement.txt")
+	if err := os.WriteFile(replacement, []byte("other content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(replacement, stat.ModTime(), stat.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(replacement, localPath); err != nil {
+		t.Fatal(err)
+	}
+	replaced, err := os.Stat(localPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fileInode(replaced) == 0 {
+		t.Skip("no inodes on this platform")
+	}
+	if _, unchanged := repository.Unchanged("file.txt", replaced); unchanged {
+		t.Error("a replaced file with the same size and mtime taken as unchanged")
+	}
+}
+
+func TestRepositoryRoundTrip(t *testing.T) {
+	// several chunks, with a repeated part stored once
+	random := rand.New(rand.NewSource(1))
+	part := make([]byte, 3*chunker.MaxSize/2)
+	random.Read(part)
+	content := append(append([]byte{}, part...), part...)
+
+	for name, options := range map[string]EncryptionOptions{"plain": {}, "encrypted": {Passphrase: "correct horse"}} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			localPath := filepath.Join(dir, "file.bin")
+			if err := os.WriteFile(localPath, content, 0644); err != nil {
+				t.Fatal(err)
+			}
+			storage, raw := newEncryptedStorage(t, t.TempDir(), options)
+			repository, err := OpenRepository(storage, "prefix")
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkSum, chunks, err := repository.StoreFile(context.Background(), localPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if checkSum != fmt.Sprintf("%x", sha256.Sum256(content)) {
+				t.Errorf("stored with the checksum %s", checkSum)
+			}
+			distinct := map[string]bool{}
+			for _, chunk := range chunks {
+				distinct[chunk] = true
+			}
+			if len(chunks) < 4 || len(distinct) == len(chunks) {
+				t.Errorf("%d chunks, %d distinct: the repeated part wasn't deduplicated", len(chunks), len(distinct))
+			}
+			stored := 0
+			err = raw.List("prefix/chunks/", func(object ObjectInfo) error {
+				stored++
+				return nil
+			})
+			if err != nil || stored != len(distinct) {
+				t.Errorf("%d chunks stored, expected %d, %v", stored, len(distinct), err)
+			}
+
+			target := filepath.Join(dir, "restored.bin")
+			file := ManifestFile{Path: "file.bin", Size: int64(len(content)), SHA256: checkSum, Chunks: chunks}
+			if err := RestoreChunks(context.Background(), storage, "prefix", file, target); err != nil {
+				t.Fatal(err)
+			}
+			restored, err := os.ReadFile(target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(restored, content) {
+				t.Error("the restored file differs")
+			}
+
+			// a chunk replaced by another one fails the restore
+			replaced := ChunkKey("prefix", chunks[1])
+			if err := storage.Put(replaced, bytes.NewReader(part[:100]), ObjectInfo{Key: replaced, Size: 100}); err != nil {
+				t.Fatal(err)
+			}
+			if err := RestoreChunks(context.Background(), storage, "prefix", file, target); err == nil || !strings.Contains(err.Error(), "corrupted") {
+				t.Errorf("restored a corrupted chunk: %v", err)
+			}
+		})
+	}
+}
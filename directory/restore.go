@@ -1,103 +1,126 @@
 package directory
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"os"
 	"path"
 	"path/filepath"
-
-	"playus/server-backup/config"
-
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 )
 
 type Restore struct {
-	Key       string
-	Secret    string
-	Region    string
-	Endpoint  string
+	Storage   StorageOptions
 	Directory string
 	Prefix    string
+	Rotation  string
+	Date      string
 	Bucket    string
+	Retry     RetryPolicy
+	// downloads running at once
+	Workers int
+	// restore a snapshot without manifest, whatever it holds
+	AllowIncomplete bool
 }
 
-func NewRestore(directory string, bucket string, prefix string) *Restore {
+func NewRestore(options StorageOptions, retry RetryPolicy, workers int, directory string, bucket string, prefix string, rotation string, date string, allowIncomplete bool) *Restore {
 	worker := &Restore{
-		Key:       config.Conf.Get("dirbackup.key").(string),
-		Secret:    config.Conf.Get("dirbackup.secret").(string),
-		Region:    config.Conf.Get("dirbackup.region").(string),
-		Endpoint:  config.Conf.Get("dirbackup.endpoint").(string),
-		Bucket:    bucket,
-		Prefix:    prefix,
-		Directory: directory,
+		Storage:         options,
+		Bucket:          bucket,
+		Prefix:          prefix,
+		Rotation:        rotation,
+		Date:            date,
+		Directory:       directory,
+		Retry:           retry,
+		Workers:         workers,
+		AllowIncomplete: allowIncomplete,
 	}
 	return worker
 }
 
-func (restore *Restore) RestoreBackup() {
-	// create new aws session
-	session, err := session.NewSession(&aws.Config{
-		Region:      aws.String(restore.Region),
-		Credentials: credentials.NewStaticCredentials(restore.Key, restore.Secret, ""),
-		Endpoint:    aws.String(restore.Endpoint),
-	})
+/**
+ * Download every missing file of the snapshot, returns a *RunError when any download failed.
+ * Only the files of the manifest are restored, a snapshot without one is refused unless AllowIncomplete
+ */
+func (restore *Restore) RestoreBackup(ctx context.Context) error {
+	storage, err := OpenStorage(ctx, restore.Bucket, restore.Storage)
 	if checkErr(err) {
-		return
-	}
-
-	// Create S3 service client
-	s3Client := s3.New(session)
-	if s3Client == nil {
-		return
+		return err
 	}
+	defer storage.Close()
 
-	uploader := s3manager.NewUploader(session)
-	if uploader == nil {
-		return
+	if _, err := ParseSnapshotID(restore.Date); checkErr(err) {
+		return err
 	}
-	downloader := s3manager.NewDownloader(session)
-	if downloader == nil {
-		return
+	manifest, err := restore.readManifest(storage)
+	if checkErr(err) {
+		return err
 	}
+	snapshotPrefix := fmt.Sprintf("%s/%s/%s/", restore.Prefix, restore.Rotation, restore.Date)
 
-	util := NewS3Util(restore.Bucket, restore.Prefix, restore.Directory, s3Client, uploader, downloader)
-	workQueue := NewWorkerQueue()
-	for util.HasMore() {
-		if workQueue.Size() >= 5 { // TODO: Allow to configure workers
-			workQueue.DoWork()
+	pool := NewWorkerPool(ctx, restore.Workers)
+	// submit the worker restoring relPath unless the file exists
+	download := func(relPath string, newWorker func(targetPath string) S3Worker) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
 		}
-		for _, next := range *util.GetNextPage() {
-			if next == nil {
-				continue
-			}
-			remotePath := *next.Key
-			extractedSuffix, err := util.ExtractTargetSuffix(remotePath)
+		targetPath := filepath.Join(restore.Directory, filepath.FromSlash(relPath))
+		if CheckFileExists(targetPath) {
+			return nil
+		}
+		// file does not exist, download from remote
+		parentDir := path.Dir(targetPath)
+		if !isDirectory(parentDir) {
+			err := os.MkdirAll(parentDir, os.ModePerm)
 			if checkErr(err) {
-				continue
+				return nil
 			}
-			suffix := *extractedSuffix
-			targetPath := filepath.Join(restore.Directory, suffix)
-			if !CheckFileExists(targetPath) {
-				if workQueue.Size() >= 5 { // TODO: Allow to configure workers
-					workQueue.DoWork()
-				}
-				// file does not exist, delete from remote
-				parentDir := path.Dir(targetPath)
-				if !isDirectory(parentDir) {
-					err := os.MkdirAll(parentDir, os.ModePerm)
-					if checkErr(err) {
-						continue
-					}
-
+		}
+		return pool.Submit(newWorker(targetPath))
+	}
+	if manifest != nil {
+		for _, file := range manifest.Files {
+			err = download(file.Path, func(targetPath string) S3Worker {
+				if manifest.Repository {
+					return NewChunkRestoreWorker(restore.Prefix, file, targetPath, storage, restore.Retry)
 				}
-				workQueue.Add(NewDownloadWorker(remotePath, targetPath, *util))
+				return NewDownloadWorker(snapshotPrefix+file.Path, targetPath, storage, restore.Retry)
+			})
+			if err != nil {
+				break
 			}
 		}
+	} else {
+		err = storage.List(snapshotPrefix, func(next ObjectInfo) error {
+			return download(next.Key[len(snapshotPrefix):], func(targetPath string) S3Worker {
+				return NewDownloadWorker(next.Key, targetPath, storage, restore.Retry)
+			})
+		})
+	}
+	checkErr(err)
+	transfers := &TransferError{}
+	transfers.Add(pool.Wait())
+	outcomes := []error{err}
+	if transfers.Succeeded > 0 || len(transfers.Failures) > 0 {
+		outcomes = append(outcomes, transfers.Err())
+	}
+	return Summarize("restore", outcomes)
+}
+
+/**
+ * Manifest of the snapshot, nil for a snapshot written before manifests existed or an allowed incomplete one
+ */
+func (restore *Restore) readManifest(storage Storage) (*Manifest, error) {
+	manifest, err := ReadManifest(storage, restore.Prefix, restore.Rotation, restore.Date)
+	if !errors.Is(err, ErrObjectNotFound) {
+		return manifest, err
+	}
+	complete, err := SnapshotsComplete(storage, restore.Prefix, restore.Rotation, []string{restore.Date})
+	if err != nil {
+		return nil, err
 	}
-	if workQueue.Size() > 0 { // TODO: Allow to configure workers
-		workQueue.DoWork()
+	if !complete[restore.Date] && !restore.AllowIncomplete {
+		return nil, fmt.Errorf("%s/%s/%s has no manifest, the run writing it didn't complete. Use -allow-incomplete to restore it anyway", restore.Prefix, restore.Rotation, restore.Date)
 	}
+	return nil, nil
 }
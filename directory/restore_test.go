@@ -0,0 +1,89 @@
+package directory
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"playus/server-backup/config"
+)
+
+func TestRestoreWithJobKey(t *testing.T) {
+	source := t.TempDir()
+	files := map[string]string{"file.txt": "job content", "sub/other.txt": "other content"}
+	for relPath, content := range files {
+		localPath := filepath.Join(source, filepath.FromSlash(relPath))
+		if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(localPath, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root := t.TempDir()
+	destination := fileScheme + root
+	conf := &config.Config{
+		General: config.GeneralConfig{StateDir: t.TempDir()},
+		DirBackup: config.DirBackupConfig{
+			Workers: 2,
+			Storage: config.StorageConfig{EncryptionPassphrase: "section passphrase"},
+			Jobs: []config.DirectoryJob{{
+				Name:             "docs",
+				Destinations:     []string{destination},
+				Prefix:           "docs",
+				Directories:      []string{source},
+				Workers:          2,
+				Rotation:         config.RotationConfig{DailyRotation: 1},
+				Storage:          config.StorageConfig{EncryptionPassphrase: "job passphrase"},
+				ChunkGracePeriod: "24h",
+			}},
+		},
+	}
+	worker, err := NewWorker(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, _ := worker.Job("docs")
+	if err := worker.DoJobBackup(context.Background(), job); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := NewFileSystemStorage(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, err := ListSnapshotIDs(raw, "docs", DAILY)
+	if err != nil || len(ids) != 1 {
+		t.Fatalf("snapshots %v, %v", ids, err)
+	}
+
+	restore := func(t *testing.T, jobName string) (string, error) {
+		t.Helper()
+		access, err := ResolveJobAccess(conf, jobName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		target := t.TempDir()
+		err = NewRestore(access.Storage, access.Retry, access.Workers, target, destination, "docs", DAILY, ids[0], false).RestoreBackup(context.Background())
+		return target, err
+	}
+	for _, name := range []string{"docs", "dirbackup/docs"} {
+		target, err := restore(t, name)
+		if err != nil {
+			t.Fatalf("restore with the key of %s: %v", name, err)
+		}
+		for relPath, content := range files {
+			restored, err := os.ReadFile(filepath.Join(target, filepath.FromSlash(relPath)))
+			if err != nil || string(restored) != content {
+				t.Errorf("%s restored as %q, %v", relPath, restored, err)
+			}
+		}
+	}
+	// the key of the [dirbackup] section didn't encrypt it
+	if _, err := restore(t, ""); err == nil {
+		t.Error("restored with the key of the section")
+	}
+	if _, err := ResolveJobAccess(conf, "unknown"); err == nil {
+		t.Error("resolved an unknown job")
+	}
+}
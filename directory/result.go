@@ -0,0 +1,199 @@
+package directory
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+/**
+ * Outcome of a backup run
+ */
+type Status string
+
+const (
+	StatusSuccess Status = "success"
+	// some files, databases or destinations failed, the rest was backed up
+	StatusPartial Status = "partial"
+	StatusFailed  Status = "failed"
+)
+
+// how many failures are listed on an error message, the rest is only counted
+const maxListedFailures = 5
+
+/**
+ * A failure on a single file or object
+ */
+type FileError struct {
+	Op       string
+	Key      string
+	Err      error
+	Attempts int
+}
+
+func (err *FileError) Error() string {
+	if err.Attempts > 1 {
+		return fmt.Sprintf("%s %s after %d attempts: %v", err.Op, err.Key, err.Attempts, err.Err)
+	}
+	return fmt.Sprintf("%s %s: %v", err.Op, err.Key, err.Err)
+}
+
+func (err *FileError) Unwrap() error {
+	return err.Err
+}
+
+/**
+ * Transfers of a batch, returned only when some of them failed
+ */
+type TransferError struct {
+	Succeeded int
+	Failures  []*FileError
+}
+
+func (err *TransferError) Add(succeeded int, failures []*FileError) {
+	err.Succeeded += succeeded
+	err.Failures = append(err.Failures, failures...)
+}
+
+/**
+ * nil when no transfer failed
+ */
+func (err *TransferError) Err() error {
+	if len(err.Failures) == 0 {
+		return nil
+	}
+	return err
+}
+
+func (err *TransferError) Error() string {
+	messages := []string{}
+	for _, failure := range err.Failures {
+		messages = append(messages, failure.Error())
+	}
+	return fmt.Sprintf("%d of %d transfers failed: %s", len(err.Failures), len(err.Failures)+err.Succeeded, listFailures(messages))
+}
+
+func (err *TransferError) Unwrap() []error {
+	errs := []error{}
+	for _, failure := range err.Failures {
+		errs = append(errs, failure)
+	}
+	return errs
+}
+
+/**
+ * A backup run that did not fully succeed, Failures holds the error of every failed part
+ */
+type RunError struct {
+	Name     string
+	Status   Status
+	Failures []error
+}
+
+func (err *RunError) Error() string {
+	messages := []string{}
+	for _, failure := range err.Failures {
+		messages = append(messages, failure.Error())
+	}
+	outcome := "failed"
+	if err.Status == StatusPartial {
+		outcome = "partly failed"
+	}
+	return fmt.Sprintf("%s %s: %s", err.Name, outcome, listFailures(messages))
+}
+
+func (err *RunError) Unwrap() []error {
+	return err.Failures
+}
+
+/**
+ * Aggregate the outcome of every part of a run, a file, a database or a destination, nil meaning success.
+ * Returns nil when every part succeeded, otherwise a *RunError failed when no part did any work
+ */
+func Summarize(name string, outcomes []error) error {
+	failures := []error{}
+	worked := false
+	for _, outcome := range outcomes {
+		status := StatusOf(outcome)
+		if status != StatusFailed {
+			worked = true
+		}
+		if outcome != nil {
+			failures = append(failures, outcome)
+		}
+	}
+	if len(failures) == 0 {
+		return nil
+	}
+	status := StatusFailed
+	if worked {
+		status = StatusPartial
+	}
+	return &RunError{
+		Name:     name,
+		Status:   status,
+		Failures: failures,
+	}
+}
+
+/**
+ * Status of a run from its error: a *RunError knows its status,
+ * otherwise the run partly failed when some transfer succeeded
+ */
+func StatusOf(err error) Status {
+	if err == nil {
+		return StatusSuccess
+	}
+	var runErr *RunError
+	if errors.As(err, &runErr) {
+		return runErr.Status
+	}
+	if succeededTransfers(err) > 0 {
+		return StatusPartial
+	}
+	return StatusFailed
+}
+
+func succeededTransfers(err error) int {
+	switch current := err.(type) {
+	case *TransferError:
+		return current.Succeeded
+	case interface{ Unwrap() []error }:
+		total := 0
+		for _, next := range current.Unwrap() {
+			total += succeededTransfers(next)
+		}
+		return total
+	case interface{ Unwrap() error }:
+		return succeededTransfers(current.Unwrap())
+	}
+	return 0
+}
+
+/**
+ * Every file that failed in the run
+ */
+func FailedFiles(err error) []*FileError {
+	switch current := err.(type) {
+	case nil:
+		return nil
+	case *FileError:
+		return []*FileError{current}
+	case interface{ Unwrap() []error }:
+		failed := []*FileError{}
+		for _, next := range current.Unwrap() {
+			failed = append(failed, FailedFiles(next)...)
+		}
+		return failed
+	case interface{ Unwrap() error }:
+		return FailedFiles(current.Unwrap())
+	}
+	return nil
+}
+
+func listFailures(messages []string) string {
+	if len(messages) <= maxListedFailures {
+		return strings.Join(messages, "; ")
+	}
+	return fmt.Sprintf("%s; and %d more", strings.Join(messages[:maxListedFailures], "; "), len(messages)-maxListedFailures)
+}
@@ -0,0 +1,116 @@
+package directory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"syscall"
+	"time"
+
+	"playus/server-backup/config"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+/**
+ * How often and how long to wait before retrying a failed transfer
+ */
+type RetryPolicy struct {
+	Retries      int
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+}
+
+func NewRetryPolicy(conf config.RetryConfig) RetryPolicy {
+	return RetryPolicy{
+		Retries:      conf.Retries,
+		InitialDelay: time.Duration(conf.Delay) * time.Second,
+		MaxDelay:     time.Duration(conf.MaxDelay) * time.Second,
+	}
+}
+
+/**
+ * Run op until it succeeds, fails with a permanent error or runs out of retries.
+ * Returns the number of attempts and the last error
+ */
+func (policy RetryPolicy) Do(ctx context.Context, name string, op func() error) (int, error) {
+	attempt := 0
+	for {
+		attempt++
+		err := op()
+		if err == nil || attempt > policy.Retries || !IsTransient(err) || ctx.Err() != nil {
+			return attempt, err
+		}
+		delay := policy.backoff(attempt)
+		fmt.Printf("Retrying %s in %s, attempt %d of %d failed: %s\n", name, delay.Round(time.Millisecond), attempt, policy.Retries+1, err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return attempt, errors.Join(err, ctx.Err())
+		case <-timer.C:
+		}
+	}
+}
+
+/**
+ * Exponential backoff with jitter, a random delay between half and the whole of InitialDelay * 2^(attempt-1)
+ */
+func (policy RetryPolicy) backoff(attempt int) time.Duration {
+	delay := policy.InitialDelay
+	for index := 1; index < attempt && delay < policy.MaxDelay; index++ {
+		delay *= 2
+	}
+	if policy.MaxDelay > 0 && delay > policy.MaxDelay {
+		delay = policy.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(delay-half)+1))
+}
+
+/**
+ * Throttling, 5xx and network errors are worth retrying, anything else fails right away
+ */
+func IsTransient(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ErrObjectNotFound) {
+		return false
+	}
+	for current := err; current != nil; current = unwrapAny(current) {
+		if requestFailure, ok := current.(awserr.RequestFailure); ok {
+			status := requestFailure.StatusCode()
+			if status == 429 || status >= 500 {
+				return true
+			}
+		}
+		if awsErr, ok := current.(awserr.Error); ok {
+			switch awsErr.Code() {
+			case "RequestError", "RequestTimeout", "RequestTimeoutException", "SlowDown", "Throttling", "ThrottlingException", "ThrottledException", "RequestThrottled", "InternalError", "ServiceUnavailable":
+				return true
+			}
+		}
+		var netErr net.Error
+		if errors.As(current, &netErr) {
+			return true
+		}
+		if errors.Is(current, io.ErrUnexpectedEOF) || errors.Is(current, syscall.ECONNRESET) || errors.Is(current, syscall.ECONNREFUSED) || errors.Is(current, syscall.EPIPE) || errors.Is(current, syscall.ETIMEDOUT) {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+ * Next error of the chain, aws errors keep the cause in OrigErr instead of Unwrap
+ */
+func unwrapAny(err error) error {
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.OrigErr() != nil {
+		return awsErr.OrigErr()
+	}
+	return errors.Unwrap(err)
+}
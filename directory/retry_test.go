@@ -0,0 +1,138 @@
+package directory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+func TestIsTransient(t *testing.T) {
+	timeout := &net.OpError{Op: "dial", Net: "tcp", Err: os.ErrDeadlineExceeded}
+	tests := map[string]struct {
+		err       error
+		transient bool
+	}{
+		"nil":                {nil, false},
+		"not found":          {ErrObjectNotFound, false},
+		"wrapped not found":  {fmt.Errorf("head: %w", ErrObjectNotFound), false},
+		"canceled":           {context.Canceled, false},
+		"deadline":           {fmt.Errorf("upload: %w", context.DeadlineExceeded), false},
+		"permanent":          {errors.New("access denied"), false},
+		"slow down":          {awserr.New("SlowDown", "reduce your request rate", nil), true},
+		"throttling":         {awserr.New("ThrottlingException", "rate exceeded", nil), true},
+		"request error":      {awserr.New("RequestError", "send request failed", timeout), true},
+		"access denied":      {awserr.New("AccessDenied", "access denied", nil), false},
+		"status 503":         {awserr.NewRequestFailure(awserr.New("Unknown", "unavailable", nil), 503, "id"), true},
+		"status 429":         {awserr.NewRequestFailure(awserr.New("Unknown", "too many requests", nil), 429, "id"), true},
+		"status 403":         {awserr.NewRequestFailure(awserr.New("Forbidden", "forbidden", nil), 403, "id"), false},
+		"aws wrapping a net": {awserr.New("Unknown", "failed", timeout), true},
+		"net error":          {timeout, true},
+		"wrapped net error":  {fmt.Errorf("upload: %w", timeout), true},
+		"connection reset":   {fmt.Errorf("read: %w", syscall.ECONNRESET), true},
+		"connection refused": {syscall.ECONNREFUSED, true},
+		"broken pipe":        {syscall.EPIPE, true},
+		"unexpected EOF":     {io.ErrUnexpectedEOF, true},
+		"EOF":                {io.EOF, false},
+	}
+	for name, test := range tests {
+		if got := IsTransient(test.err); got != test.transient {
+			t.Errorf("%s: IsTransient(%v) = %v", name, test.err, got)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	policy := RetryPolicy{Retries: 10, InitialDelay: time.Second, MaxDelay: 30 * time.Second}
+	tests := []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{5, 16 * time.Second},
+		{6, 30 * time.Second},
+		{50, 30 * time.Second},
+	}
+	for _, test := range tests {
+		for run := 0; run < 100; run++ {
+			delay := policy.backoff(test.attempt)
+			if delay < test.max/2 || delay > test.max {
+				t.Fatalf("attempt %d: waited %s, expected between %s and %s", test.attempt, delay, test.max/2, test.max)
+			}
+		}
+	}
+	if delay := (RetryPolicy{Retries: 3}).backoff(2); delay != 0 {
+		t.Errorf("waited %s without delay", delay)
+	}
+}
+
+func TestRetryDo(t *testing.T) {
+	policy := RetryPolicy{Retries: 2, InitialDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	transient := awserr.New("SlowDown", "reduce your request rate", nil)
+
+	calls := 0
+	attempts, err := policy.Do(context.Background(), "test", func() error {
+		calls++
+		return transient
+	})
+	if attempts != 3 || calls != 3 || err != transient {
+		t.Errorf("transient: %d attempts, %d calls, %v", attempts, calls, err)
+	}
+
+	calls = 0
+	attempts, err = policy.Do(context.Background(), "test", func() error {
+		calls++
+		if calls == 2 {
+			return nil
+		}
+		return transient
+	})
+	if attempts != 2 || err != nil {
+		t.Errorf("recovered: %d attempts, %v", attempts, err)
+	}
+
+	calls = 0
+	attempts, err = policy.Do(context.Background(), "test", func() error {
+		calls++
+		return ErrObjectNotFound
+	})
+	if attempts != 1 || !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("permanent: %d attempts, %v", attempts, err)
+	}
+}
+
+func TestRetryDoStopsOnCancel(t *testing.T) {
+	policy := RetryPolicy{Retries: 5, InitialDelay: time.Hour, MaxDelay: time.Hour}
+	transient := awserr.New("SlowDown", "reduce your request rate", nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	started := time.Now()
+	attempts, err := policy.Do(ctx, "test", func() error {
+		return transient
+	})
+	if time.Since(started) > 5*time.Second {
+		t.Errorf("waited %s after the cancel", time.Since(started))
+	}
+	if attempts != 1 || !errors.Is(err, context.Canceled) || !errors.Is(err, transient) {
+		t.Errorf("canceled while waiting: %d attempts, %v", attempts, err)
+	}
+
+	calls := 0
+	attempts, err = policy.Do(ctx, "test", func() error {
+		calls++
+		return transient
+	})
+	if attempts != 1 || calls != 1 || err != transient {
+		t.Errorf("canceled before: %d attempts, %v", attempts, err)
+	}
+}
@@ -1,320 +1,258 @@
 package directory
 
 import (
-	"errors"
 	"fmt"
-	"os"
-	"strings"
+	"io"
+	"net/url"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
-
-	"github.com/gabriel-vasile/mimetype"
 )
 
-type ObjectExists struct {
-	exists       bool
-	sameCheckSum bool
-}
+// largest object a single CopyObject request accepts
+const maxCopyObjectSize = int64(5 * 1024 * 1024 * 1024)
+
+// range copied by every part of a multipart copy
+const copyPartSize = int64(512 * 1024 * 1024)
 
+// most keys a ListObjectsV2 page returns, snapshots and chunks are listed in as few requests as possible
+const listPageSize = int64(1000)
+
+/**
+ * S3 implementation of Storage, all keys are relative to the bucket
+ */
 type S3Util struct {
-	Bucket           string
-	Prefix           string
-	client           *s3.S3
-	listInput        *s3.ListObjectsV2Input
-	uploader         *s3manager.Uploader
-	downloader       *s3manager.Downloader
-	listInputHasMore bool
-	page             int
-	maxKeys          int64
+	Bucket   string
+	client   *s3.S3
+	uploader *s3manager.Uploader
+	maxKeys  int64
 }
 
-func NewS3Util(bucket string, prefix string, dir string, s3Client *s3.S3, uploader *s3manager.Uploader, downloader *s3manager.Downloader) *S3Util {
+func NewS3Util(bucket string, s3Client *s3.S3, uploader *s3manager.Uploader) *S3Util {
 	return &S3Util{
-		Bucket:           bucket,
-		Prefix:           prefix,
-		client:           s3Client,
-		page:             0,
-		maxKeys:          int64(100),
-		listInput:        nil,
-		listInputHasMore: false,
-		uploader:         uploader,
-		downloader:       downloader,
+		Bucket:   bucket,
+		client:   s3Client,
+		maxKeys:  listPageSize,
+		uploader: uploader,
 	}
 }
 
-func (util *S3Util) ResetPage() {
-	util.page = 0
-	util.listInput = nil
-}
+/**
+ * Create the aws session and clients for the given bucket
+ */
+func NewS3Storage(bucket string, options StorageOptions) (*S3Util, error) {
+	session, err := NewAWSSession(options)
+	if err != nil {
+		return nil, err
+	}
 
-func (util *S3Util) IsStart() bool {
-	return util.listInput == nil
+	// Create S3 service client, the endpoint only applies to S3 so role assumption still reaches aws sts
+	s3Client := s3.New(session, &aws.Config{
+		Endpoint: aws.String(options.Endpoint),
+	})
+	uploader := s3manager.NewUploaderWithClient(s3Client)
+	return NewS3Util(bucket, s3Client, uploader), nil
 }
 
-func (util *S3Util) HasMore() bool {
-	return util.IsStart() || util.listInputHasMore
+func (util *S3Util) String() string {
+	return fmt.Sprintf("s3://%s", util.Bucket)
 }
 
-func (util *S3Util) ObjectExists(keyFile string, checkSum *string) ObjectExists {
-	input := &s3.GetObjectInput{
-		Bucket: aws.String(util.Bucket),
-		Key:    aws.String(keyFile),
-	}
-	object, err := util.client.GetObject(input)
-	if object != nil && err == nil && checkSum != nil && object.Metadata != nil {
-		checkSumVal, exists := object.Metadata[SHA256]
-		return ObjectExists{
-			exists:       exists,
-			sameCheckSum: (*checkSumVal) == (*checkSum),
-		}
-	}
-	return ObjectExists{
-		exists:       object != nil && err == nil,
-		sameCheckSum: false,
-	}
+func (util *S3Util) Close() error {
+	return nil
 }
 
-func (util *S3Util) GetNextPage() *[]*s3.Object {
-
-	if util.listInput == nil {
-		util.listInput = &s3.ListObjectsV2Input{
-			Bucket:  aws.String(util.Bucket),
-			Prefix:  aws.String(util.Prefix),
-			MaxKeys: &util.maxKeys,
-		}
+func (util *S3Util) Put(key string, body io.Reader, info ObjectInfo) error {
+	uploadInput := s3manager.UploadInput{
+		Bucket:   aws.String(util.Bucket),
+		Key:      aws.String(key),
+		Body:     body,
+		Metadata: map[string]*string{},
 	}
-	resp, err := util.client.ListObjectsV2(util.listInput)
-	if checkErr(err) {
-		return nil
+	if info.ContentType != "" {
+		uploadInput.ContentType = aws.String(info.ContentType)
 	}
-	result := []*s3.Object{}
-	for _, key := range resp.Contents {
-		if key == nil {
-			continue
-		}
-		result = append(result, key)
+	for name, value := range info.Metadata {
+		uploadInput.Metadata[name] = aws.String(value)
 	}
-	util.listInput.ContinuationToken = resp.NextContinuationToken
-	util.listInputHasMore = *resp.IsTruncated
-
-	return &result
+	// the checksum is the one of the local file, the stored content of an encrypted or compressed object differs
+	_, encrypted := info.Metadata[EncryptionMetadata]
+	_, compressed := info.Metadata[CompressionMetadata]
+	if checkSum, exists := info.Metadata[SHA256]; exists && !encrypted && !compressed {
+		uploadInput.ChecksumSHA256 = aws.String(checkSum)
+	}
+	_, err := util.uploader.Upload(&uploadInput)
+	return err
 }
 
-// path without prefix
-func (util *S3Util) GetTopDirectories(path string) []string {
-	dirs := &map[string]bool{}
-	targetPath := fmt.Sprintf("%s/%s", util.Prefix, path)
-	listInput := &s3.ListObjectsV2Input{
-		Bucket:  aws.String(util.Bucket),
-		Prefix:  aws.String(targetPath),
-		MaxKeys: &util.maxKeys,
+func (util *S3Util) Get(key string) (io.ReadCloser, *ObjectInfo, error) {
+	object, err := util.client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(util.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, nil, util.translateError(err)
 	}
-	util.processTopListInput(targetPath, dirs, listInput)
-
-	result := []string{}
-	for key := range *dirs {
-		result = append(result, key)
+	info := &ObjectInfo{
+		Key:          key,
+		Size:         aws.Int64Value(object.ContentLength),
+		LastModified: aws.TimeValue(object.LastModified),
+		ContentType:  aws.StringValue(object.ContentType),
+		Metadata:     aws.StringValueMap(object.Metadata),
 	}
-	return result
+	return object.Body, info, nil
 }
 
-func (util *S3Util) processTopListInput(targetPath string, dirs *map[string]bool, listInput *s3.ListObjectsV2Input) {
-	resp, err := util.client.ListObjectsV2(listInput)
-	if checkErr(err) {
-		return
-	}
-	for listInput != nil {
-		for _, nextObject := range resp.Contents {
-			if nextObject == nil {
-				continue
-			}
-			objectKey := (*nextObject.Key)
-			suffix := objectKey[len(targetPath)+1:]
-			index := strings.Index(suffix, "/")
-			if index < 0 {
-				// not a directory
-				continue
-			}
-			dirName := suffix[0:index]
-			_, exists := (*dirs)[dirName]
-
-			if exists {
-				// already on the map
-				continue
-			}
-			(*dirs)[dirName] = true
-		}
-		if resp.ContinuationToken == nil {
-			// end the loop
-			listInput = nil
-		} else {
-			listInput := &s3.ListObjectsV2Input{
-				Bucket:            aws.String(util.Bucket),
-				Prefix:            aws.String(targetPath),
-				MaxKeys:           &util.maxKeys,
-				ContinuationToken: resp.ContinuationToken,
-			}
-			resp, err = util.client.ListObjectsV2(listInput)
-			if checkErr(err) {
-				return
-			}
-		}
+func (util *S3Util) Head(key string) (*ObjectInfo, error) {
+	object, err := util.client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(util.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, util.translateError(err)
 	}
+	return &ObjectInfo{
+		Key:          key,
+		Size:         aws.Int64Value(object.ContentLength),
+		LastModified: aws.TimeValue(object.LastModified),
+		ContentType:  aws.StringValue(object.ContentType),
+		Metadata:     aws.StringValueMap(object.Metadata),
+	}, nil
 }
 
-func (util *S3Util) CleanFiles(path string) []string {
-	dirs := &map[string]bool{}
-	targetPath := fmt.Sprintf("%s/%s", util.Prefix, path)
+func (util *S3Util) List(prefix string, fn func(ObjectInfo) error) error {
 	listInput := &s3.ListObjectsV2Input{
 		Bucket:  aws.String(util.Bucket),
-		Prefix:  aws.String(targetPath),
+		Prefix:  aws.String(prefix),
 		MaxKeys: &util.maxKeys,
 	}
-	util.processCleanFiles(targetPath, dirs, listInput)
-
-	result := []string{}
-	for key := range *dirs {
-		result = append(result, key)
-	}
-	return result
-}
-
-func (util *S3Util) processCleanFiles(targetPath string, dirs *map[string]bool, listInput *s3.ListObjectsV2Input) {
-	resp, err := util.client.ListObjectsV2(listInput)
-	if checkErr(err) {
-		return
-	}
-	for listInput != nil {
-		for _, nextObject := range resp.Contents {
-			if nextObject == nil {
-				continue
-			}
-			objectKey := (*nextObject.Key)
-			err = util.DeleteFile(objectKey)
-			if checkErr(err) {
+	var fnErr error
+	err := util.client.ListObjectsV2Pages(listInput, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, next := range page.Contents {
+			if next == nil || next.Key == nil {
 				continue
 			}
-		}
-		if resp.ContinuationToken == nil {
-			// end the loop
-			listInput = nil
-		} else {
-			listInput := &s3.ListObjectsV2Input{
-				Bucket:            aws.String(util.Bucket),
-				Prefix:            aws.String(targetPath),
-				MaxKeys:           &util.maxKeys,
-				ContinuationToken: resp.ContinuationToken,
-			}
-			resp, err = util.client.ListObjectsV2(listInput)
-			if checkErr(err) {
-				return
+			fnErr = fn(ObjectInfo{
+				Key:          *next.Key,
+				Size:         aws.Int64Value(next.Size),
+				LastModified: aws.TimeValue(next.LastModified),
+			})
+			if fnErr != nil {
+				return false
 			}
 		}
-	}
-}
-
-func (util *S3Util) UploadFile(targetFile string, targetKey string) error {
-	checkSum := FileSha256(targetFile)
-	if checkSum == nil {
-		errMsg := fmt.Sprintf("Can't get checksum of %s", targetFile)
-		fmt.Println(errMsg)
-		return errors.New(errMsg)
-	}
-	mtype, err := mimetype.DetectFile(targetFile)
-	checkErr(err)
-	var contentType string
-	if mtype != nil {
-		contentType = mtype.String()
-	}
-	file, err := os.Open(targetFile)
-	if checkErr(err) {
-		return err
-	}
-	uploadInput := s3manager.UploadInput{
-		Bucket:         aws.String(util.Bucket),
-		Key:            aws.String(targetKey),
-		Body:           file,
-		ChecksumSHA256: checkSum,
-	}
-	if mtype != nil {
-		uploadInput.ContentType = aws.String(contentType)
-	}
-	uploadInput.Metadata = map[string]*string{}
-	uploadInput.Metadata[SHA256] = checkSum
-	fmt.Println("Uploading path of archive:" + targetFile)
-	result, err := util.uploader.Upload(&uploadInput)
-
-	if checkErr(err) {
+		return true
+	})
+	if err != nil {
 		return err
 	}
-
-	fmt.Println("Upload successfully! Path of archive:" + result.Location)
-	return nil
+	return fnErr
 }
 
-func (util *S3Util) DeleteFile(targetKey string) error {
+func (util *S3Util) Delete(key string) error {
 	_, err := util.client.DeleteObject(&s3.DeleteObjectInput{
 		Bucket: aws.String(util.Bucket),
-		Key:    aws.String(targetKey),
+		Key:    aws.String(key),
 	})
-	if checkErr(err) {
+	return err
+}
+
+/**
+ * Server side copy keeping the content type and metadata, objects over 5GB are copied in parts
+ */
+func (util *S3Util) Copy(sourceKey string, targetKey string) error {
+	info, err := util.Head(sourceKey)
+	if err != nil {
 		return err
 	}
-
-	return nil
+	if info.Size > maxCopyObjectSize {
+		return util.multipartCopy(sourceKey, targetKey, info)
+	}
+	_, err = util.client.CopyObject(&s3.CopyObjectInput{
+		Bucket:     aws.String(util.Bucket),
+		Key:        aws.String(targetKey),
+		CopySource: aws.String(util.copySource(sourceKey)),
+	})
+	return util.translateError(err)
 }
 
-func (util *S3Util) DownloadFile(targetKey string, targetFile string) error {
-	exists := CheckFileExists(targetFile)
-	if exists {
-		err := os.Remove(targetFile)
-		if err != nil {
-			checkErr(err)
-			return err
-		}
+func (util *S3Util) multipartCopy(sourceKey string, targetKey string, info *ObjectInfo) error {
+	createInput := &s3.CreateMultipartUploadInput{
+		Bucket:   aws.String(util.Bucket),
+		Key:      aws.String(targetKey),
+		Metadata: aws.StringMap(info.Metadata),
 	}
-	file, err := os.Create(targetFile)
+	if info.ContentType != "" {
+		createInput.ContentType = aws.String(info.ContentType)
+	}
+	upload, err := util.client.CreateMultipartUpload(createInput)
 	if err != nil {
-		checkErr(err)
-		return err
+		return util.translateError(err)
 	}
-
-	defer file.Close()
-
-	fmt.Println("Downloading: ", file.Name())
-	numBytes, err := util.downloader.Download(file,
-		&s3.GetObjectInput{
-			Bucket: aws.String(util.Bucket),
-			Key:    aws.String(targetKey),
+	parts := []*s3.CompletedPart{}
+	partNumber := int64(1)
+	for start := int64(0); start < info.Size; start += copyPartSize {
+		end := start + copyPartSize - 1
+		if end >= info.Size {
+			end = info.Size - 1
+		}
+		part, err := util.client.UploadPartCopy(&s3.UploadPartCopyInput{
+			Bucket:          aws.String(util.Bucket),
+			Key:             aws.String(targetKey),
+			UploadId:        upload.UploadId,
+			PartNumber:      aws.Int64(partNumber),
+			CopySource:      aws.String(util.copySource(sourceKey)),
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", start, end)),
 		})
+		if err != nil {
+			util.abortMultipartUpload(targetKey, upload.UploadId)
+			return util.translateError(err)
+		}
+		parts = append(parts, &s3.CompletedPart{
+			ETag:       part.CopyPartResult.ETag,
+			PartNumber: aws.Int64(partNumber),
+		})
+		partNumber++
+	}
+	_, err = util.client.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(util.Bucket),
+		Key:             aws.String(targetKey),
+		UploadId:        upload.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
 	if err != nil {
-		err := fmt.Errorf("unable to download item %q, %v", targetFile, err)
-		checkErr(err)
-		return err
+		util.abortMultipartUpload(targetKey, upload.UploadId)
 	}
+	return util.translateError(err)
+}
 
-	fmt.Println("Downloaded: ", file.Name(), numBytes, "bytes")
+/**
+ * Drop the parts already copied, so a failed copy doesn't keep billing storage
+ */
+func (util *S3Util) abortMultipartUpload(key string, uploadId *string) {
+	_, err := util.client.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(util.Bucket),
+		Key:      aws.String(key),
+		UploadId: uploadId,
+	})
+	checkErr(err)
+}
 
-	return nil
+func (util *S3Util) copySource(key string) string {
+	return (&url.URL{Path: fmt.Sprintf("%s/%s", util.Bucket, key)}).EscapedPath()
 }
 
-func (util *S3Util) ExtractTargetSuffix(targetKey string) (*string, error) {
-	index := strings.Index(targetKey, "/")
-	if index < 0 {
-		return nil, fmt.Errorf("invalid target key %s", targetKey)
+func (util *S3Util) translateError(err error) error {
+	if err == nil {
+		return nil
 	}
-	suffix := targetKey[index+1:]
-	index = strings.Index(suffix, "/")
-	if index < 0 {
-		return nil, fmt.Errorf("invalid target key %s", targetKey)
+	if awsErr, ok := err.(awserr.RequestFailure); ok && awsErr.StatusCode() == 404 {
+		return ErrObjectNotFound
 	}
-	suffix = suffix[index+1:]
-	index = strings.Index(suffix, "/")
-	if index < 0 {
-		return nil, fmt.Errorf("invalid target key %s", targetKey)
+	if awsErr, ok := err.(awserr.Error); ok && (awsErr.Code() == s3.ErrCodeNoSuchKey || awsErr.Code() == "NotFound") {
+		return ErrObjectNotFound
 	}
-	suffix = suffix[index+1:]
-	return &suffix, nil
+	return err
 }
@@ -1,20 +1,23 @@
 package directory
 
 import (
+	"context"
+	"errors"
 	"sync"
 )
 
 type S3Worker interface {
 	RemoteKey() string
 	LocalPath() string
-	DoWork()
+	DoWork(ctx context.Context) error
 }
 
 // Download worker
 type S3DownloadWorker struct {
 	remoteKey string
 	localPath string
-	util      S3Util
+	storage   Storage
+	retry     RetryPolicy
 }
 
 func (downloadWorker *S3DownloadWorker) RemoteKey() string {
@@ -23,23 +26,33 @@ func (downloadWorker *S3DownloadWorker) RemoteKey() string {
 func (downloadWorker *S3DownloadWorker) LocalPath() string {
 	return downloadWorker.localPath
 }
-func (downloadWorker *S3DownloadWorker) DoWork() {
-	downloadWorker.util.DownloadFile(downloadWorker.remoteKey, downloadWorker.localPath)
+func (downloadWorker *S3DownloadWorker) DoWork(ctx context.Context) error {
+	attempts, err := downloadWorker.retry.Do(ctx, downloadWorker.remoteKey, func() error {
+		return DownloadFile(ctx, downloadWorker.storage, downloadWorker.remoteKey, downloadWorker.localPath)
+	})
+	return withAttempts(err, attempts)
 }
 
-func NewDownloadWorker(remoteKey string, localPath string, util S3Util) *S3DownloadWorker {
+func NewDownloadWorker(remoteKey string, localPath string, storage Storage, retry RetryPolicy) *S3DownloadWorker {
 	return &S3DownloadWorker{
 		remoteKey: remoteKey,
 		localPath: localPath,
-		util:      util,
+		storage:   storage,
+		retry:     retry,
 	}
 }
 
-// Upload worker
+// Upload worker, records the checksum of the file on the manifest once uploaded
 type S3UploadWorker struct {
+	relPath   string
 	remoteKey string
 	localPath string
-	util      S3Util
+	storage   Storage
+	manifest  *ManifestBuilder
+	retry     RetryPolicy
+	checkSums *ChecksumCache
+	// codec of the upload, empty to upload the file as it is
+	compression string
 }
 
 func (uploadWorker *S3UploadWorker) RemoteKey() string {
@@ -48,114 +61,215 @@ func (uploadWorker *S3UploadWorker) RemoteKey() string {
 func (uploadWorker *S3UploadWorker) LocalPath() string {
 	return uploadWorker.localPath
 }
-func (uploadWorker *S3UploadWorker) DoWork() {
-	uploadWorker.util.UploadFile(uploadWorker.remoteKey, uploadWorker.localPath)
+func (uploadWorker *S3UploadWorker) DoWork(ctx context.Context) error {
+	var info *ObjectInfo
+	attempts, err := uploadWorker.retry.Do(ctx, uploadWorker.remoteKey, func() error {
+		var uploadErr error
+		info, uploadErr = UploadFile(ctx, uploadWorker.storage, uploadWorker.localPath, uploadWorker.remoteKey, uploadWorker.checkSums, uploadWorker.compression)
+		return uploadErr
+	})
+	if err == nil {
+		uploadWorker.manifest.SetStored(uploadWorker.relPath, info.Metadata[SHA256], info.Size)
+	}
+	return withAttempts(err, attempts)
 }
 
-func NewUploadWorker(remoteKey string, localPath string, util S3Util) *S3UploadWorker {
+func NewUploadWorker(relPath string, remoteKey string, localPath string, storage Storage, manifest *ManifestBuilder, retry RetryPolicy, checkSums *ChecksumCache, compression string) *S3UploadWorker {
 	return &S3UploadWorker{
-		remoteKey: remoteKey,
-		localPath: localPath,
-		util:      util,
+		relPath:     relPath,
+		remoteKey:   remoteKey,
+		localPath:   localPath,
+		storage:     storage,
+		manifest:    manifest,
+		retry:       retry,
+		checkSums:   checkSums,
+		compression: compression,
 	}
 }
 
-type S3WorkerNode struct {
-	prev   *S3WorkerNode
-	next   *S3WorkerNode
-	Worker S3Worker
+// Copy worker, duplicates an object on the storage
+type S3CopyWorker struct {
+	sourceKey string
+	remoteKey string
+	storage   Storage
+	retry     RetryPolicy
 }
 
-type S3WorkerQueueIterator struct {
-	next *S3WorkerNode
+func (copyWorker *S3CopyWorker) RemoteKey() string {
+	return copyWorker.remoteKey
+}
+func (copyWorker *S3CopyWorker) LocalPath() string {
+	return ""
+}
+func (copyWorker *S3CopyWorker) DoWork(ctx context.Context) error {
+	attempts, err := copyWorker.retry.Do(ctx, copyWorker.remoteKey, func() error {
+		return CopyObject(copyWorker.storage, copyWorker.sourceKey, copyWorker.remoteKey)
+	})
+	return withAttempts(err, attempts)
 }
 
-func (iterator *S3WorkerQueueIterator) hasNext() bool {
-	return iterator.next != nil
+func NewCopyWorker(sourceKey string, remoteKey string, storage Storage, retry RetryPolicy) *S3CopyWorker {
+	return &S3CopyWorker{
+		sourceKey: sourceKey,
+		remoteKey: remoteKey,
+		storage:   storage,
+		retry:     retry,
+	}
 }
-func (iterator *S3WorkerQueueIterator) getNext() *S3WorkerNode {
-	oldNext := iterator.next
-	iterator.next = oldNext.next
-	return oldNext
+
+// Chunk worker, stores a file in a repository and records its chunks on the manifest
+type S3ChunkWorker struct {
+	relPath    string
+	localPath  string
+	repository *Repository
+	manifest   *ManifestBuilder
+	retry      RetryPolicy
 }
 
-type S3WorkerQueue struct {
-	head  *S3WorkerNode
-	index map[string]*S3WorkerNode
-	mutex sync.Mutex
+func (chunkWorker *S3ChunkWorker) RemoteKey() string {
+	return chunkWorker.relPath
+}
+func (chunkWorker *S3ChunkWorker) LocalPath() string {
+	return chunkWorker.localPath
+}
+func (chunkWorker *S3ChunkWorker) DoWork(ctx context.Context) error {
+	var checkSum string
+	var chunks []string
+	attempts, err := chunkWorker.retry.Do(ctx, chunkWorker.localPath, func() error {
+		var storeErr error
+		// chunks stored by a failed attempt are skipped on the next one
+		checkSum, chunks, storeErr = chunkWorker.repository.StoreFile(ctx, chunkWorker.localPath)
+		return storeErr
+	})
+	if err == nil {
+		chunkWorker.manifest.SetChunks(chunkWorker.relPath, checkSum, chunks)
+	}
+	return withAttempts(err, attempts)
+}
+
+func NewChunkWorker(relPath string, localPath string, repository *Repository, manifest *ManifestBuilder, retry RetryPolicy) *S3ChunkWorker {
+	return &S3ChunkWorker{
+		relPath:    relPath,
+		localPath:  localPath,
+		repository: repository,
+		manifest:   manifest,
+		retry:      retry,
+	}
 }
 
-func (queue *S3WorkerQueue) Size() int {
-	return len(queue.index)
+// Chunk restore worker, rebuilds a file of a repository snapshot
+type S3ChunkRestoreWorker struct {
+	prefix    string
+	file      ManifestFile
+	localPath string
+	storage   Storage
+	retry     RetryPolicy
 }
-func (queue *S3WorkerQueue) IsEmpty() bool {
-	return queue.head == nil && queue.Size() == 0
+
+func (restoreWorker *S3ChunkRestoreWorker) RemoteKey() string {
+	return restoreWorker.file.Path
 }
-func (queue *S3WorkerQueue) Add(worker S3Worker) bool {
-	queue.mutex.Lock()
-	defer queue.mutex.Unlock()
-	_, exists := queue.index[worker.RemoteKey()]
-	if exists {
-		return false
+func (restoreWorker *S3ChunkRestoreWorker) LocalPath() string {
+	return restoreWorker.localPath
+}
+func (restoreWorker *S3ChunkRestoreWorker) DoWork(ctx context.Context) error {
+	attempts, err := restoreWorker.retry.Do(ctx, restoreWorker.file.Path, func() error {
+		return RestoreChunks(ctx, restoreWorker.storage, restoreWorker.prefix, restoreWorker.file, restoreWorker.localPath)
+	})
+	return withAttempts(err, attempts)
+}
+
+func NewChunkRestoreWorker(prefix string, file ManifestFile, localPath string, storage Storage, retry RetryPolicy) *S3ChunkRestoreWorker {
+	return &S3ChunkRestoreWorker{
+		prefix:    prefix,
+		file:      file,
+		localPath: localPath,
+		storage:   storage,
+		retry:     retry,
 	}
-	node := &S3WorkerNode{
-		Worker: worker,
+}
+
+func withAttempts(err error, attempts int) error {
+	var fileErr *FileError
+	if errors.As(err, &fileErr) {
+		fileErr.Attempts = attempts
+	}
+	return err
+}
+
+/**
+ * Runs workers on a fixed number of goroutines as they are submitted.
+ * Submit blocks while every goroutine is busy and the buffer is full,
+ * so walking a huge tree never holds more than a few pending transfers in memory
+ */
+type WorkerPool struct {
+	ctx       context.Context
+	workers   chan S3Worker
+	wg        sync.WaitGroup
+	mutex     sync.Mutex
+	succeeded int
+	failed    []*FileError
+}
+
+func NewWorkerPool(ctx context.Context, concurrency int) *WorkerPool {
+	if concurrency < 1 {
+		concurrency = 1
 	}
-	if queue.head == nil {
-		queue.head = node
-	} else {
-		oldHead := queue.head
-		oldHead.prev = node
-
-		node.next = oldHead
-		queue.head = node
+	pool := &WorkerPool{
+		ctx:     ctx,
+		workers: make(chan S3Worker, concurrency),
+		failed:  []*FileError{},
 	}
-	queue.index[worker.RemoteKey()] = node
-	return true
-}
-func (queue *S3WorkerQueue) Remove(worker S3Worker) bool {
-	queue.mutex.Lock()
-	defer queue.mutex.Unlock()
-	node, exists := queue.index[worker.RemoteKey()]
-	if !exists {
-		return false
+	pool.wg.Add(concurrency)
+	for index := 0; index < concurrency; index++ {
+		go pool.consume()
 	}
-	if queue.head == node {
-		queue.head = node.next
-	} else {
-		if node.prev != nil {
-			node.prev.next = node.next
-			if node.next != nil {
-				node.next.prev = node.prev
+	return pool
+}
+
+func (pool *WorkerPool) consume() {
+	defer pool.wg.Done()
+	for worker := range pool.workers {
+		err := pool.ctx.Err()
+		if err == nil {
+			err = worker.DoWork(pool.ctx)
+		}
+		pool.mutex.Lock()
+		if err != nil {
+			var fileErr *FileError
+			if !errors.As(err, &fileErr) {
+				fileErr = &FileError{Op: "transfer", Key: worker.RemoteKey(), Err: err}
 			}
+			pool.failed = append(pool.failed, fileErr)
+		} else {
+			pool.succeeded++
 		}
+		pool.mutex.Unlock()
 	}
-	delete(queue.index, worker.RemoteKey())
-	return true
 }
 
-func (queue *S3WorkerQueue) DoWork() {
-	wg := &sync.WaitGroup{}
-	iterator := S3WorkerQueueIterator{
-		next: queue.head,
+/**
+ * Queue a worker, waits for a free slot. Fails once the context is canceled
+ */
+func (pool *WorkerPool) Submit(worker S3Worker) error {
+	// select picks at random when a slot is free too
+	if err := pool.ctx.Err(); err != nil {
+		return err
 	}
-	for iterator.hasNext() {
-		wg.Add(1)
-		go func(worker *S3WorkerNode, q *S3WorkerQueue, g *sync.WaitGroup) {
-			defer g.Done()
-			if worker != nil {
-				worker.Worker.DoWork()
-				q.Remove(worker.Worker)
-			}
-		}(iterator.getNext(), queue, wg)
+	select {
+	case pool.workers <- worker:
+		return nil
+	case <-pool.ctx.Done():
+		return pool.ctx.Err()
 	}
-	wg.Wait()
 }
 
-func NewWorkerQueue() *S3WorkerQueue {
-	return &S3WorkerQueue{
-		head:  nil,
-		index: map[string]*S3WorkerNode{},
-		mutex: sync.Mutex{},
-	}
+/**
+ * Wait for every submitted worker, returns how many succeeded and the error of every failed one.
+ * Nothing can be submitted afterwards
+ */
+func (pool *WorkerPool) Wait() (int, []*FileError) {
+	close(pool.workers)
+	pool.wg.Wait()
+	return pool.succeeded, pool.failed
 }
@@ -0,0 +1,151 @@
+package directory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+/**
+ * Worker recording how many of its kind run at once
+ */
+type testWorker struct {
+	key     string
+	err     error
+	running *int
+	most    *int
+	mutex   *sync.Mutex
+	release chan struct{}
+}
+
+func (worker *testWorker) RemoteKey() string {
+	return worker.key
+}
+
+func (worker *testWorker) LocalPath() string {
+	return ""
+}
+
+func (worker *testWorker) DoWork(ctx context.Context) error {
+	if worker.mutex != nil {
+		worker.mutex.Lock()
+		*worker.running++
+		if *worker.running > *worker.most {
+			*worker.most = *worker.running
+		}
+		worker.mutex.Unlock()
+		defer func() {
+			worker.mutex.Lock()
+			*worker.running--
+			worker.mutex.Unlock()
+		}()
+	}
+	if worker.release != nil {
+		select {
+		case <-worker.release:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return worker.err
+}
+
+func TestWorkerPoolConcurrency(t *testing.T) {
+	running, most := 0, 0
+	mutex := &sync.Mutex{}
+	release := make(chan struct{})
+	pool := NewWorkerPool(context.Background(), 3)
+	submitted := make(chan error)
+	go func() {
+		for index := 0; index < 10; index++ {
+			if err := pool.Submit(&testWorker{key: fmt.Sprint(index), running: &running, most: &most, mutex: mutex, release: release}); err != nil {
+				submitted <- err
+				return
+			}
+		}
+		submitted <- nil
+	}()
+	// the workers block until released, so the pool fills up
+	time.Sleep(50 * time.Millisecond)
+	mutex.Lock()
+	busy := running
+	mutex.Unlock()
+	if busy != 3 {
+		t.Errorf("%d workers running at once, expected 3", busy)
+	}
+	close(release)
+	if err := <-submitted; err != nil {
+		t.Fatal(err)
+	}
+	succeeded, failed := pool.Wait()
+	if succeeded != 10 || len(failed) != 0 || most > 3 {
+		t.Errorf("%d succeeded, %d failed, at most %d at once", succeeded, len(failed), most)
+	}
+}
+
+func TestWorkerPoolSubmitAfterCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	pool := NewWorkerPool(ctx, 1)
+	release := make(chan struct{})
+	defer close(release)
+	// one running, one buffered, the next Submit would block
+	for index := 0; index < 2; index++ {
+		if err := pool.Submit(&testWorker{key: fmt.Sprint(index), release: release}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cancel()
+	done := make(chan error)
+	go func() {
+		done <- pool.Submit(&testWorker{key: "blocked"})
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("submitted after cancel: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Submit blocked after cancel")
+	}
+	// a free slot doesn't make it succeed either
+	for index := 0; index < 100; index++ {
+		if err := pool.Submit(&testWorker{key: "late"}); err == nil {
+			t.Fatal("submitted after cancel")
+		}
+	}
+	succeeded, failed := pool.Wait()
+	if succeeded != 0 || len(failed) != 2 {
+		t.Errorf("%d succeeded, %d failed, expected the canceled workers to fail", succeeded, len(failed))
+	}
+}
+
+func TestWorkerPoolWait(t *testing.T) {
+	pool := NewWorkerPool(context.Background(), 2)
+	fileErr := &FileError{Op: "upload", Key: "file", Err: errors.New("denied")}
+	workers := []*testWorker{
+		{key: "ok"},
+		{key: "file", err: fileErr},
+		{key: "other", err: errors.New("failed")},
+		{key: "ok2"},
+		{key: "wrapped", err: fmt.Errorf("retried: %w", &FileError{Op: "copy", Key: "wrapped", Err: errors.New("gone")})},
+	}
+	for _, worker := range workers {
+		if err := pool.Submit(worker); err != nil {
+			t.Fatal(err)
+		}
+	}
+	succeeded, failed := pool.Wait()
+	if succeeded != 2 || len(failed) != 3 {
+		t.Fatalf("%d succeeded, %d failed", succeeded, len(failed))
+	}
+	ops := map[string]string{}
+	for _, failure := range failed {
+		ops[failure.Key] = failure.Op
+	}
+	if ops["file"] != "upload" || ops["other"] != "transfer" || ops["wrapped"] != "copy" {
+		t.Errorf("failures %v", ops)
+	}
+}
@@ -0,0 +1,395 @@
+package directory
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Destinations starting with sftp:// are stored on a remote host through SFTP
+const sftpScheme = "sftp://"
+
+/**
+ * Authentication and host verification for sftp destinations
+ * Either Password or KeyFile is required, and either HostKey or KnownHostsFile
+ */
+type SFTPOptions struct {
+	Password      string
+	KeyFile       string
+	KeyPassphrase string
+	// authorized_keys formatted public key or a SHA256:... fingerprint of the server host key
+	HostKey        string
+	KnownHostsFile string
+}
+
+/**
+ * Storage on a remote directory reached through SFTP.
+ * Uses the same layout as FileSystemStorage, including the metadata side files
+ */
+type SFTPStorage struct {
+	Root      string
+	address   string
+	sshClient *ssh.Client
+	client    *sftp.Client
+}
+
+/**
+ * Connect to the destination sftp://user@host[:port]/path/to/dir
+ */
+func NewSFTPStorage(destination string, options SFTPOptions) (*SFTPStorage, error) {
+	target, err := url.Parse(destination)
+	if err != nil {
+		return nil, err
+	}
+	if target.User == nil || target.User.Username() == "" {
+		return nil, fmt.Errorf("sftp destination %s requires a user", destination)
+	}
+	address := target.Host
+	if target.Port() == "" {
+		address = net.JoinHostPort(target.Hostname(), "22")
+	}
+	auth, err := sftpAuthMethods(target, options)
+	if err != nil {
+		return nil, err
+	}
+	hostKeyCallback, err := sftpHostKeyCallback(options)
+	if err != nil {
+		return nil, fmt.Errorf("sftp destination %s: %v", address, err)
+	}
+	sshClient, err := ssh.Dial("tcp", address, &ssh.ClientConfig{
+		User:            target.User.Username(),
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         30 * time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+	client, err := sftp.NewClient(sshClient)
+	if err != nil {
+		sshClient.Close()
+		return nil, err
+	}
+	storage := NewSFTPStorageFromClient(client, target.Path)
+	storage.address = address
+	storage.sshClient = sshClient
+	return storage, nil
+}
+
+/**
+ * Wrap an already connected sftp client, used to run against an in-process sftp server
+ */
+func NewSFTPStorageFromClient(client *sftp.Client, root string) *SFTPStorage {
+	if root == "" {
+		root = "."
+	}
+	return &SFTPStorage{
+		Root:    path.Clean(root),
+		address: "local",
+		client:  client,
+	}
+}
+
+func (storage *SFTPStorage) String() string {
+	return fmt.Sprintf("%s%s%s", sftpScheme, storage.address, storage.Root)
+}
+
+func (storage *SFTPStorage) Close() error {
+	err := storage.client.Close()
+	if storage.sshClient != nil {
+		storage.sshClient.Close()
+	}
+	return err
+}
+
+func (storage *SFTPStorage) Put(key string, body io.Reader, info ObjectInfo) error {
+	targetPath := storage.filePath(key)
+	err := storage.client.MkdirAll(path.Dir(targetPath))
+	if err != nil {
+		return err
+	}
+	// write next to the target and rename so readers never see a partial file
+	tmpPath := path.Join(path.Dir(targetPath), fmt.Sprintf(".tmp-%d", time.Now().UnixNano()))
+	file, err := storage.client.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer storage.client.Remove(tmpPath)
+	_, err = io.Copy(file, body)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+	err = storage.writeMetadata(key, fsMetadata{ContentType: info.ContentType, Metadata: info.Metadata})
+	if err != nil {
+		return err
+	}
+	return storage.rename(tmpPath, targetPath)
+}
+
+func (storage *SFTPStorage) Get(key string) (io.ReadCloser, *ObjectInfo, error) {
+	info, err := storage.Head(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	file, err := storage.client.Open(storage.filePath(key))
+	if err != nil {
+		return nil, nil, storage.translateError(err)
+	}
+	return file, info, nil
+}
+
+func (storage *SFTPStorage) Head(key string) (*ObjectInfo, error) {
+	stat, err := storage.client.Stat(storage.filePath(key))
+	if err != nil {
+		return nil, storage.translateError(err)
+	}
+	if stat.IsDir() {
+		return nil, ErrObjectNotFound
+	}
+	metadata := storage.readMetadata(key)
+	return &ObjectInfo{
+		Key:          key,
+		Size:         stat.Size(),
+		LastModified: stat.ModTime(),
+		ContentType:  metadata.ContentType,
+		Metadata:     metadata.Metadata,
+	}, nil
+}
+
+func (storage *SFTPStorage) List(prefix string, fn func(ObjectInfo) error) error {
+	// only walk the deepest directory fully contained in the prefix
+	startDir := path.Dir(prefix)
+	if strings.HasSuffix(prefix, "/") {
+		startDir = strings.TrimSuffix(prefix, "/")
+	}
+	walker := storage.client.Walk(storage.filePath(startDir))
+	for walker.Step() {
+		err := walker.Err()
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		info := walker.Stat()
+		if info.IsDir() {
+			if info.Name() == fsMetadataDir {
+				walker.SkipDir()
+			}
+			continue
+		}
+		if strings.HasPrefix(info.Name(), ".tmp-") {
+			continue
+		}
+		key, below := storage.relativePath(walker.Path())
+		if !below || !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		err = fn(ObjectInfo{
+			Key:          key,
+			Size:         info.Size(),
+			LastModified: info.ModTime(),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (storage *SFTPStorage) Delete(key string) error {
+	targetPath := storage.filePath(key)
+	err := storage.client.Remove(targetPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	metadataPath := storage.metadataPath(key)
+	err = storage.client.Remove(metadataPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	storage.removeEmptyParents(path.Dir(targetPath))
+	storage.removeEmptyParents(path.Dir(metadataPath))
+	return nil
+}
+
+/**
+ * SFTP has no server side copy, the object is streamed back through this host
+ */
+func (storage *SFTPStorage) Copy(sourceKey string, targetKey string) error {
+	body, info, err := storage.Get(sourceKey)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	return storage.Put(targetKey, body, *info)
+}
+
+func (storage *SFTPStorage) filePath(key string) string {
+	return path.Join(storage.Root, path.Clean("/" + key)[1:])
+}
+
+func (storage *SFTPStorage) metadataPath(key string) string {
+	return path.Join(storage.Root, fsMetadataDir, path.Clean("/" + key)[1:]+".json")
+}
+
+func (storage *SFTPStorage) rename(source string, target string) error {
+	err := storage.client.PosixRename(source, target)
+	if err == nil {
+		return nil
+	}
+	// server without the posix-rename extension, plain rename fails when the target exists
+	removeErr := storage.client.Remove(target)
+	if removeErr != nil && !os.IsNotExist(removeErr) {
+		return removeErr
+	}
+	return storage.client.Rename(source, target)
+}
+
+func (storage *SFTPStorage) writeMetadata(key string, metadata fsMetadata) error {
+	metadataPath := storage.metadataPath(key)
+	err := storage.client.MkdirAll(path.Dir(metadataPath))
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	file, err := storage.client.Create(metadataPath)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func (storage *SFTPStorage) readMetadata(key string) fsMetadata {
+	metadata := fsMetadata{}
+	file, err := storage.client.Open(storage.metadataPath(key))
+	if err != nil {
+		return metadata
+	}
+	defer file.Close()
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return metadata
+	}
+	checkErr(json.Unmarshal(data, &metadata))
+	return metadata
+}
+
+/**
+ * Slash separated path of a remote path relative to the root, false when it isn't below the root
+ */
+func (storage *SFTPStorage) relativePath(remotePath string) (string, bool) {
+	remotePath = path.Clean(remotePath)
+	if storage.Root == "." {
+		// relative to the login directory
+		below := remotePath != "." && remotePath != ".." && !strings.HasPrefix(remotePath, "/") && !strings.HasPrefix(remotePath, "../")
+		return remotePath, below
+	}
+	// the root may be / itself, e.g. a chrooted account
+	base := strings.TrimSuffix(storage.Root, "/") + "/"
+	if !strings.HasPrefix(remotePath, base) {
+		return "", false
+	}
+	return remotePath[len(base):], true
+}
+
+/**
+ * Remove empty directories left behind by deletions, stopping at the storage root
+ */
+func (storage *SFTPStorage) removeEmptyParents(dir string) {
+	for {
+		if _, below := storage.relativePath(dir); !below {
+			return
+		}
+		if storage.client.RemoveDirectory(dir) != nil {
+			// not empty
+			return
+		}
+		dir = path.Dir(dir)
+	}
+}
+
+func (storage *SFTPStorage) translateError(err error) error {
+	if os.IsNotExist(err) {
+		return ErrObjectNotFound
+	}
+	return err
+}
+
+func sftpAuthMethods(target *url.URL, options SFTPOptions) ([]ssh.AuthMethod, error) {
+	auth := []ssh.AuthMethod{}
+	if options.KeyFile != "" {
+		key, err := ioutil.ReadFile(options.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		var signer ssh.Signer
+		if options.KeyPassphrase != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(options.KeyPassphrase))
+		} else {
+			signer, err = ssh.ParsePrivateKey(key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to read sftp key file %s: %v", options.KeyFile, err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	password := options.Password
+	if urlPassword, exists := target.User.Password(); exists && password == "" {
+		password = urlPassword
+	}
+	if password != "" {
+		auth = append(auth, ssh.Password(password))
+	}
+	if len(auth) == 0 {
+		return nil, fmt.Errorf("sftp destination %s requires a password or a key file", target.Host)
+	}
+	return auth, nil
+}
+
+func sftpHostKeyCallback(options SFTPOptions) (ssh.HostKeyCallback, error) {
+	if options.HostKey != "" {
+		if strings.HasPrefix(options.HostKey, "SHA256:") {
+			return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+				fingerprint := ssh.FingerprintSHA256(key)
+				if fingerprint != options.HostKey {
+					return fmt.Errorf("host key mismatch for %s, got %s", hostname, fingerprint)
+				}
+				return nil
+			}, nil
+		}
+		pinned, _, _, _, err := ssh.ParseAuthorizedKey([]byte(options.HostKey))
+		if err != nil {
+			return nil, fmt.Errorf("invalid host key: %v", err)
+		}
+		return ssh.FixedHostKey(pinned), nil
+	}
+	if options.KnownHostsFile != "" {
+		return knownhosts.New(options.KnownHostsFile)
+	}
+	return nil, fmt.Errorf("a pinned host key or a known hosts file is required")
+}
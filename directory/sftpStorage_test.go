@@ -0,0 +1,186 @@
+package directory
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/pkg/sftp"
+)
+
+type pipeConn struct {
+	io.Reader
+	io.WriteCloser
+}
+
+/**
+ * Storage connected through pipes to an in-process server run by serve
+ */
+func newPipeStorage(t *testing.T, root string, serve func(conn io.ReadWriteCloser)) *SFTPStorage {
+	t.Helper()
+	clientReader, serverWriter := io.Pipe()
+	serverReader, clientWriter := io.Pipe()
+	go serve(pipeConn{Reader: serverReader, WriteCloser: serverWriter})
+	client, err := sftp.NewClientPipe(clientReader, clientWriter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage := NewSFTPStorageFromClient(client, root)
+	t.Cleanup(func() {
+		storage.Close()
+	})
+	return storage
+}
+
+func newServerStorage(t *testing.T, root string, options ...sftp.ServerOption) *SFTPStorage {
+	return newPipeStorage(t, root, func(conn io.ReadWriteCloser) {
+		server, err := sftp.NewServer(conn, options...)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		server.Serve()
+		server.Close()
+	})
+}
+
+func TestSFTPStorage(t *testing.T) {
+	tests := []struct {
+		name string
+		open func(t *testing.T) *SFTPStorage
+	}{
+		{"absolute root", func(t *testing.T) *SFTPStorage {
+			return newServerStorage(t, t.TempDir())
+		}},
+		{"login directory", func(t *testing.T) *SFTPStorage {
+			return newServerStorage(t, "", sftp.WithServerWorkingDirectory(t.TempDir()))
+		}},
+		{"chroot root", func(t *testing.T) *SFTPStorage {
+			// an in-memory file system, / is the root of the account
+			return newPipeStorage(t, "/", func(conn io.ReadWriteCloser) {
+				server := sftp.NewRequestServer(conn, sftp.InMemHandler())
+				server.Serve()
+				server.Close()
+			})
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			testStorage(t, test.open(t))
+		})
+	}
+}
+
+func testStorage(t *testing.T, storage Storage) {
+	put := func(key string, content string, metadata map[string]string) {
+		t.Helper()
+		err := storage.Put(key, strings.NewReader(content), ObjectInfo{Key: key, Size: int64(len(content)), ContentType: "text/plain", Metadata: metadata})
+		if err != nil {
+			t.Fatalf("put %s: %v", key, err)
+		}
+	}
+	list := func(prefix string) string {
+		t.Helper()
+		keys := []string{}
+		err := storage.List(prefix, func(object ObjectInfo) error {
+			keys = append(keys, object.Key)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("list %s: %v", prefix, err)
+		}
+		sort.Strings(keys)
+		return strings.Join(keys, ",")
+	}
+
+	put("prefix/daily/2026-10-17/a.txt", "first", map[string]string{SHA256: "abc"})
+	put("prefix/daily/2026-10-17/sub/b.txt", "second file", nil)
+	put("prefix/daily/2026-10-18/a.txt", "third", nil)
+	put("other/c.txt", "fourth", nil)
+	// overwriting replaces the content
+	put("prefix/daily/2026-10-17/a.txt", "first again", map[string]string{SHA256: "def"})
+
+	body, info, err := storage.Get("prefix/daily/2026-10-17/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := io.ReadAll(body)
+	body.Close()
+	if err != nil || string(content) != "first again" {
+		t.Fatalf("got %q, %v", content, err)
+	}
+	if info.Size != 11 || info.ContentType != "text/plain" || info.Metadata[SHA256] != "def" {
+		t.Errorf("unexpected info %+v", info)
+	}
+
+	info, err = storage.Head("prefix/daily/2026-10-17/sub/b.txt")
+	if err != nil || info.Size != int64(len("second file")) {
+		t.Errorf("head: %+v, %v", info, err)
+	}
+	if _, err := storage.Head("prefix/daily/missing"); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("head of a missing key: %v", err)
+	}
+	if _, _, err := storage.Get("prefix/daily/missing"); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("get of a missing key: %v", err)
+	}
+	if _, err := storage.Head("prefix/daily/2026-10-17"); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("head of a directory: %v", err)
+	}
+
+	if got := list("prefix/daily/2026-10-17/"); got != "prefix/daily/2026-10-17/a.txt,prefix/daily/2026-10-17/sub/b.txt" {
+		t.Errorf("list of a directory: %s", got)
+	}
+	if got := list("prefix/daily/2026-10-1"); got != "prefix/daily/2026-10-17/a.txt,prefix/daily/2026-10-17/sub/b.txt,prefix/daily/2026-10-18/a.txt" {
+		t.Errorf("list of a partial name: %s", got)
+	}
+	if got := list(""); got != "other/c.txt,prefix/daily/2026-10-17/a.txt,prefix/daily/2026-10-17/sub/b.txt,prefix/daily/2026-10-18/a.txt" {
+		t.Errorf("list of everything: %s", got)
+	}
+	if got := list("missing/"); got != "" {
+		t.Errorf("list of a missing prefix: %s", got)
+	}
+
+	if err := storage.Copy("prefix/daily/2026-10-17/a.txt", "prefix/weekly/2026-10-17/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	info, err = storage.Head("prefix/weekly/2026-10-17/a.txt")
+	if err != nil || info.Size != 11 || info.Metadata[SHA256] != "def" {
+		t.Errorf("copy lost its content or metadata: %+v, %v", info, err)
+	}
+
+	for _, key := range []string{"prefix/daily/2026-10-17/a.txt", "prefix/daily/2026-10-17/sub/b.txt"} {
+		if err := storage.Delete(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := storage.Delete("prefix/daily/missing"); err != nil {
+		t.Errorf("delete of a missing key: %v", err)
+	}
+	if got := list("prefix/daily/"); got != "prefix/daily/2026-10-18/a.txt" {
+		t.Errorf("list after delete: %s", got)
+	}
+	if _, err := storage.Head("prefix/daily/2026-10-17/a.txt"); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("head after delete: %v", err)
+	}
+}
+
+func TestSFTPStorageRemovesEmptyDirectories(t *testing.T) {
+	root := t.TempDir()
+	storage := newServerStorage(t, root)
+	if err := storage.Put("prefix/daily/2026-10-17/sub/a.txt", strings.NewReader("a"), ObjectInfo{Size: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Delete("prefix/daily/2026-10-17/sub/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "prefix")); !os.IsNotExist(err) {
+		t.Errorf("empty directories left behind: %v", err)
+	}
+	if _, err := os.Stat(root); err != nil {
+		t.Errorf("root removed: %v", err)
+	}
+}
@@ -0,0 +1,382 @@
+package directory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gabriel-vasile/mimetype"
+)
+
+// Destinations starting with file:// are stored on the local file system (e.g. a mounted NAS)
+const fileScheme = "file://"
+
+// ErrObjectNotFound is returned by Storage.Get and Storage.Head when the key does not exist
+var ErrObjectNotFound = errors.New("object not found")
+
+/**
+ * Object attributes as reported by a storage backend
+ */
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+	ContentType  string
+	Metadata     map[string]string
+}
+
+/**
+ * Storage is implemented by every backup destination.
+ * Keys are slash separated and relative to the destination root (the bucket on S3),
+ * e.g. <prefix>/<daily|weekly|monthly>/<date>/<relpath>
+ */
+type Storage interface {
+	// Put stores body under key, info carries the content type and metadata
+	Put(key string, body io.Reader, info ObjectInfo) error
+	// Get opens the object, the caller must close the returned reader
+	Get(key string) (io.ReadCloser, *ObjectInfo, error)
+	// Head returns the object attributes without reading its content
+	Head(key string) (*ObjectInfo, error)
+	// List calls fn for every object whose key starts with prefix
+	List(prefix string, fn func(ObjectInfo) error) error
+	Delete(key string) error
+	// Copy duplicates an object with its metadata, on the server when the storage can
+	Copy(sourceKey string, targetKey string) error
+	// String describes the destination for log messages
+	String() string
+	// Close releases the connections held by the storage
+	Close() error
+}
+
+/**
+ * Credentials for every kind of destination, only the ones matching the destination are used
+ */
+type StorageOptions struct {
+	Key      string
+	Secret   string
+	Region   string
+	Endpoint string
+	AWS      AWSOptions
+	SFTP     SFTPOptions
+	// bandwidth limits of the job, nil for none
+	Throttle *Throttle
+	// client side encryption keys, loaded when the storage is opened
+	Encryption EncryptionOptions
+}
+
+/**
+ * Open the storage for a destination:
+ * a bucket name, file:///path/to/dir or sftp://user@host[:port]/path/to/dir.
+ * ctx is the run using it, throttled transfers stop waiting once it's done
+ */
+func OpenStorage(ctx context.Context, destination string, options StorageOptions) (Storage, error) {
+	current, others, err := LoadSecrets(options.Encryption)
+	if err != nil {
+		return nil, err
+	}
+	storage, err := openStorage(destination, options)
+	if err != nil {
+		return nil, err
+	}
+	// throttle what goes over the wire, the encrypted content
+	return encryptStorage(throttleStorage(ctx, storage, options.Throttle), current, others), nil
+}
+
+func openStorage(destination string, options StorageOptions) (Storage, error) {
+	if strings.HasPrefix(destination, fileScheme) {
+		return NewFileSystemStorage(strings.TrimPrefix(destination, fileScheme))
+	}
+	if strings.HasPrefix(destination, sftpScheme) {
+		return NewSFTPStorage(destination, options.SFTP)
+	}
+	return NewS3Storage(destination, options)
+}
+
+/**
+ * Objects of a snapshot by key, listed once per run so unchanged files cost no request
+ */
+type SnapshotIndex map[string]ObjectInfo
+
+func ListSnapshot(storage Storage, prefix string) (SnapshotIndex, error) {
+	index := SnapshotIndex{}
+	err := storage.List(prefix, func(object ObjectInfo) error {
+		index[object.Key] = object
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+/**
+ * Whether the object stored under key matches the local file, returns the checksum of the file when it does.
+ * previous is the entry of the file in the manifest the run replaces, nil without one. While the listed object
+ * has the size it recorded, the file is unchanged if its size, mtime and inode are the ones recorded too,
+ * and compared with the recorded checksum otherwise, so a compressed object needs no request either.
+ * Without an entry, the checksum and size before compression are compared with the ones of the object with a HEAD
+ */
+func (index SnapshotIndex) UpToDate(storage Storage, key string, localPath string, stat os.FileInfo, checkSums *ChecksumCache, previous *ManifestFile) (string, bool) {
+	object, exists := index[key]
+	if !exists {
+		return "", false
+	}
+	if previous != nil && previous.SHA256 != "" {
+		storedSize := previous.StoredSize
+		if storedSize == 0 {
+			// recorded before stored sizes were, only an uncompressed object can match
+			storedSize = previous.Size
+		}
+		if object.Size == storedSize {
+			// both times come from the local clock
+			if previous.Size == stat.Size() && previous.ModTime.Equal(stat.ModTime().UTC()) && previous.Inode == fileInode(stat) {
+				return previous.SHA256, true
+			}
+			checkSum := checkSums.Sum(localPath)
+			if checkSum == nil || *checkSum != previous.SHA256 {
+				return "", false
+			}
+			return *checkSum, true
+		}
+	}
+	if object.Size > stat.Size() {
+		return "", false
+	}
+	info, err := storage.Head(key)
+	if err != nil || info == nil {
+		return "", false
+	}
+	if uncompressedSize, compressed := info.Metadata[UncompressedSizeMetadata]; compressed {
+		if uncompressedSize != strconv.FormatInt(stat.Size(), 10) {
+			return "", false
+		}
+	} else if info.Size != stat.Size() {
+		return "", false
+	}
+	remoteCheckSum, found := info.Metadata[SHA256]
+	if !found {
+		return "", false
+	}
+	checkSum := checkSums.Sum(localPath)
+	if checkSum == nil || *checkSum != remoteCheckSum {
+		return "", false
+	}
+	return *checkSum, true
+}
+
+/**
+ * Names of the directories right below path, path is a key prefix ending with "/" or empty for the root
+ */
+func GetTopDirectories(storage Storage, path string) ([]string, error) {
+	dirs := map[string]bool{}
+	err := storage.List(path, func(object ObjectInfo) error {
+		suffix := object.Key[len(path):]
+		index := strings.Index(suffix, "/")
+		if index < 0 {
+			// not a directory
+			return nil
+		}
+		dirs[suffix[0:index]] = true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := []string{}
+	for key := range dirs {
+		result = append(result, key)
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+/**
+ * Delete every object below path
+ */
+func CleanFiles(storage Storage, path string) error {
+	keys := []string{}
+	err := storage.List(path, func(object ObjectInfo) error {
+		keys = append(keys, object.Key)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return DeleteObjects(storage, keys)
+}
+
+/**
+ * Delete every key, returns a *TransferError listing the ones that failed
+ */
+func DeleteObjects(storage Storage, keys []string) error {
+	deletions := &TransferError{}
+	for _, key := range keys {
+		err := storage.Delete(key)
+		if checkErr(err) {
+			deletions.Add(0, []*FileError{{Op: "delete", Key: key, Err: err}})
+			continue
+		}
+		deletions.Add(1, nil)
+	}
+	return deletions.Err()
+}
+
+/**
+ * Upload a local file with its checksum and mimetype, returns what was stored. Failures are returned as *FileError.
+ * The checksum is taken from checkSums when the file didn't change since it was last hashed.
+ * With a codec, files not compressed already are uploaded compressed when it makes them smaller
+ */
+func UploadFile(ctx context.Context, storage Storage, targetFile string, targetKey string, checkSums *ChecksumCache, codec string) (*ObjectInfo, error) {
+	info, err := uploadFile(ctx, storage, targetFile, targetKey, checkSums, codec)
+	if err != nil {
+		return nil, &FileError{Op: "upload", Key: targetKey, Err: err}
+	}
+	return info, nil
+}
+
+func uploadFile(ctx context.Context, storage Storage, targetFile string, targetKey string, checkSums *ChecksumCache, codec string) (*ObjectInfo, error) {
+	checkSum := checkSums.Sum(targetFile)
+	if checkSum == nil {
+		errMsg := fmt.Sprintf("Can't get checksum of %s", targetFile)
+		fmt.Println(errMsg)
+		return nil, errors.New(errMsg)
+	}
+	mtype, err := mimetype.DetectFile(targetFile)
+	checkErr(err)
+	file, err := os.Open(targetFile)
+	if checkErr(err) {
+		return nil, err
+	}
+	defer file.Close()
+
+	info := ObjectInfo{
+		Key:      targetKey,
+		Metadata: map[string]string{},
+	}
+	if stat, err := file.Stat(); err == nil {
+		info.Size = stat.Size()
+	}
+	if mtype != nil {
+		info.ContentType = mtype.String()
+	}
+	info.Metadata[SHA256] = *checkSum
+	body := io.Reader(file)
+	if codec != "" && !alreadyCompressed(mtype) {
+		compressed, size, err := compressFile(ctx, file, codec)
+		if checkErr(err) {
+			return nil, err
+		}
+		defer removeTemp(compressed)
+		if size < info.Size {
+			info.Metadata[CompressionMetadata] = codec
+			info.Metadata[UncompressedSizeMetadata] = strconv.FormatInt(info.Size, 10)
+			info.Size = size
+			body = compressed
+		} else if _, err := file.Seek(0, io.SeekStart); checkErr(err) {
+			return nil, err
+		}
+	}
+	fmt.Println("Uploading path of archive:" + targetFile)
+	err = storage.Put(targetKey, newContextReader(ctx, body), info)
+	if checkErr(err) {
+		return nil, err
+	}
+
+	fmt.Printf("Upload successfully! Path of archive: %s/%s\n", storage.String(), targetKey)
+	return &info, nil
+}
+
+/**
+ * Copy an object on the storage, failures are returned as *FileError
+ */
+func CopyObject(storage Storage, sourceKey string, targetKey string) error {
+	if err := storage.Copy(sourceKey, targetKey); err != nil {
+		checkErr(err)
+		return &FileError{Op: "copy", Key: targetKey, Err: err}
+	}
+	fmt.Printf("Copied %s/%s to %s\n", storage.String(), sourceKey, targetKey)
+	return nil
+}
+
+/**
+ * Download an object to a local file, failures are returned as *FileError
+ */
+func DownloadFile(ctx context.Context, storage Storage, targetKey string, targetFile string) error {
+	if err := downloadFile(ctx, storage, targetKey, targetFile); err != nil {
+		return &FileError{Op: "download", Key: targetKey, Err: err}
+	}
+	return nil
+}
+
+func downloadFile(ctx context.Context, storage Storage, targetKey string, targetFile string) error {
+	exists := CheckFileExists(targetFile)
+	if exists {
+		err := os.Remove(targetFile)
+		if err != nil {
+			checkErr(err)
+			return err
+		}
+	}
+	body, info, err := storage.Get(targetKey)
+	if err != nil {
+		err := fmt.Errorf("unable to download item %q, %v", targetFile, err)
+		checkErr(err)
+		return err
+	}
+	defer body.Close()
+	content, err := decompressBody(body, info)
+	if err != nil {
+		err := fmt.Errorf("unable to download item %q, %v", targetFile, err)
+		checkErr(err)
+		return err
+	}
+	defer content.Close()
+
+	file, err := os.Create(targetFile)
+	if err != nil {
+		checkErr(err)
+		return err
+	}
+	defer file.Close()
+
+	fmt.Println("Downloading: ", file.Name())
+	numBytes, err := io.Copy(file, newContextReader(ctx, content))
+	if err != nil {
+		err := fmt.Errorf("unable to download item %q, %v", targetFile, err)
+		checkErr(err)
+		return err
+	}
+
+	fmt.Println("Downloaded: ", file.Name(), numBytes, "bytes")
+
+	return nil
+}
+
+/**
+ * Strip the <prefix>/<rotation>/<date>/ part of a key
+ */
+func ExtractTargetSuffix(targetKey string) (*string, error) {
+	index := strings.Index(targetKey, "/")
+	if index < 0 {
+		return nil, fmt.Errorf("invalid target key %s", targetKey)
+	}
+	suffix := targetKey[index+1:]
+	index = strings.Index(suffix, "/")
+	if index < 0 {
+		return nil, fmt.Errorf("invalid target key %s", targetKey)
+	}
+	suffix = suffix[index+1:]
+	index = strings.Index(suffix, "/")
+	if index < 0 {
+		return nil, fmt.Errorf("invalid target key %s", targetKey)
+	}
+	suffix = suffix[index+1:]
+	return &suffix, nil
+}
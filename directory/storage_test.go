@@ -0,0 +1,150 @@
+package directory
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"playus/server-backup/compression"
+)
+
+/**
+ * Storage counting its HEAD requests
+ */
+type headCountingStorage struct {
+	Storage
+	heads int
+}
+
+func (storage *headCountingStorage) Head(key string) (*ObjectInfo, error) {
+	storage.heads++
+	return storage.Storage.Head(key)
+}
+
+func TestUpToDate(t *testing.T) {
+	fsStorage, err := NewFileSystemStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage := &headCountingStorage{Storage: fsStorage}
+	localPath := filepath.Join(t.TempDir(), "file.txt")
+	if err := os.WriteFile(localPath, []byte(strings.Repeat("compressible ", 1000)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	key := "prefix/daily/2026-10-17/file.txt"
+	stored, err := UploadFile(context.Background(), storage, localPath, key, newMemoryChecksumCache(), compression.Gzip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat, err := os.Stat(localPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Size >= stat.Size() {
+		t.Fatalf("stored %d bytes of %d, expected it compressed", stored.Size, stat.Size())
+	}
+	index, err := ListSnapshot(storage, "prefix/daily/2026-10-17/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := ManifestFile{
+		Path:       "file.txt",
+		Size:       stat.Size(),
+		SHA256:     stored.Metadata[SHA256],
+		ModTime:    stat.ModTime().UTC(),
+		Inode:      fileInode(stat),
+		StoredSize: stored.Size,
+	}
+	check := func(t *testing.T, previous *ManifestFile) (bool, int) {
+		t.Helper()
+		stat, err := os.Stat(localPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		storage.heads = 0
+		checkSum, upToDate := index.UpToDate(storage, key, localPath, stat, newMemoryChecksumCache(), previous)
+		if upToDate && checkSum != stored.Metadata[SHA256] {
+			t.Errorf("up to date with the checksum %s", checkSum)
+		}
+		return upToDate, storage.heads
+	}
+
+	if upToDate, heads := check(t, &previous); !upToDate || heads != 0 {
+		t.Errorf("unchanged file: up to date %v with %d HEAD requests", upToDate, heads)
+	}
+	if upToDate, heads := check(t, nil); !upToDate || heads != 1 {
+		t.Errorf("without manifest: up to date %v with %d HEAD requests", upToDate, heads)
+	}
+	stale := previous
+	stale.StoredSize = 0
+	if upToDate, heads := check(t, &stale); !upToDate || heads != 1 {
+		t.Errorf("manifest without stored size: up to date %v with %d HEAD requests", upToDate, heads)
+	}
+
+	touched := time.Now().Add(time.Hour)
+	if err := os.Chtimes(localPath, touched, touched); err != nil {
+		t.Fatal(err)
+	}
+	if upToDate, heads := check(t, &previous); !upToDate || heads != 0 {
+		t.Errorf("touched file: up to date %v with %d HEAD requests", upToDate, heads)
+	}
+
+	if err := os.WriteFile(localPath, []byte(strings.Repeat("compressable ", 1000)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if upToDate, heads := check(t, &previous); upToDate || heads != 0 {
+		t.Errorf("changed file: up to date %v with %d HEAD requests", upToDate, heads)
+	}
+	if upToDate, _ := check(t, nil); upToDate {
+		t.Errorf("changed file without manifest: up to date")
+	}
+}
+
+func TestUpToDateStoredSizeChanged(t *testing.T) {
+	fsStorage, err := NewFileSystemStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage := &headCountingStorage{Storage: fsStorage}
+	localPath := filepath.Join(t.TempDir(), "file.txt")
+	if err := os.WriteFile(localPath, []byte(strings.Repeat("compressible ", 1000)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	key := "prefix/daily/2026-10-17/file.txt"
+	stored, err := UploadFile(context.Background(), storage, localPath, key, newMemoryChecksumCache(), compression.Zstd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat, err := os.Stat(localPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := ManifestFile{
+		Path:       "file.txt",
+		Size:       stat.Size(),
+		SHA256:     stored.Metadata[SHA256],
+		ModTime:    stat.ModTime().UTC(),
+		Inode:      fileInode(stat),
+		StoredSize: stored.Size,
+	}
+
+	// the object was replaced since the manifest was written, the unchanged local file is stored again
+	other := strings.Repeat("other content ", 10)
+	err = fsStorage.Put(key, strings.NewReader(other), ObjectInfo{Key: key, Size: int64(len(other)), Metadata: map[string]string{SHA256: "other"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := ListSnapshot(storage, "prefix/daily/2026-10-17/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, upToDate := index.UpToDate(storage, key, localPath, stat, newMemoryChecksumCache(), &previous); upToDate {
+		t.Error("up to date with an object of another size than the manifest recorded")
+	}
+	if storage.heads != 1 {
+		t.Errorf("%d HEAD requests, expected the object to be checked once", storage.heads)
+	}
+}
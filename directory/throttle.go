@@ -0,0 +1,237 @@
+package directory
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"playus/server-backup/config"
+	"playus/server-backup/schedule"
+)
+
+// largest read between two waits, so a throttled transfer stays smooth
+const maxThrottleChunk = 64 * 1024
+
+/**
+ * Token bucket allowing rate bytes per second, with a burst of one second,
+ * only while the current local time is inside window
+ */
+type Limiter struct {
+	rate   float64
+	window schedule.Window
+	mutex  sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+/**
+ * Limiter for rate bytes per second, nil (no limit) when rate isn't positive
+ */
+func NewLimiter(rate int, window schedule.Window) *Limiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &Limiter{
+		rate:   float64(rate),
+		window: window,
+		tokens: float64(rate),
+	}
+}
+
+/**
+ * Take n bytes from the bucket, returns how long to wait before going on
+ */
+func (limiter *Limiter) reserve(n int, now time.Time) time.Duration {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	if !limiter.window.Contains(now) {
+		limiter.tokens = limiter.rate
+		limiter.last = now
+		return 0
+	}
+	if !limiter.last.IsZero() {
+		limiter.tokens += now.Sub(limiter.last).Seconds() * limiter.rate
+		if limiter.tokens > limiter.rate {
+			limiter.tokens = limiter.rate
+		}
+	}
+	limiter.last = now
+	limiter.tokens -= float64(n)
+	if limiter.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-limiter.tokens / limiter.rate * float64(time.Second))
+}
+
+func (limiter *Limiter) chunk() int {
+	if limiter == nil {
+		return maxThrottleChunk
+	}
+	// about a tenth of a second worth of data
+	chunk := int(limiter.rate / 10)
+	if chunk < 1024 {
+		chunk = 1024
+	}
+	if chunk > maxThrottleChunk {
+		chunk = maxThrottleChunk
+	}
+	return chunk
+}
+
+/**
+ * Upload and download limits of a job or section
+ */
+type Throttle struct {
+	Upload   *Limiter
+	Download *Limiter
+}
+
+func NewThrottle(conf config.ThrottleConfig) *Throttle {
+	window, err := schedule.ParseWindow(conf.Hours)
+	checkErr(err)
+	return &Throttle{
+		Upload:   NewLimiter(conf.UploadLimit, window),
+		Download: NewLimiter(conf.DownloadLimit, window),
+	}
+}
+
+// limits shared by every job, see SetGlobalThrottle
+var globalThrottle = &Throttle{}
+
+/**
+ * Set the limits shared by every backup and restore of the process, on top of the limits of each job
+ */
+func SetGlobalThrottle(conf config.ThrottleConfig) {
+	globalThrottle = NewThrottle(conf)
+}
+
+func (throttle *Throttle) uploadLimiters() []*Limiter {
+	return activeLimiters(throttle.Upload, globalThrottle.Upload)
+}
+
+func (throttle *Throttle) downloadLimiters() []*Limiter {
+	return activeLimiters(throttle.Download, globalThrottle.Download)
+}
+
+func activeLimiters(limiters ...*Limiter) []*Limiter {
+	active := []*Limiter{}
+	for _, limiter := range limiters {
+		if limiter != nil {
+			active = append(active, limiter)
+		}
+	}
+	return active
+}
+
+/**
+ * Wait for delay, returns the context error as soon as it's done
+ */
+func sleepContext(ctx context.Context, delay time.Duration) error {
+	if delay <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+/**
+ * Reader waiting on every limiter for the bytes it reads, a canceled run stops waiting right away
+ */
+type throttledReader struct {
+	ctx      context.Context
+	reader   io.Reader
+	limiters []*Limiter
+	chunk    int
+}
+
+func newThrottledReader(ctx context.Context, reader io.Reader, limiters []*Limiter) io.Reader {
+	if len(limiters) == 0 {
+		return reader
+	}
+	chunk := maxThrottleChunk
+	for _, limiter := range limiters {
+		if next := limiter.chunk(); next < chunk {
+			chunk = next
+		}
+	}
+	return &throttledReader{
+		ctx:      ctx,
+		reader:   reader,
+		limiters: limiters,
+		chunk:    chunk,
+	}
+}
+
+func (reader *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > reader.chunk {
+		p = p[:reader.chunk]
+	}
+	n, err := reader.reader.Read(p)
+	if n > 0 {
+		wait := time.Duration(0)
+		for _, limiter := range reader.limiters {
+			if next := limiter.reserve(n, time.Now()); next > wait {
+				wait = next
+			}
+		}
+		if waitErr := sleepContext(reader.ctx, wait); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+type throttledReadCloser struct {
+	io.Reader
+	closer io.Closer
+}
+
+func (reader *throttledReadCloser) Close() error {
+	return reader.closer.Close()
+}
+
+/**
+ * Storage throttling the content of Put and Get, the other calls go straight to the wrapped storage.
+ * ctx is the one of the run the storage is opened for, its transfers stop waiting once it's done
+ */
+type throttledStorage struct {
+	Storage
+	ctx      context.Context
+	throttle *Throttle
+}
+
+func throttleStorage(ctx context.Context, storage Storage, throttle *Throttle) Storage {
+	if throttle == nil {
+		throttle = &Throttle{}
+	}
+	if len(throttle.uploadLimiters()) == 0 && len(throttle.downloadLimiters()) == 0 {
+		return storage
+	}
+	return &throttledStorage{
+		Storage:  storage,
+		ctx:      ctx,
+		throttle: throttle,
+	}
+}
+
+func (storage *throttledStorage) Put(key string, body io.Reader, info ObjectInfo) error {
+	return storage.Storage.Put(key, newThrottledReader(storage.ctx, body, storage.throttle.uploadLimiters()), info)
+}
+
+func (storage *throttledStorage) Get(key string) (io.ReadCloser, *ObjectInfo, error) {
+	body, info, err := storage.Storage.Get(key)
+	if err != nil {
+		return body, info, err
+	}
+	return &throttledReadCloser{
+		Reader: newThrottledReader(storage.ctx, body, storage.throttle.downloadLimiters()),
+		closer: body,
+	}, info, nil
+}
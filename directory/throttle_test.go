@@ -0,0 +1,113 @@
+package directory
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"playus/server-backup/schedule"
+)
+
+func TestLimiterReserve(t *testing.T) {
+	always, err := schedule.ParseWindow("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	limiter := NewLimiter(1000, always)
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	steps := []struct {
+		after time.Duration
+		bytes int
+		wait  time.Duration
+	}{
+		// a burst of one second is allowed
+		{0, 500, 0},
+		{0, 500, 0},
+		{0, 500, 500 * time.Millisecond},
+		// the debt is paid after half a second
+		{500 * time.Millisecond, 0, 0},
+		{100 * time.Millisecond, 200, 100 * time.Millisecond},
+		// idle time refills at most one second worth of bytes
+		{time.Hour, 1000, 0},
+		{0, 1, time.Millisecond},
+	}
+	for index, step := range steps {
+		now = now.Add(step.after)
+		if wait := limiter.reserve(step.bytes, now); wait != step.wait {
+			t.Errorf("step %d: wait %s, expected %s", index, wait, step.wait)
+		}
+	}
+	if NewLimiter(0, always) != nil {
+		t.Error("a limiter without rate")
+	}
+}
+
+func TestLimiterWindow(t *testing.T) {
+	window, err := schedule.ParseWindow("08:00-20:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	limiter := NewLimiter(1000, window)
+	night := time.Date(2026, 10, 17, 21, 0, 0, 0, time.UTC)
+	if wait := limiter.reserve(1000000, night); wait != 0 {
+		t.Errorf("limited outside the window: wait %s", wait)
+	}
+	// the bucket is full again once the window starts
+	morning := time.Date(2026, 10, 18, 8, 0, 0, 0, time.UTC)
+	if wait := limiter.reserve(1000, morning); wait != 0 {
+		t.Errorf("first second of the window: wait %s", wait)
+	}
+	if wait := limiter.reserve(1000, morning); wait != time.Second {
+		t.Errorf("past the burst: wait %s", wait)
+	}
+}
+
+func TestLimiterChunk(t *testing.T) {
+	always, _ := schedule.ParseWindow("")
+	tests := map[int]int{100: 1024, 100 * 1024: 10 * 1024, 100 * 1024 * 1024: maxThrottleChunk}
+	for rate, expected := range tests {
+		if chunk := NewLimiter(rate, always).chunk(); chunk != expected {
+			t.Errorf("rate %d: chunks of %d, expected %d", rate, chunk, expected)
+		}
+	}
+}
+
+func TestThrottledReaderCancel(t *testing.T) {
+	always, _ := schedule.ParseWindow("")
+	limiter := NewLimiter(1024, always)
+	ctx, cancel := context.WithCancel(context.Background())
+	// ten seconds worth of data
+	reader := newThrottledReader(ctx, bytes.NewReader(make([]byte, 10*1024)), []*Limiter{limiter})
+	time.AfterFunc(50*time.Millisecond, cancel)
+	started := time.Now()
+	_, err := io.ReadAll(reader)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("read after cancel: %v", err)
+	}
+	if elapsed := time.Since(started); elapsed > 2*time.Second {
+		t.Errorf("canceled read returned after %s", elapsed)
+	}
+}
+
+func TestThrottledStorageCancel(t *testing.T) {
+	fsStorage, err := NewFileSystemStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	always, _ := schedule.ParseWindow("")
+	ctx, cancel := context.WithCancel(context.Background())
+	storage := throttleStorage(ctx, fsStorage, &Throttle{Upload: NewLimiter(1024, always)})
+	time.AfterFunc(50*time.Millisecond, cancel)
+	started := time.Now()
+	content := make([]byte, 10*1024)
+	err = storage.Put("prefix/file", bytes.NewReader(content), ObjectInfo{Key: "prefix/file", Size: int64(len(content))})
+	if err == nil {
+		t.Error("a canceled upload succeeded")
+	}
+	if elapsed := time.Since(started); elapsed > 2*time.Second {
+		t.Errorf("canceled upload returned after %s", elapsed)
+	}
+}
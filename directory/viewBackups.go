@@ -2,24 +2,13 @@ package directory
 
 import (
 	"bytes"
+	"context"
 	"fmt"
-	"strings"
-
-	"playus/server-backup/config"
-
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
 )
 
 type BackupView struct {
-	Key      string
-	Secret   string
-	Region   string
-	Endpoint string
-	Bucket   string
-	MaxKeys  int64
+	Storage StorageOptions
+	Bucket  string
 }
 
 type BackupKeys struct {
@@ -29,36 +18,31 @@ type BackupKeys struct {
 type BackupKey struct {
 	Name     string       `json:"name"`
 	Children *[]BackupKey `json:"children"`
+	// snapshot without manifest, see Manifest
+	Incomplete bool `json:"incomplete,omitempty"`
 }
 
-func NewBackupView(bucket string) *BackupView {
+func NewBackupView(options StorageOptions, bucket string) *BackupView {
+	// only keys and manifest names are listed, nothing is decrypted
+	options.Encryption = EncryptionOptions{}
 	backupView := &BackupView{
-		Key:      config.Conf.Get("dirbackup.key").(string),
-		Secret:   config.Conf.Get("dirbackup.secret").(string),
-		Region:   config.Conf.Get("dirbackup.region").(string),
-		Endpoint: config.Conf.Get("dirbackup.endpoint").(string),
-		Bucket:   bucket,
-		MaxKeys:  int64(100),
+		Storage: options,
+		Bucket:  bucket,
 	}
 	return backupView
 }
 
 func (view *BackupView) ViewBackup() {
-	session, err := session.NewSession(&aws.Config{
-		Region:      aws.String(view.Region),
-		Credentials: credentials.NewStaticCredentials(view.Key, view.Secret, ""),
-		Endpoint:    aws.String(view.Endpoint),
-	})
+	storage, err := OpenStorage(context.Background(), view.Bucket, view.Storage)
 	if checkErr(err) {
 		return
 	}
+	defer storage.Close()
 
-	// Create S3 service client
-	s3Client := s3.New(session)
-	if s3Client == nil {
+	topKeys, err := GetTopDirectories(storage, "")
+	if checkErr(err) {
 		return
 	}
-	topKeys := view.getTopDirectories(s3Client, "")
 	keys := []BackupKey{}
 	for _, next := range topKeys {
 		keys = append(keys, BackupKey{
@@ -69,9 +53,10 @@ func (view *BackupView) ViewBackup() {
 
 	for _, next := range keys {
 		children := []BackupKey{}
-		view.getChildren(s3Client, DAILY, fmt.Sprintf("%s/%s/", next.Name, DAILY), &children)
-		view.getChildren(s3Client, WEEKLY, fmt.Sprintf("%s/%s/", next.Name, WEEKLY), &children)
-		view.getChildren(s3Client, MONTHLY, fmt.Sprintf("%s/%s/", next.Name, MONTHLY), &children)
+		view.getChildren(storage, next.Name, HOURLY, &children)
+		view.getChildren(storage, next.Name, DAILY, &children)
+		view.getChildren(storage, next.Name, WEEKLY, &children)
+		view.getChildren(storage, next.Name, MONTHLY, &children)
 		(*next.Children) = children
 	}
 
@@ -86,15 +71,23 @@ func (view *BackupView) ViewBackup() {
 	fmt.Println(buffer.String())
 }
 
-func (view *BackupView) getChildren(client *s3.S3, parent string, path string, target *[]BackupKey) {
+func (view *BackupView) getChildren(storage Storage, prefix string, parent string, target *[]BackupKey) {
 	children := *target
-	pathChildrenKeys := view.getTopDirectories(client, path)
+	pathChildrenKeys, err := ListSnapshotIDs(storage, prefix, parent)
+	if checkErr(err) {
+		return
+	}
 	if len(pathChildrenKeys) > 0 {
+		complete, err := SnapshotsComplete(storage, prefix, parent, pathChildrenKeys)
+		if checkErr(err) {
+			return
+		}
 		pathChildren := []BackupKey{}
 		for _, nextKey := range pathChildrenKeys {
 			pathChildren = append(pathChildren, BackupKey{
-				Name:     nextKey,
-				Children: nil,
+				Name:       nextKey,
+				Children:   nil,
+				Incomplete: !complete[nextKey],
 			})
 		}
 		(*target) = append(children, BackupKey{
@@ -103,64 +96,3 @@ func (view *BackupView) getChildren(client *s3.S3, parent string, path string, t
 		})
 	}
 }
-
-func (view *BackupView) getTopDirectories(client *s3.S3, path string) []string {
-	dirs := &map[string]bool{}
-	// targetPath := fmt.Sprintf("%s/%s", util.Prefix, path)
-	listInput := &s3.ListObjectsV2Input{
-		Bucket:  aws.String(view.Bucket),
-		Prefix:  aws.String(path),
-		MaxKeys: &view.MaxKeys,
-	}
-	view.processTopListInput(client, path, dirs, listInput)
-
-	result := []string{}
-	for key := range *dirs {
-		result = append(result, key)
-	}
-	return result
-}
-
-func (view *BackupView) processTopListInput(client *s3.S3, targetPath string, dirs *map[string]bool, listInput *s3.ListObjectsV2Input) {
-	resp, err := client.ListObjectsV2(listInput)
-	if checkErr(err) {
-		return
-	}
-	for listInput != nil {
-		for _, nextObject := range resp.Contents {
-			if nextObject == nil {
-				continue
-			}
-			objectKey := (*nextObject.Key)
-			suffix := objectKey[len(targetPath):]
-			index := strings.Index(suffix, "/")
-			if index < 0 {
-				// not a directory
-				continue
-			}
-			dirName := suffix[0:index]
-			_, exists := (*dirs)[dirName]
-
-			if exists {
-				// already on the map
-				continue
-			}
-			(*dirs)[dirName] = true
-		}
-		if resp.ContinuationToken == nil {
-			// end the loop
-			listInput = nil
-		} else {
-			listInput := &s3.ListObjectsV2Input{
-				Bucket:            aws.String(view.Bucket),
-				Prefix:            aws.String(targetPath),
-				MaxKeys:           &view.MaxKeys,
-				ContinuationToken: resp.ContinuationToken,
-			}
-			resp, err = client.ListObjectsV2(listInput)
-			if checkErr(err) {
-				return
-			}
-		}
-	}
-}
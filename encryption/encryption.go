@@ -0,0 +1,379 @@
+package encryption
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// Algorithm recorded on encrypted objects
+const Algorithm = "aes-256-gcm"
+
+const (
+	magic = "SBE1"
+	// random part of the nonces of an object, stored on its header
+	noncePrefixSize = 7
+	headerSize      = len(magic) + noncePrefixSize
+	// plaintext sealed at once, every segment adds a tag
+	segmentSize = 64 * 1024
+	tagSize     = 16
+)
+
+// scrypt cost of new repositories
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// additional data of the values sealed by Seal, so they can't be taken for an object's segment
+var sealedValue = []byte("server-backup sealed value")
+
+/**
+ * How the passphrase keys of a repository are derived, stored next to its data.
+ * The salt is random, the same passphrase gives another key on every repository
+ */
+type KDFParams struct {
+	KDF  string `json:"kdf"`
+	N    int    `json:"n"`
+	R    int    `json:"r"`
+	P    int    `json:"p"`
+	Salt []byte `json:"salt"`
+}
+
+func NewKDFParams() (*KDFParams, error) {
+	salt := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	return &KDFParams{KDF: "scrypt", N: scryptN, R: scryptR, P: scryptP, Salt: salt}, nil
+}
+
+func (params *KDFParams) validate() error {
+	if params.KDF != "scrypt" {
+		return fmt.Errorf("unsupported key derivation %q", params.KDF)
+	}
+	if len(params.Salt) < 16 {
+		return errors.New("key derivation salt too short")
+	}
+	return nil
+}
+
+/**
+ * Configured key material: 32 bytes used as they are, or a passphrase stretched with the KDFParams of a repository
+ */
+type Secret struct {
+	raw        []byte
+	passphrase string
+}
+
+func PassphraseSecret(passphrase string) (*Secret, error) {
+	if passphrase == "" {
+		return nil, errors.New("empty encryption passphrase")
+	}
+	return &Secret{passphrase: passphrase}, nil
+}
+
+/**
+ * Whether the key depends on the repository, see Key
+ */
+func (secret *Secret) NeedsParams() bool {
+	return secret.raw == nil
+}
+
+/**
+ * The key of a repository, params is only read for a passphrase
+ */
+func (secret *Secret) Key(params *KDFParams) (*Key, error) {
+	if secret.raw != nil {
+		return NewKey(secret.raw)
+	}
+	if params == nil {
+		return nil, errors.New("a passphrase needs the key derivation parameters of the repository")
+	}
+	if err := params.validate(); err != nil {
+		return nil, err
+	}
+	raw, err := scrypt.Key([]byte(secret.passphrase), params.Salt, params.N, params.R, params.P, 32)
+	if err != nil {
+		return nil, err
+	}
+	return NewKey(raw)
+}
+
+/**
+ * An AES-256 key, ID identifies it on the objects it encrypted without revealing it
+ */
+type Key struct {
+	ID   string
+	aead cipher.AEAD
+	// key of Hash, derived from the key so hashes can't be compared across keys
+	hashKey []byte
+}
+
+func NewKey(raw []byte) (*Key, error) {
+	if len(raw) != 32 {
+		return nil, fmt.Errorf("an encryption key is 32 bytes, got %d", len(raw))
+	}
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	id := sha256.Sum256(append([]byte("server-backup key id "), raw...))
+	mac := hmac.New(sha256.New, raw)
+	mac.Write([]byte("server-backup content hash"))
+	return &Key{ID: hex.EncodeToString(id[:8]), aead: aead, hashKey: mac.Sum(nil)}, nil
+}
+
+/**
+ * Read a key file: 32 bytes as 64 hex digits or base64, anything else is used as a passphrase
+ */
+func LoadKeyFile(path string) (*Secret, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read encryption key file %s: %v", path, err)
+	}
+	text := strings.TrimSpace(string(content))
+	if raw, err := hex.DecodeString(text); err == nil && len(raw) == 32 {
+		return &Secret{raw: raw}, nil
+	}
+	if raw, err := base64.StdEncoding.DecodeString(text); err == nil && len(raw) == 32 {
+		return &Secret{raw: raw}, nil
+	}
+	return PassphraseSecret(text)
+}
+
+/**
+ * Keyed SHA-256 of data as hex, names content without revealing its checksum to whoever lacks the key
+ */
+func (key *Key) Hash(data []byte) string {
+	mac := hmac.New(sha256.New, key.hashKey)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+/**
+ * Encrypt a small value at once, such as the metadata of an object
+ */
+func (key *Key) Seal(plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, key.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return key.aead.Seal(nonce, nonce, plaintext, sealedValue), nil
+}
+
+func (key *Key) Open(sealed []byte) ([]byte, error) {
+	if len(sealed) < key.aead.NonceSize() {
+		return nil, errors.New("sealed value truncated")
+	}
+	nonce := sealed[:key.aead.NonceSize()]
+	plaintext, err := key.aead.Open(nil, nonce, sealed[len(nonce):], sealedValue)
+	if err != nil {
+		return nil, errors.New("sealed value altered or truncated")
+	}
+	return plaintext, nil
+}
+
+/**
+ * Keys able to decrypt objects by ID, Current encrypts new objects and may be nil to store them in plaintext
+ */
+type Keyring struct {
+	Current *Key
+	keys    map[string]*Key
+}
+
+func NewKeyring(current *Key, others ...*Key) *Keyring {
+	keyring := &Keyring{Current: current, keys: map[string]*Key{}}
+	for _, key := range append(others, current) {
+		if key != nil {
+			keyring.keys[key.ID] = key
+		}
+	}
+	return keyring
+}
+
+func (keyring *Keyring) Key(id string) (*Key, bool) {
+	if keyring == nil {
+		return nil, false
+	}
+	key, exists := keyring.keys[id]
+	return key, exists
+}
+
+/**
+ * Size of size bytes once encrypted
+ */
+func EncryptedSize(size int64) int64 {
+	segments := (size + segmentSize - 1) / segmentSize
+	if segments == 0 {
+		segments = 1
+	}
+	return int64(headerSize) + size + segments*tagSize
+}
+
+/**
+ * Size of the plaintext of an encrypted object, -1 when size can't be an encrypted object
+ */
+func PlainSize(size int64) int64 {
+	sealed := size - int64(headerSize)
+	if sealed < tagSize {
+		return -1
+	}
+	segments := (sealed + segmentSize + tagSize - 1) / (segmentSize + tagSize)
+	plain := sealed - segments*tagSize
+	if plain < 0 || EncryptedSize(plain) != size {
+		return -1
+	}
+	return plain
+}
+
+func nonce(prefix []byte, counter uint32, last bool) []byte {
+	value := make([]byte, 12)
+	copy(value, prefix)
+	binary.BigEndian.PutUint32(value[noncePrefixSize:], counter)
+	if last {
+		value[11] = 1
+	}
+	return value
+}
+
+/**
+ * Stream encrypting plaintext in authenticated segments, the last one is flagged so a truncated object never decrypts
+ */
+type encryptReader struct {
+	key     *Key
+	source  *bufio.Reader
+	header  []byte
+	counter uint32
+	pending bytes.Buffer
+	done    bool
+	err     error
+}
+
+func (key *Key) Encrypt(plaintext io.Reader) io.Reader {
+	header := make([]byte, headerSize)
+	copy(header, magic)
+	_, err := io.ReadFull(rand.Reader, header[len(magic):])
+	reader := &encryptReader{key: key, source: bufio.NewReaderSize(plaintext, segmentSize+1), header: header, err: err}
+	reader.pending.Write(header)
+	return reader
+}
+
+func (reader *encryptReader) Read(p []byte) (int, error) {
+	for reader.pending.Len() == 0 {
+		if reader.err != nil {
+			return 0, reader.err
+		}
+		if reader.done {
+			return 0, io.EOF
+		}
+		reader.seal()
+	}
+	return reader.pending.Read(p)
+}
+
+func (reader *encryptReader) seal() {
+	segment := make([]byte, segmentSize)
+	read, err := io.ReadFull(reader.source, segment)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		reader.err = err
+		return
+	}
+	last := read < segmentSize
+	if !last {
+		// a full segment is the last one when nothing follows
+		if _, peekErr := reader.source.Peek(1); peekErr == io.EOF {
+			last = true
+		} else if peekErr != nil {
+			reader.err = peekErr
+			return
+		}
+	}
+	noncePrefix := reader.header[len(magic):]
+	reader.pending.Write(reader.key.aead.Seal(nil, nonce(noncePrefix, reader.counter, last), segment[:read], reader.header))
+	reader.counter++
+	reader.done = last
+}
+
+/**
+ * Stream decrypting what Encrypt produced, fails on any altered or truncated content
+ */
+type decryptReader struct {
+	key     *Key
+	source  *bufio.Reader
+	header  []byte
+	counter uint32
+	pending bytes.Buffer
+	done    bool
+	err     error
+}
+
+func (key *Key) Decrypt(ciphertext io.Reader) io.Reader {
+	return &decryptReader{key: key, source: bufio.NewReaderSize(ciphertext, segmentSize+tagSize+1)}
+}
+
+func (reader *decryptReader) Read(p []byte) (int, error) {
+	for reader.pending.Len() == 0 {
+		if reader.err != nil {
+			return 0, reader.err
+		}
+		if reader.done {
+			return 0, io.EOF
+		}
+		reader.open()
+	}
+	return reader.pending.Read(p)
+}
+
+func (reader *decryptReader) open() {
+	if reader.header == nil {
+		header := make([]byte, headerSize)
+		if _, err := io.ReadFull(reader.source, header); err != nil || string(header[:len(magic)]) != magic {
+			reader.err = errors.New("not an encrypted object")
+			return
+		}
+		reader.header = header
+	}
+	sealed := make([]byte, segmentSize+tagSize)
+	read, err := io.ReadFull(reader.source, sealed)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		reader.err = err
+		return
+	}
+	last := read < len(sealed)
+	if !last {
+		if _, peekErr := reader.source.Peek(1); peekErr == io.EOF {
+			last = true
+		} else if peekErr != nil {
+			reader.err = peekErr
+			return
+		}
+	}
+	plaintext, err := reader.key.aead.Open(nil, nonce(reader.header[len(magic):], reader.counter, last), sealed[:read], reader.header)
+	if err != nil {
+		reader.err = errors.New("encrypted object altered or truncated")
+		return
+	}
+	reader.pending.Write(plaintext)
+	reader.counter++
+	reader.done = last
+}
@@ -0,0 +1,219 @@
+package encryption
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+// sizes around the segment boundaries
+var sizes = []int{0, 1, segmentSize - 1, segmentSize, segmentSize + 1, 3 * segmentSize}
+
+func newTestKey(t *testing.T, fill byte) *Key {
+	t.Helper()
+	key, err := NewKey(bytes.Repeat([]byte{fill}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func plaintext(size int) []byte {
+	data := make([]byte, size)
+	for index := range data {
+		data[index] = byte(index * 7)
+	}
+	return data
+}
+
+func encrypt(t *testing.T, key *Key, data []byte) []byte {
+	t.Helper()
+	ciphertext, err := io.ReadAll(key.Encrypt(bytes.NewReader(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ciphertext
+}
+
+func decrypt(key *Key, ciphertext []byte) ([]byte, error) {
+	return io.ReadAll(key.Decrypt(bytes.NewReader(ciphertext)))
+}
+
+func TestRoundTrip(t *testing.T) {
+	key := newTestKey(t, 1)
+	for _, size := range sizes {
+		data := plaintext(size)
+		ciphertext := encrypt(t, key, data)
+		if int64(len(ciphertext)) != EncryptedSize(int64(size)) {
+			t.Errorf("%d bytes encrypted to %d, EncryptedSize says %d", size, len(ciphertext), EncryptedSize(int64(size)))
+		}
+		decrypted, err := decrypt(key, ciphertext)
+		if err != nil || !bytes.Equal(decrypted, data) {
+			t.Errorf("%d bytes: decrypted %d bytes, %v", size, len(decrypted), err)
+		}
+		// the segments don't depend on how the streams are read
+		shortReads, err := io.ReadAll(iotest.OneByteReader(key.Decrypt(iotest.HalfReader(bytes.NewReader(ciphertext)))))
+		if err != nil || !bytes.Equal(shortReads, data) {
+			t.Errorf("%d bytes read short: decrypted %d bytes, %v", size, len(shortReads), err)
+		}
+		if again := encrypt(t, key, data); bytes.Equal(again, ciphertext) {
+			t.Errorf("%d bytes encrypted twice to the same ciphertext", size)
+		}
+	}
+}
+
+func TestSizes(t *testing.T) {
+	for _, size := range sizes {
+		if plain := PlainSize(EncryptedSize(int64(size))); plain != int64(size) {
+			t.Errorf("PlainSize(EncryptedSize(%d)) = %d", size, plain)
+		}
+	}
+	if size := EncryptedSize(0); size != int64(headerSize+tagSize) {
+		t.Errorf("an empty object is %d bytes encrypted", size)
+	}
+	// no segment is only a tag but the last one of an empty object
+	for _, size := range []int64{0, int64(headerSize), int64(headerSize + tagSize - 1), EncryptedSize(segmentSize) + tagSize} {
+		if plain := PlainSize(size); plain != -1 {
+			t.Errorf("PlainSize(%d) = %d, no object is encrypted to that size", size, plain)
+		}
+	}
+}
+
+func TestTruncation(t *testing.T) {
+	key := newTestKey(t, 1)
+	ciphertext := encrypt(t, key, plaintext(3*segmentSize))
+	// the objects ending at a segment boundary are only rejected by the flag of the last segment
+	for segments := 0; segments < 3; segments++ {
+		truncated := ciphertext[:headerSize+segments*(segmentSize+tagSize)]
+		if _, err := decrypt(key, truncated); err == nil {
+			t.Errorf("truncated after %d segments: decrypted", segments)
+		}
+	}
+	for _, length := range []int{0, headerSize - 1, headerSize + 10, len(ciphertext) - 1} {
+		if _, err := decrypt(key, ciphertext[:length]); err == nil {
+			t.Errorf("truncated to %d bytes: decrypted", length)
+		}
+	}
+	// a segment dropped from the middle
+	dropped := append(append([]byte{}, ciphertext[:headerSize+segmentSize+tagSize]...), ciphertext[headerSize+2*(segmentSize+tagSize):]...)
+	if _, err := decrypt(key, dropped); err == nil {
+		t.Error("decrypted without its second segment")
+	}
+}
+
+func TestAlteration(t *testing.T) {
+	key := newTestKey(t, 1)
+	ciphertext := encrypt(t, key, plaintext(2*segmentSize))
+	for _, offset := range []int{0, len(magic), headerSize - 1, headerSize, headerSize + segmentSize + tagSize + 5, len(ciphertext) - 1} {
+		altered := append([]byte{}, ciphertext...)
+		altered[offset] ^= 1
+		if _, err := decrypt(key, altered); err == nil {
+			t.Errorf("byte %d flipped: decrypted", offset)
+		}
+	}
+	if _, err := decrypt(newTestKey(t, 2), ciphertext); err == nil {
+		t.Error("decrypted with another key")
+	}
+}
+
+func TestSeal(t *testing.T) {
+	key := newTestKey(t, 1)
+	sealed, err := key.Seal([]byte("metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opened, err := key.Open(sealed)
+	if err != nil || string(opened) != "metadata" {
+		t.Errorf("opened %q, %v", opened, err)
+	}
+	if _, err := newTestKey(t, 2).Open(sealed); err == nil {
+		t.Error("opened with another key")
+	}
+	altered := append([]byte{}, sealed...)
+	altered[len(altered)-1] ^= 1
+	if _, err := key.Open(altered); err == nil {
+		t.Error("opened an altered value")
+	}
+	if _, err := key.Open(sealed[:4]); err == nil {
+		t.Error("opened a truncated value")
+	}
+
+	// a segment of an object, with the nonce it was sealed with, isn't a sealed value
+	ciphertext := encrypt(t, key, []byte("metadata"))
+	segment := append(nonce(ciphertext[len(magic):headerSize], 0, true), ciphertext[headerSize:]...)
+	if _, err := key.Open(segment); err == nil {
+		t.Error("opened a segment of an object")
+	}
+}
+
+func TestHash(t *testing.T) {
+	key := newTestKey(t, 1)
+	hash := key.Hash([]byte("chunk"))
+	if len(hash) != 64 || hash != key.Hash([]byte("chunk")) {
+		t.Errorf("hashed to %s then %s", hash, key.Hash([]byte("chunk")))
+	}
+	if hash == key.Hash([]byte("chunk2")) {
+		t.Error("two contents hashed the same")
+	}
+	if hash == newTestKey(t, 2).Hash([]byte("chunk")) {
+		t.Error("two keys hashed the same")
+	}
+}
+
+func TestSecretKey(t *testing.T) {
+	secret, err := PassphraseSecret("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := secret.Key(nil); err == nil {
+		t.Error("a passphrase key derived without salt")
+	}
+	first, err := NewKDFParams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := NewKDFParams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstKey, err := secret.Key(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := secret.Key(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secondKey, err := secret.Key(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if firstKey.ID != again.ID || firstKey.ID == secondKey.ID {
+		t.Errorf("keys %s, %s and %s", firstKey.ID, again.ID, secondKey.ID)
+	}
+	if _, err := secret.Key(&KDFParams{KDF: "scrypt", N: scryptN, R: scryptR, P: scryptP, Salt: []byte("short")}); err == nil {
+		t.Error("a key derived with a short salt")
+	}
+	if _, err := PassphraseSecret(""); err == nil {
+		t.Error("an empty passphrase accepted")
+	}
+}
+
+func TestKeyring(t *testing.T) {
+	current := newTestKey(t, 1)
+	former := newTestKey(t, 2)
+	keyring := NewKeyring(current, former, nil)
+	for _, key := range []*Key{current, former} {
+		if found, exists := keyring.Key(key.ID); !exists || found != key {
+			t.Errorf("key %s not found", key.ID)
+		}
+	}
+	if _, exists := keyring.Key(newTestKey(t, 3).ID); exists {
+		t.Error("found a key the keyring doesn't have")
+	}
+	var empty *Keyring
+	if _, exists := empty.Key(current.ID); exists {
+		t.Error("found a key without keyring")
+	}
+}
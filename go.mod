@@ -1,17 +1,30 @@
 module playus/server-backup
 
-go 1.16
+// the lowest version building the module: the code needs 1.21 (the builtin max, errors.Join and
+// context.WithCancelCause), github.com/pkg/sftp v1.13.11 and golang.org/x/crypto v0.54.0 require 1.25.0
+go 1.25.0
 
 require (
 	github.com/aws/aws-sdk-go v1.44.42
 	github.com/fatih/color v1.13.0
 	github.com/gabriel-vasile/mimetype v1.4.0
 	github.com/go-sql-driver/mysql v1.6.0
-	github.com/madflojo/tasks v1.0.4
-	github.com/mattn/go-colorable v0.1.12 // indirect
+	github.com/klauspost/compress v1.20.1
 	github.com/pelletier/go-toml v1.9.5
-	github.com/rs/xid v1.4.0 // indirect
+	github.com/pkg/sftp v1.13.11
+	github.com/robfig/cron/v3 v3.0.1
 	github.com/sabhiram/go-gitignore v0.0.0-20210923224102-525f6e181f06
 	github.com/typesense/typesense-go v0.5.0
-	golang.org/x/sys v0.0.0-20220610221304-9f5ed59c137d // indirect
+	golang.org/x/crypto v0.54.0
+)
+
+require (
+	github.com/deepmap/oapi-codegen v1.9.0 // indirect
+	github.com/jmespath/go-jmespath v0.4.0 // indirect
+	github.com/kr/fs v0.1.0 // indirect
+	github.com/mattn/go-colorable v0.1.12 // indirect
+	github.com/mattn/go-isatty v0.0.14 // indirect
+	github.com/sony/gobreaker v0.5.0 // indirect
+	golang.org/x/net v0.56.0 // indirect
+	golang.org/x/sys v0.47.0 // indirect
 )
@@ -1,20 +1,35 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
-	"sync"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"playus/server-backup/config"
 	"playus/server-backup/database"
 	"playus/server-backup/directory"
+	"playus/server-backup/schedule"
 	"playus/server-backup/typesensebackup"
+)
 
-	"github.com/madflojo/tasks"
+// Exit status of the process
+const (
+	exitOK      = 0
+	exitFailure = 1
+	exitUsage   = 2
+	// stopped on a signal but the running backups had to be canceled on the shutdown deadline
+	exitCanceled = 3
 )
 
+var shutdownSignals = []os.Signal{syscall.SIGTERM, syscall.SIGINT}
+
 type BackupOptions struct {
+	configPath     *string
 	backup         bool
 	restore        bool
 	viewBackups    bool
@@ -23,141 +38,359 @@ type BackupOptions struct {
 	targetKey      *string
 	targetRotation *string
 	targetDate     *string
+	// backup whose storage settings and keys read the bucket, the [dirbackup] ones when empty
+	jobName *string
+	// restore a snapshot without manifest
+	allowIncomplete bool
 }
 
-func scheduleDBBackup(scheduler *tasks.Scheduler) {
-	fmt.Println("Scheduling DB backup")
-	interval := int(config.Conf.Get("database.secondsInterval").(int64))
-	_, err := scheduler.Add(&tasks.Task{
-		Mutex:      sync.Mutex{},
-		Interval:   time.Duration(time.Duration(interval) * time.Second),
-		RunOnce:    false,
-		StartAfter: time.Time{},
-		TaskFunc: func() error {
-			fmt.Println("Start running DB backup: ")
-			database.Worker.DoBackup()
-			return nil
-		},
-		ErrFunc: func(err error) {
-			fmt.Println("Error running DB backup: ")
-			fmt.Println(err.Error())
-		},
-	})
-	if err != nil {
-		fmt.Println("Error scheduling DB backup")
-	}
-	database.Worker.DoBackup()
-}
-
-func scheduleDirBackup(scheduler *tasks.Scheduler) {
-	fmt.Println("Scheduling Directory Backup")
-	interval := int(config.Conf.Get("dirbackup.secondsInterval").(int64))
-	_, err := scheduler.Add(&tasks.Task{
-		Mutex:      sync.Mutex{},
-		Interval:   time.Duration(time.Duration(interval) * time.Second),
-		RunOnce:    false,
-		StartAfter: time.Time{},
-		TaskFunc: func() error {
-			fmt.Println("Start running Dir backup: ")
-			directory.Worker.DoBackup()
-			return nil
-		},
-		ErrFunc: func(err error) {
-			fmt.Println("Error running Dir backup: ")
-			fmt.Println(err.Error())
-		},
-	})
+/**
+ * A backup of an enabled section or directory job,
+ * run by the scheduler or once with the backup command
+ */
+type backupJob struct {
+	Name     string
+	Schedule config.ScheduleConfig
+	Run      func(ctx context.Context) error
+	// apply the retention without backing up, see the prune command
+	Prune func(ctx context.Context, dryRun bool) error
+}
+
+func backupJobs(conf *config.Config) ([]backupJob, error) {
+	jobs := []backupJob{}
+	if conf.Database.Enabled {
+		worker := database.NewWorker(conf)
+		jobs = append(jobs, backupJob{
+			Name:     "database",
+			Schedule: conf.Database.Schedule,
+			Run:      worker.DoBackup,
+			Prune:    worker.DoPrune,
+		})
+	}
+	if conf.DirBackup.Enabled {
+		worker, err := directory.NewWorker(conf)
+		if err != nil {
+			return nil, err
+		}
+		for _, job := range worker.Jobs {
+			job := job
+			jobs = append(jobs, backupJob{
+				Name:     fmt.Sprintf("dirbackup/%s", job.Name),
+				Schedule: job.Schedule,
+				Run: func(ctx context.Context) error {
+					return worker.DoJobBackup(ctx, job)
+				},
+				Prune: func(ctx context.Context, dryRun bool) error {
+					return worker.DoJobPrune(ctx, job, dryRun)
+				},
+			})
+		}
+	}
+	if conf.Typesense.Enabled {
+		worker := typesensebackup.NewWorker(conf)
+		jobs = append(jobs, backupJob{
+			Name:     "typesensebackup",
+			Schedule: conf.Typesense.Schedule,
+			Run:      worker.DoBackup,
+			Prune:    worker.DoPrune,
+		})
+	}
+	return jobs, nil
+}
+
+/**
+ * Find a job by its full name, or only the name for directory jobs
+ */
+func findBackupJob(jobs []backupJob, name string) (backupJob, bool) {
+	for _, candidate := range []string{name, fmt.Sprintf("dirbackup/%s", name)} {
+		for _, job := range jobs {
+			if job.Name == candidate {
+				return job, true
+			}
+		}
+	}
+	return backupJob{}, false
+}
+
+func jobNames(jobs []backupJob) string {
+	names := []string{}
+	for _, job := range jobs {
+		names = append(names, job.Name)
+	}
+	return strings.Join(names, ", ")
+}
+
+/**
+ * Run a job and report whether it succeeded, partly failed or failed
+ */
+func (job backupJob) runAndReport(ctx context.Context) error {
+	err := job.Run(ctx)
+	fmt.Printf("Finished %s: %s\n", job.Name, directory.StatusOf(err))
+	return err
+}
+
+func scheduleBackups(scheduler *schedule.Scheduler, jobs []backupJob) error {
+	for _, job := range jobs {
+		taskSchedule, err := schedule.Parse(job.Schedule.Cron, job.Schedule.Timezone, job.Schedule.SecondsInterval)
+		if err != nil {
+			return fmt.Errorf("unable to schedule %s: %v", job.Name, err)
+		}
+		fmt.Printf("Scheduling %s\n", job.Name)
+		scheduler.Add(schedule.Task{
+			Name:     job.Name,
+			Schedule: taskSchedule,
+			CatchUp:  job.Schedule.CatchUp,
+			Overlap:  job.Schedule.Overlap,
+			Run:      job.runAndReport,
+		})
+	}
+	return nil
+}
+
+/**
+ * Run the scheduled backups until SIGTERM or SIGINT.
+ * A first signal stops scheduling and waits up to general.shutdownTimeout for the running backups,
+ * a second one exits right away
+ */
+func runBackups(conf *config.Config) int {
+	fmt.Println("start")
+	state, err := schedule.LoadState(conf.General.StateDir)
 	if err != nil {
-		fmt.Println("Error scheduling Dir backup")
-	}
-	directory.Worker.DoBackup()
-}
-
-func scheduleTypesenseBackup(scheduler *tasks.Scheduler) {
-	fmt.Println("Scheduling Typesense Backup")
-	interval := int(config.Conf.Get("typesensebackup.secondsInterval").(int64))
-	_, err := scheduler.Add(&tasks.Task{
-		Mutex:      sync.Mutex{},
-		Interval:   time.Duration(time.Duration(interval) * time.Second),
-		RunOnce:    false,
-		StartAfter: time.Time{},
-		TaskFunc: func() error {
-			fmt.Println("Start running Typesense backup: ")
-			typesensebackup.Worker.DoBackup()
-			return nil
-		},
-		ErrFunc: func(err error) {
-			fmt.Println("Error running Typesense backup: ")
-			fmt.Println(err.Error())
-		},
-	})
+		fmt.Printf("unable to load the scheduler state from %s: %v\n", conf.General.StateDir, err)
+		return exitFailure
+	}
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, shutdownSignals...)
+
+	jobs, err := backupJobs(conf)
 	if err != nil {
-		fmt.Println("Error scheduling Typesense backup")
+		fmt.Println(err)
+		return exitFailure
+	}
+	scheduler := schedule.NewScheduler(state)
+	if err := scheduleBackups(scheduler, jobs); err != nil {
+		fmt.Println(err)
+		scheduler.Shutdown(0)
+		return exitFailure
+	}
+
+	received := <-signals
+	timeout := time.Duration(conf.General.ShutdownTimeout) * time.Second
+	fmt.Printf("Received %s, waiting up to %s for running backups\n", received, timeout)
+	go func() {
+		again := <-signals
+		fmt.Printf("Received %s again, exiting now\n", again)
+		os.Exit(exitCanceled)
+	}()
+	if err := scheduler.Shutdown(timeout); err != nil {
+		fmt.Println(err)
+		return exitCanceled
 	}
-	typesensebackup.Worker.DoBackup()
+	fmt.Println("end")
+	return exitOK
 }
 
-func runBackups() {
-	fmt.Println("start")
-	scheduler := tasks.New()
-	defer scheduler.Stop()
+/**
+ * Run the selected backup, or every enabled one, exactly once.
+ * Meant for cron, systemd timers or kubernetes cron jobs, exits with status 1 when any backup failed
+ */
+func runBackupCommand(args []string) int {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	configPath := flags.String("config", config.DefaultPath, "Path to the configuration file")
+	jobName := flags.String("job", "", "Backup to run: database, typesensebackup or a directory job name, every enabled backup when empty")
+	flags.Parse(args)
+
+	jobs, status := selectJobs(loadConfig(*configPath), *jobName)
+	if status != exitOK {
+		return status
+	}
 
-	dbEnabled := config.Conf.Get("database.enabled").(bool)
-	if dbEnabled {
-		scheduleDBBackup(scheduler)
+	ctx, stop := signal.NotifyContext(context.Background(), shutdownSignals...)
+	defer stop()
+	failed := []string{}
+	for _, job := range jobs {
+		fmt.Printf("Start running %s\n", job.Name)
+		if err := job.runAndReport(ctx); err != nil {
+			fmt.Printf("Error running %s: %s\n", job.Name, err)
+			failed = append(failed, job.Name)
+		}
 	}
-	dirEnabled := config.Conf.Get("dirbackup.enabled").(bool)
-	if dirEnabled {
-		scheduleDirBackup(scheduler)
+	if ctx.Err() != nil {
+		fmt.Println("Backup canceled")
+		return exitCanceled
 	}
-	typesenseEnabled := config.Conf.Get("typesensebackup.enabled").(bool)
-	if typesenseEnabled {
-		scheduleTypesenseBackup(scheduler)
+	if len(failed) > 0 {
+		fmt.Printf("Failed backups: %s\n", strings.Join(failed, ", "))
+		return exitFailure
 	}
+	return exitOK
+}
 
-	fmt.Scanln()
-	fmt.Println("end")
+/**
+ * Apply the retention of the selected backup, or every enabled one, without backing anything up.
+ * With -dry-run only prints the snapshots it would keep and delete
+ */
+func runPruneCommand(args []string) int {
+	flags := flag.NewFlagSet("prune", flag.ExitOnError)
+	configPath := flags.String("config", config.DefaultPath, "Path to the configuration file")
+	jobName := flags.String("job", "", "Backup to prune: database, typesensebackup or a directory job name, every enabled backup when empty")
+	dryRun := flags.Bool("dry-run", false, "Print the snapshots that would be deleted without deleting them")
+	flags.Parse(args)
+
+	jobs, status := selectJobs(loadConfig(*configPath), *jobName)
+	if status != exitOK {
+		return status
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), shutdownSignals...)
+	defer stop()
+	failed := []string{}
+	for _, job := range jobs {
+		fmt.Printf("Pruning %s\n", job.Name)
+		if err := job.Prune(ctx, *dryRun); err != nil {
+			fmt.Printf("Error pruning %s: %s\n", job.Name, err)
+			failed = append(failed, job.Name)
+		}
+	}
+	if ctx.Err() != nil {
+		fmt.Println("Prune canceled")
+		return exitCanceled
+	}
+	if len(failed) > 0 {
+		fmt.Printf("Failed prunes: %s\n", strings.Join(failed, ", "))
+		return exitFailure
+	}
+	return exitOK
 }
 
-func runViewBackups(bucket string) {
-	worker := directory.NewBackupView(bucket)
+/**
+ * The enabled jobs, or only the named one, with exitOK or the status to exit with
+ */
+func selectJobs(conf *config.Config, jobName string) ([]backupJob, int) {
+	jobs, err := backupJobs(conf)
+	if err != nil {
+		fmt.Println(err)
+		return nil, exitFailure
+	}
+	if jobName != "" {
+		job, found := findBackupJob(jobs, jobName)
+		if !found {
+			fmt.Printf("Unknown or disabled backup job %s, enabled jobs: %s\n", jobName, jobNames(jobs))
+			return nil, exitUsage
+		}
+		jobs = []backupJob{job}
+	}
+	if len(jobs) == 0 {
+		fmt.Println("No backup enabled in the configuration")
+		return nil, exitFailure
+	}
+	return jobs, exitOK
+}
+
+func runViewBackups(conf *config.Config, bucket string, jobName string) error {
+	access, err := directory.ResolveJobAccess(conf, jobName)
+	if err != nil {
+		return err
+	}
+	worker := directory.NewBackupView(access.Storage, bucket)
 	worker.ViewBackup()
+	return nil
 }
 
-func runRestore(targetDir string, bucket string, targetKey string, targetRotation string, targetDate string) {
-	worker := directory.NewRestore(targetDir, bucket, fmt.Sprintf("%s/%s/%s", targetKey, targetRotation, targetDate))
-	worker.RestoreBackup()
+func runRestore(ctx context.Context, conf *config.Config, jobName string, targetDir string, bucket string, targetKey string, targetRotation string, targetDate string, allowIncomplete bool) error {
+	access, err := directory.ResolveJobAccess(conf, jobName)
+	if err != nil {
+		return err
+	}
+	worker := directory.NewRestore(access.Storage, access.Retry, access.Workers, targetDir, bucket, targetKey, targetRotation, targetDate, allowIncomplete)
+	return worker.RestoreBackup(ctx)
+}
+
+/**
+ * Check the configuration file without running anything,
+ * exits with status 1 listing every problem found
+ */
+func runValidateConfig(args []string) {
+	flags := flag.NewFlagSet("validate-config", flag.ExitOnError)
+	configPath := flags.String("config", config.DefaultPath, "Path to the configuration file")
+	flags.Parse(args)
+
+	_, err := config.Load(*configPath)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(exitFailure)
+	}
+	fmt.Printf("%s: OK\n", *configPath)
+}
+
+func loadConfig(path string) *config.Config {
+	conf, err := config.Load(path)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(exitFailure)
+	}
+	directory.SetGlobalThrottle(conf.General.Throttle)
+	return conf
 }
 
 func main() {
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		switch os.Args[1] {
+		case "validate-config":
+			runValidateConfig(os.Args[2:])
+		case "backup":
+			os.Exit(runBackupCommand(os.Args[2:]))
+		case "prune":
+			os.Exit(runPruneCommand(os.Args[2:]))
+		default:
+			fmt.Printf("Unknown command %s, available commands: backup, prune, validate-config\n", os.Args[1])
+			os.Exit(exitUsage)
+		}
+		return
+	}
 	options := GetBackupOptions()
 	if options == nil {
 		return
 	}
+	conf := loadConfig(*options.configPath)
 	if options.backup {
-		runBackups()
+		os.Exit(runBackups(conf))
 	}
 	if options.viewBackups {
-		runViewBackups(*options.bucket)
+		if err := runViewBackups(conf, *options.bucket, *options.jobName); err != nil {
+			fmt.Println(err)
+			os.Exit(exitUsage)
+		}
 	}
 	if options.restore {
-		runRestore(*options.targetDir, *options.bucket, *options.targetKey, *options.targetRotation, *options.targetDate)
+		ctx, stop := signal.NotifyContext(context.Background(), shutdownSignals...)
+		err := runRestore(ctx, conf, *options.jobName, *options.targetDir, *options.bucket, *options.targetKey, *options.targetRotation, *options.targetDate, options.allowIncomplete)
+		stop()
+		fmt.Printf("Restore %s\n", directory.StatusOf(err))
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(exitFailure)
+		}
 	}
 }
 
 func GetBackupOptions() *BackupOptions {
+	configPath := flag.String("config", config.DefaultPath, "Path to the configuration file")
 	restore := flag.Bool("restore", false, "Indicate to run in restore mode")
 	viewBackups := flag.Bool("view", false, "Get Available keys for restore")
 
 	targetDir := flag.String("dir", "", "Target Directory to restore")
 	targetBucket := flag.String("bucket", "", "Target Bucket")
 	targetKey := flag.String("key", "", "Target Backup key to restore")
-	targetRotation := flag.String("rotation", "", "Target Rotation key, daily|weekly|monthly")
-	targetDate := flag.String("date", "", "Target date directory to restore")
+	targetRotation := flag.String("rotation", "", "Target Rotation key, hourly|daily|weekly|monthly")
+	targetDate := flag.String("date", "", "Target snapshot to restore, a date such as 2026-10-17 or an hourly snapshot such as 2026-10-17T0300Z")
+	allowIncomplete := flag.Bool("allow-incomplete", false, "Restore a snapshot without manifest, e.g. of an interrupted run")
+	jobName := flag.String("job", "", "Backup that wrote the bucket: database, typesensebackup or a directory job name, uses its credentials and keys. The [dirbackup] ones when empty")
 
 	flag.Parse()
 	if (restore == nil && viewBackups == nil) || !(*viewBackups) && !(*restore) {
 		return &BackupOptions{
+			configPath:     configPath,
 			backup:         true,
 			restore:        false,
 			viewBackups:    false,
@@ -173,14 +406,17 @@ func GetBackupOptions() *BackupOptions {
 			return nil
 		}
 		return &BackupOptions{
-			backup:         false,
-			restore:        true,
-			viewBackups:    false,
-			targetDir:      targetDir,
-			targetKey:      targetKey,
-			targetRotation: targetRotation,
-			targetDate:     targetDate,
-			bucket:         targetBucket,
+			configPath:      configPath,
+			backup:          false,
+			restore:         true,
+			viewBackups:     false,
+			targetDir:       targetDir,
+			targetKey:       targetKey,
+			targetRotation:  targetRotation,
+			targetDate:      targetDate,
+			bucket:          targetBucket,
+			jobName:         jobName,
+			allowIncomplete: *allowIncomplete,
 		}
 	}
 	if viewBackups != nil && (*viewBackups) {
@@ -190,6 +426,7 @@ func GetBackupOptions() *BackupOptions {
 			return nil
 		}
 		return &BackupOptions{
+			configPath:     configPath,
 			backup:         false,
 			restore:        false,
 			viewBackups:    true,
@@ -198,6 +435,7 @@ func GetBackupOptions() *BackupOptions {
 			targetRotation: nil,
 			targetDate:     nil,
 			bucket:         targetBucket,
+			jobName:        jobName,
 		}
 	}
 	return nil
@@ -0,0 +1,166 @@
+package retention
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/**
+ * A snapshot to keep or prune, Time is when it was taken.
+ * An incomplete snapshot, e.g. of a run that stopped halfway, never counts towards the policy
+ */
+type Snapshot struct {
+	ID         string
+	Time       time.Time
+	Incomplete bool
+}
+
+/**
+ * How many snapshots to keep: the newest snapshot of each of the last Hourly hours, Daily days, Weekly ISO weeks,
+ * Monthly months and Yearly years, plus every snapshot taken within Within of now.
+ * A count of 0 keeps none for its rule, an empty policy keeps nothing but the newest incomplete snapshots
+ */
+type Policy struct {
+	Hourly  int
+	Daily   int
+	Weekly  int
+	Monthly int
+	Yearly  int
+	Within  time.Duration
+}
+
+func (policy Policy) Empty() bool {
+	return policy.Hourly <= 0 && policy.Daily <= 0 && policy.Weekly <= 0 && policy.Monthly <= 0 && policy.Yearly <= 0 && policy.Within <= 0
+}
+
+/**
+ * Whether a snapshot is kept and the rules keeping it
+ */
+type Decision struct {
+	Snapshot Snapshot
+	Keep     bool
+	Reasons  []string
+}
+
+type bucketRule struct {
+	name   string
+	count  int
+	bucket func(t time.Time) string
+}
+
+func (policy Policy) rules() []bucketRule {
+	return []bucketRule{
+		{name: "hourly", count: policy.Hourly, bucket: func(t time.Time) string { return t.Format("2006-01-02T15") }},
+		{name: "daily", count: policy.Daily, bucket: func(t time.Time) string { return t.Format("2006-01-02") }},
+		{name: "weekly", count: policy.Weekly, bucket: func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+		{name: "monthly", count: policy.Monthly, bucket: func(t time.Time) string { return t.Format("2006-01") }},
+		{name: "yearly", count: policy.Yearly, bucket: func(t time.Time) string { return t.Format("2006") }},
+	}
+}
+
+/**
+ * Decide which snapshots the policy keeps, newest first. now is the reference for Within,
+ * pass the clock of the caller so the outcome doesn't depend on when it runs.
+ * Incomplete snapshots are kept only while newer than every complete one, a run may still be writing them
+ */
+func Apply(policy Policy, snapshots []Snapshot, now time.Time) []Decision {
+	decisions := make([]Decision, len(snapshots))
+	for index, snapshot := range snapshots {
+		decisions[index] = Decision{Snapshot: snapshot}
+	}
+	sort.SliceStable(decisions, func(i, j int) bool {
+		return decisions[i].Snapshot.Time.After(decisions[j].Snapshot.Time)
+	})
+	for index := range decisions {
+		if !decisions[index].Snapshot.Incomplete {
+			break
+		}
+		decisions[index].Keep = true
+		decisions[index].Reasons = []string{"incomplete, newest"}
+	}
+	for _, rule := range policy.rules() {
+		if rule.count <= 0 {
+			continue
+		}
+		seen := map[string]bool{}
+		for index := range decisions {
+			if len(seen) >= rule.count {
+				break
+			}
+			if decisions[index].Snapshot.Incomplete {
+				continue
+			}
+			bucket := rule.bucket(decisions[index].Snapshot.Time)
+			if seen[bucket] {
+				continue
+			}
+			seen[bucket] = true
+			decisions[index].Keep = true
+			decisions[index].Reasons = append(decisions[index].Reasons, fmt.Sprintf("%s %d", rule.name, len(seen)))
+		}
+	}
+	if policy.Within > 0 {
+		limit := now.Add(-policy.Within)
+		for index := range decisions {
+			if decisions[index].Snapshot.Time.After(limit) && !decisions[index].Snapshot.Incomplete {
+				decisions[index].Keep = true
+				decisions[index].Reasons = append(decisions[index].Reasons, "within "+FormatDuration(policy.Within))
+			}
+		}
+	}
+	return decisions
+}
+
+var durationUnits = map[byte]time.Duration{
+	'h': time.Hour,
+	'd': 24 * time.Hour,
+	'w': 7 * 24 * time.Hour,
+}
+
+/**
+ * Parse a duration such as 36h, 14d, 2w or 1w3d, an empty value is 0
+ */
+func ParseDuration(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	total := time.Duration(0)
+	number := ""
+	for index := 0; index < len(value); index++ {
+		next := value[index]
+		if next >= '0' && next <= '9' {
+			number += string(next)
+			continue
+		}
+		unit, known := durationUnits[next]
+		if !known || number == "" {
+			return 0, fmt.Errorf("invalid duration %q, expected a number of hours, days or weeks such as 36h, 14d or 2w", value)
+		}
+		count, err := strconv.Atoi(number)
+		if err != nil {
+			return 0, err
+		}
+		total += time.Duration(count) * unit
+		number = ""
+	}
+	if number != "" {
+		return 0, fmt.Errorf("invalid duration %q, missing the unit of %s", value, number)
+	}
+	return total, nil
+}
+
+/**
+ * Shortest form of a duration parsed by ParseDuration
+ */
+func FormatDuration(duration time.Duration) string {
+	for _, unit := range []byte{'w', 'd', 'h'} {
+		if duration%durationUnits[unit] == 0 {
+			return fmt.Sprintf("%d%c", duration/durationUnits[unit], unit)
+		}
+	}
+	return duration.String()
+}
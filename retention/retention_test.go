@@ -0,0 +1,236 @@
+package retention
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func at(value string) time.Time {
+	taken, err := time.Parse("2006-01-02T15:04", value)
+	if err != nil {
+		panic(err)
+	}
+	return taken
+}
+
+func snapshots(values ...string) []Snapshot {
+	result := []Snapshot{}
+	for _, value := range values {
+		result = append(result, Snapshot{ID: value, Time: at(value)})
+	}
+	return result
+}
+
+/**
+ * Kept snapshots newest first, joined by commas
+ */
+func kept(decisions []Decision) string {
+	ids := []string{}
+	for _, decision := range decisions {
+		if decision.Keep {
+			ids = append(ids, decision.Snapshot.ID)
+		}
+	}
+	return strings.Join(ids, ",")
+}
+
+func TestApply(t *testing.T) {
+	now := at("2027-01-10T12:00")
+	tests := []struct {
+		name      string
+		policy    Policy
+		snapshots []Snapshot
+		expected  string
+	}{
+		{
+			"hourly keeps the newest of each hour",
+			Policy{Hourly: 2},
+			snapshots("2026-10-17T03:00", "2026-10-17T03:59", "2026-10-17T04:00", "2026-10-17T04:30", "2026-10-17T05:10"),
+			"2026-10-17T05:10,2026-10-17T04:30",
+		},
+		{
+			"daily keeps the newest of each day",
+			Policy{Daily: 3},
+			snapshots("2026-10-14T23:59", "2026-10-15T00:00", "2026-10-15T10:00", "2026-10-16T01:00", "2026-10-17T00:00", "2026-10-17T23:00"),
+			"2026-10-17T23:00,2026-10-16T01:00,2026-10-15T10:00",
+		},
+		{
+			"daily counts days having a snapshot, not calendar days",
+			Policy{Daily: 2},
+			snapshots("2026-09-01T00:00", "2026-10-01T00:00", "2026-10-17T00:00"),
+			"2026-10-17T00:00,2026-10-01T00:00",
+		},
+		{
+			// 2026-12-31 and 2027-01-01 both belong to the ISO week 2026-W53, 2027-01-04 starts 2027-W01
+			"weekly uses ISO weeks across the year boundary",
+			Policy{Weekly: 2},
+			snapshots("2026-12-27T00:00", "2026-12-28T00:00", "2026-12-31T00:00", "2027-01-01T00:00", "2027-01-04T00:00"),
+			"2027-01-04T00:00,2027-01-01T00:00",
+		},
+		{
+			"weekly starts on monday",
+			Policy{Weekly: 3},
+			snapshots("2026-10-11T00:00", "2026-10-12T00:00", "2026-10-18T00:00", "2026-10-19T00:00"),
+			"2026-10-19T00:00,2026-10-18T00:00,2026-10-11T00:00",
+		},
+		{
+			"monthly keeps the newest of each month",
+			Policy{Monthly: 2},
+			snapshots("2026-08-31T00:00", "2026-09-01T00:00", "2026-09-30T00:00", "2026-10-01T00:00"),
+			"2026-10-01T00:00,2026-09-30T00:00",
+		},
+		{
+			"yearly keeps the newest of each year",
+			Policy{Yearly: 2},
+			snapshots("2024-12-31T00:00", "2025-01-01T00:00", "2025-12-31T00:00", "2026-06-01T00:00", "2026-12-31T00:00"),
+			"2026-12-31T00:00,2025-12-31T00:00",
+		},
+		{
+			"rules add up",
+			Policy{Monthly: 1, Yearly: 2},
+			snapshots("2025-06-01T00:00", "2025-12-01T00:00", "2026-11-01T00:00", "2026-12-01T00:00"),
+			"2026-12-01T00:00,2025-12-01T00:00",
+		},
+		{
+			"within keeps everything newer than now minus the duration",
+			Policy{Within: 36 * time.Hour},
+			snapshots("2027-01-08T23:59", "2027-01-09T00:01", "2027-01-10T11:00"),
+			"2027-01-10T11:00,2027-01-09T00:01",
+		},
+		{
+			"within adds to the counts",
+			Policy{Daily: 1, Within: 2 * 24 * time.Hour},
+			snapshots("2027-01-01T00:00", "2027-01-09T00:00", "2027-01-10T00:00"),
+			"2027-01-10T00:00,2027-01-09T00:00",
+		},
+		{
+			"an empty policy keeps none",
+			Policy{},
+			snapshots("2027-01-09T00:00", "2027-01-10T00:00"),
+			"",
+		},
+		{
+			"more kept than snapshots",
+			Policy{Daily: 10},
+			snapshots("2027-01-09T00:00", "2027-01-10T00:00"),
+			"2027-01-10T00:00,2027-01-09T00:00",
+		},
+		{
+			"no snapshots",
+			Policy{Daily: 1},
+			nil,
+			"",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := kept(Apply(test.policy, test.snapshots, now)); got != test.expected {
+				t.Errorf("kept %q, expected %q", got, test.expected)
+			}
+		})
+	}
+}
+
+func TestApplyIncomplete(t *testing.T) {
+	now := at("2026-10-20T00:00")
+	snapshots := []Snapshot{
+		{ID: "old", Time: at("2026-10-15T00:00")},
+		{ID: "failed", Time: at("2026-10-16T00:00"), Incomplete: true},
+		{ID: "complete", Time: at("2026-10-17T00:00")},
+		{ID: "running", Time: at("2026-10-18T00:00"), Incomplete: true},
+		{ID: "stopped", Time: at("2026-10-18T12:00"), Incomplete: true},
+	}
+	decisions := Apply(Policy{Daily: 2}, snapshots, now)
+	// the incomplete snapshots newer than every complete one are kept and never count towards a rule
+	if got := kept(decisions); got != "stopped,running,complete,old" {
+		t.Errorf("kept %q", got)
+	}
+	if decisions[0].Reasons[0] != "incomplete, newest" {
+		t.Errorf("reasons %v", decisions[0].Reasons)
+	}
+	if got := kept(Apply(Policy{}, snapshots, now)); got != "stopped,running" {
+		t.Errorf("an empty policy kept %q", got)
+	}
+	// within never keeps an incomplete snapshot older than a complete one
+	if got := kept(Apply(Policy{Within: 7 * 24 * time.Hour}, snapshots, now)); got != "stopped,running,complete,old" {
+		t.Errorf("within kept %q", got)
+	}
+}
+
+func TestApplyReasons(t *testing.T) {
+	decisions := Apply(Policy{Daily: 1, Weekly: 1, Within: time.Hour}, snapshots("2026-10-17T03:00"), at("2026-10-17T03:30"))
+	if got := strings.Join(decisions[0].Reasons, ", "); got != "daily 1, weekly 1, within 1h" {
+		t.Errorf("reasons %q", got)
+	}
+}
+
+func TestPolicyEmpty(t *testing.T) {
+	if !(Policy{}).Empty() {
+		t.Error("the zero policy isn't empty")
+	}
+	for _, policy := range []Policy{{Hourly: 1}, {Daily: 1}, {Weekly: 1}, {Monthly: 1}, {Yearly: 1}, {Within: time.Hour}} {
+		if policy.Empty() {
+			t.Errorf("%+v is empty", policy)
+		}
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected time.Duration
+		err      bool
+	}{
+		{"", 0, false},
+		{"36h", 36 * time.Hour, false},
+		{"14d", 14 * 24 * time.Hour, false},
+		{"2w", 14 * 24 * time.Hour, false},
+		{"1w3d", 10 * 24 * time.Hour, false},
+		{"1d12h", 36 * time.Hour, false},
+		{" 2d ", 48 * time.Hour, false},
+		{"0d", 0, false},
+		{"14", 0, true},
+		{"d", 0, true},
+		{"2m", 0, true},
+		{"1.5d", 0, true},
+		{"-1d", 0, true},
+		{"1d 2h", 0, true},
+	}
+	for _, test := range tests {
+		got, err := ParseDuration(test.value)
+		if test.err {
+			if err == nil {
+				t.Errorf("ParseDuration(%q) = %v, expected an error", test.value, got)
+			}
+			continue
+		}
+		if err != nil || got != test.expected {
+			t.Errorf("ParseDuration(%q) = %v, %v, expected %v", test.value, got, err, test.expected)
+		}
+	}
+}
+
+func TestFormatDuration(t *testing.T) {
+	tests := map[time.Duration]string{
+		time.Hour:           "1h",
+		36 * time.Hour:      "36h",
+		24 * time.Hour:      "1d",
+		10 * 24 * time.Hour: "10d",
+		14 * 24 * time.Hour: "2w",
+		90 * time.Minute:    "1h30m0s",
+	}
+	for duration, expected := range tests {
+		got := FormatDuration(duration)
+		if got != expected {
+			t.Errorf("FormatDuration(%v) = %q, expected %q", duration, got, expected)
+		}
+		if duration%time.Hour != 0 {
+			continue
+		}
+		parsed, err := ParseDuration(got)
+		if err != nil || parsed != duration {
+			t.Errorf("ParseDuration(FormatDuration(%v)) = %v, %v", duration, parsed, err)
+		}
+	}
+}
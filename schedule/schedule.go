@@ -0,0 +1,139 @@
+package schedule
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// Policies for the runs missed while the process was down
+const (
+	// wait for the next scheduled run
+	CatchUpSkip = "skip"
+	// run once at startup when at least one run was missed
+	CatchUpOnce = "once"
+)
+
+// Policies for a run due while the previous one is still running
+const (
+	// drop the new run
+	OverlapSkip = "skip"
+	// start the new run once the previous one finishes, at most one run waits
+	OverlapQueue = "queue"
+	// cancel the previous run and start the new one once it stopped
+	OverlapCancel = "cancel"
+)
+
+/**
+ * When a task runs, Next returns the first run strictly after t
+ */
+type Schedule interface {
+	Next(t time.Time) time.Time
+}
+
+type intervalSchedule struct {
+	every time.Duration
+}
+
+func (schedule intervalSchedule) Next(t time.Time) time.Time {
+	return t.Add(schedule.every)
+}
+
+/**
+ * Cron expression evaluated on the wall clock of its location. A run falling in the hour skipped
+ * when the clocks go forward runs that much later, a run in the hour repeated when they go back runs once
+ */
+type cronSchedule struct {
+	// evaluated on UTC, which has no daylight saving time, the times it returns are wall clock times
+	spec     cron.Schedule
+	location *time.Location
+}
+
+func (schedule cronSchedule) Next(t time.Time) time.Time {
+	wall := wallClock(t.In(schedule.location))
+	for {
+		wall = schedule.spec.Next(wall)
+		if wall.IsZero() {
+			return wall
+		}
+		if next := schedule.instant(wall); next.After(t) {
+			return next
+		}
+	}
+}
+
+/**
+ * The fields of t in UTC
+ */
+func wallClock(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+}
+
+/**
+ * When the location shows the wall clock time: the first time when it shows it twice,
+ * with the offset before the change when it never does
+ */
+func (schedule cronSchedule) instant(wall time.Time) time.Time {
+	approximate := time.Date(wall.Year(), wall.Month(), wall.Day(), wall.Hour(), wall.Minute(), wall.Second(), wall.Nanosecond(), schedule.location)
+	// clocks never change twice in a day
+	_, before := approximate.Add(-12 * time.Hour).Zone()
+	_, after := approximate.Add(12 * time.Hour).Zone()
+	skipped := wall.Add(-time.Duration(before) * time.Second)
+	instant := time.Time{}
+	for _, offset := range []int{before, after} {
+		candidate := wall.Add(-time.Duration(offset) * time.Second).In(schedule.location)
+		if wallClock(candidate).Equal(wall) && (instant.IsZero() || candidate.Before(instant)) {
+			instant = candidate
+		}
+	}
+	if instant.IsZero() {
+		return skipped.In(schedule.location)
+	}
+	return instant
+}
+
+/**
+ * Parse a standard 5 field cron expression like "30 2 * * *", or a descriptor like @daily,
+ * evaluated on the given timezone (local time when empty), see cronSchedule.
+ * Without expression the task runs every secondsInterval
+ */
+func Parse(expression string, timezone string, secondsInterval int) (Schedule, error) {
+	location := time.Local
+	if timezone != "" {
+		loaded, err := time.LoadLocation(timezone)
+		if err != nil {
+			return nil, fmt.Errorf("unknown timezone %s: %v", timezone, err)
+		}
+		location = loaded
+	}
+	expression = strings.TrimSpace(expression)
+	if expression == "" {
+		if secondsInterval <= 0 {
+			return nil, fmt.Errorf("an interval or a cron expression is required")
+		}
+		return intervalSchedule{every: time.Duration(secondsInterval) * time.Second}, nil
+	}
+	if strings.HasPrefix(expression, "TZ=") || strings.HasPrefix(expression, "CRON_TZ=") {
+		return nil, fmt.Errorf("set the timezone with the timezone setting instead of %s", expression)
+	}
+	parsed, err := cron.ParseStandard(expression)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cron expression %q: %v", expression, err)
+	}
+	if spec, ok := parsed.(*cron.SpecSchedule); ok {
+		spec.Location = time.UTC
+		return cronSchedule{spec: spec, location: location}, nil
+	}
+	// @every runs at a fixed interval whatever the clocks show
+	return parsed, nil
+}
+
+func ValidCatchUp(policy string) bool {
+	return policy == CatchUpSkip || policy == CatchUpOnce
+}
+
+func ValidOverlap(policy string) bool {
+	return policy == OverlapSkip || policy == OverlapQueue || policy == OverlapCancel
+}
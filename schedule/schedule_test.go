@@ -0,0 +1,112 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func location(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loaded, err := time.LoadLocation(name)
+	if err != nil {
+		t.Skipf("time zone %s not available: %v", name, err)
+	}
+	return loaded
+}
+
+/**
+ * Check the runs following from, in order
+ */
+func checkRuns(t *testing.T, spec Schedule, from time.Time, expected ...time.Time) {
+	t.Helper()
+	next := from
+	for _, run := range expected {
+		next = spec.Next(next)
+		if !next.Equal(run) {
+			t.Fatalf("ran at %s, expected %s", next, run)
+		}
+	}
+}
+
+func TestParseTimezone(t *testing.T) {
+	newYork := location(t, "America/New_York")
+	tokyo := location(t, "Asia/Tokyo")
+
+	weekdays, err := Parse("0 9 * * 1-5", "America/New_York", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// from a Saturday, 09:00 EDT is 13:00 UTC
+	checkRuns(t, weekdays, time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC),
+		time.Date(2026, 10, 19, 9, 0, 0, 0, newYork),
+		time.Date(2026, 10, 20, 13, 0, 0, 0, time.UTC))
+
+	nightly, err := Parse("30 2 * * *", "Asia/Tokyo", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRuns(t, nightly, time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC),
+		time.Date(2026, 10, 17, 17, 30, 0, 0, time.UTC),
+		time.Date(2026, 10, 19, 2, 30, 0, 0, tokyo))
+
+	if next := nightly.Next(time.Now()); next.Location().String() != tokyo.String() {
+		t.Errorf("next run in %s", next.Location())
+	}
+	if _, err := Parse("30 2 * * *", "Mars/Olympus_Mons", 0); err == nil {
+		t.Error("parsed with an unknown time zone")
+	}
+	if _, err := Parse("30 2 * *", "", 0); err == nil {
+		t.Error("parsed an expression with 4 fields")
+	}
+}
+
+func TestParseDaylightSaving(t *testing.T) {
+	paris := location(t, "Europe/Paris")
+	newYork := location(t, "America/New_York")
+
+	nightly, err := Parse("30 2 * * *", "Europe/Paris", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 02:30 doesn't exist on 03-29, the run is an hour later
+	checkRuns(t, nightly, time.Date(2026, 3, 28, 12, 0, 0, 0, paris),
+		time.Date(2026, 3, 29, 1, 30, 0, 0, time.UTC),
+		time.Date(2026, 3, 30, 2, 30, 0, 0, paris))
+	// 02:30 happens twice on 10-25, the run is on the first one only
+	checkRuns(t, nightly, time.Date(2026, 10, 24, 12, 0, 0, 0, paris),
+		time.Date(2026, 10, 25, 0, 30, 0, 0, time.UTC),
+		time.Date(2026, 10, 26, 2, 30, 0, 0, paris))
+
+	quarters, err := Parse("*/15 2 * * *", "America/New_York", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the skipped runs are all done once the clocks went forward
+	checkRuns(t, quarters, time.Date(2026, 3, 8, 1, 0, 0, 0, newYork),
+		time.Date(2026, 3, 8, 7, 0, 0, 0, time.UTC),
+		time.Date(2026, 3, 9, 2, 0, 0, 0, newYork))
+
+	hourly, err := Parse("0 * * * *", "America/New_York", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the repeated hour runs once, the run after it is 2 hours later
+	checkRuns(t, hourly, time.Date(2026, 11, 1, 0, 30, 0, 0, newYork),
+		time.Date(2026, 11, 1, 5, 0, 0, 0, time.UTC),
+		time.Date(2026, 11, 1, 7, 0, 0, 0, time.UTC),
+		time.Date(2026, 11, 1, 8, 0, 0, 0, time.UTC))
+}
+
+func TestParseInterval(t *testing.T) {
+	every, err := Parse("", "", 90)
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := time.Date(2026, 3, 29, 1, 59, 0, 0, location(t, "Europe/Paris"))
+	if next := every.Next(from); next.Sub(from) != 90*time.Second {
+		t.Errorf("ran %s later", next.Sub(from))
+	}
+	if _, err := Parse("", "", 0); err == nil {
+		t.Error("parsed without expression nor interval")
+	}
+}
@@ -0,0 +1,190 @@
+package schedule
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+type Task struct {
+	Name     string
+	Schedule Schedule
+	CatchUp  string
+	Overlap  string
+	Run      func(ctx context.Context) error
+}
+
+/**
+ * Lock of a task, there is never more than one run of the same task
+ */
+type taskLock struct {
+	mutex   sync.Mutex
+	running bool
+	pending bool
+	cancel  context.CancelFunc
+}
+
+// Returned by Shutdown when the running tasks didn't finish before the deadline and were canceled
+var ErrRunsCanceled = errors.New("shutdown deadline reached, running backups were canceled")
+
+// How long canceled runs get to clean up before Shutdown gives up on them
+const cancelGrace = 30 * time.Second
+
+/**
+ * Run every task on its own schedule, nothing runs at startup
+ * unless a run was missed and the task catches up
+ */
+type Scheduler struct {
+	state  *State
+	stop   chan struct{}
+	wg     sync.WaitGroup
+	ctx    context.Context
+	cancel context.CancelFunc
+	// current time, runs are scheduled and recorded with it
+	clock func() time.Time
+}
+
+func NewScheduler(state *State) *Scheduler {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Scheduler{
+		state:  state,
+		stop:   make(chan struct{}),
+		ctx:    ctx,
+		cancel: cancel,
+		clock:  time.Now,
+	}
+}
+
+func (scheduler *Scheduler) Add(task Task) {
+	scheduler.wg.Add(1)
+	go scheduler.loop(task)
+}
+
+/**
+ * Stop scheduling new runs and wait for the running ones to finish.
+ * Once timeout is reached the running ones are canceled and ErrRunsCanceled is returned
+ */
+func (scheduler *Scheduler) Shutdown(timeout time.Duration) error {
+	close(scheduler.stop)
+	defer scheduler.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		scheduler.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+	}
+	fmt.Printf("Backups still running after %s, canceling them\n", timeout)
+	scheduler.cancel()
+	select {
+	case <-done:
+	case <-time.After(cancelGrace):
+		fmt.Println("Canceled backups did not stop in time, giving up on them")
+	}
+	return ErrRunsCanceled
+}
+
+func (scheduler *Scheduler) loop(task Task) {
+	defer scheduler.wg.Done()
+	lock := &taskLock{}
+
+	lastRun := scheduler.state.LastRun(task.Name)
+	if !lastRun.IsZero() && !task.Schedule.Next(lastRun).After(scheduler.clock()) {
+		if task.CatchUp == CatchUpOnce {
+			fmt.Printf("Catching up %s, missed runs since %s\n", task.Name, lastRun.Local().Format(time.RFC3339))
+			scheduler.trigger(task, lock)
+		} else {
+			fmt.Printf("Skipping missed runs of %s since %s\n", task.Name, lastRun.Local().Format(time.RFC3339))
+		}
+	}
+	for {
+		next := task.Schedule.Next(scheduler.clock())
+		fmt.Printf("Next run of %s at %s\n", task.Name, next.Format(time.RFC3339))
+		timer := time.NewTimer(next.Sub(scheduler.clock()))
+		select {
+		case <-scheduler.stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+			scheduler.trigger(task, lock)
+		}
+	}
+}
+
+/**
+ * Start a run unless the previous one is still running, then apply the overlap policy
+ */
+func (scheduler *Scheduler) trigger(task Task, lock *taskLock) {
+	lock.mutex.Lock()
+	defer lock.mutex.Unlock()
+	if !lock.running {
+		scheduler.start(task, lock)
+		return
+	}
+	switch task.Overlap {
+	case OverlapQueue:
+		fmt.Printf("%s is still running, queuing the next run\n", task.Name)
+		lock.pending = true
+	case OverlapCancel:
+		fmt.Printf("%s is still running, canceling it to start the next run\n", task.Name)
+		lock.pending = true
+		lock.cancel()
+	default:
+		fmt.Printf("%s is still running, skipping this run\n", task.Name)
+	}
+}
+
+/**
+ * Called with the lock held
+ */
+func (scheduler *Scheduler) start(task Task, lock *taskLock) {
+	ctx, cancel := context.WithCancel(scheduler.ctx)
+	lock.running = true
+	lock.pending = false
+	lock.cancel = cancel
+	scheduler.wg.Add(1)
+	go func() {
+		defer scheduler.wg.Done()
+		scheduler.run(ctx, task)
+		cancel()
+
+		lock.mutex.Lock()
+		defer lock.mutex.Unlock()
+		lock.running = false
+		if lock.pending && !scheduler.stopped() {
+			scheduler.start(task, lock)
+		}
+	}()
+}
+
+func (scheduler *Scheduler) stopped() bool {
+	select {
+	case <-scheduler.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (scheduler *Scheduler) run(ctx context.Context, task Task) {
+	start := scheduler.clock()
+	fmt.Printf("Start running %s\n", task.Name)
+	err := task.Run(ctx)
+	if err != nil {
+		fmt.Printf("Error running %s: %s\n", task.Name, err)
+	}
+	if ctx.Err() != nil {
+		// canceled on shutdown or by the next run, catch it up on the next start
+		return
+	}
+	// a run interrupted before this point is missed and caught up on the next start
+	if err := scheduler.state.SetLastRun(task.Name, start); err != nil {
+		fmt.Printf("[ERROR] unable to save the last run of %s: %s\n", task.Name, err)
+	}
+}
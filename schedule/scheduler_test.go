@@ -0,0 +1,210 @@
+package schedule
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestScheduler(t *testing.T) *Scheduler {
+	t.Helper()
+	state, err := LoadState(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewScheduler(state)
+}
+
+/**
+ * Task whose runs wait until released or canceled, every start is reported on started
+ */
+type blockingTask struct {
+	mutex    sync.Mutex
+	runs     int
+	canceled int
+	started  chan int
+	release  chan struct{}
+}
+
+func newBlockingTask() *blockingTask {
+	return &blockingTask{started: make(chan int, 10), release: make(chan struct{}, 10)}
+}
+
+func (task *blockingTask) Run(ctx context.Context) error {
+	task.mutex.Lock()
+	task.runs++
+	run := task.runs
+	task.mutex.Unlock()
+	task.started <- run
+	select {
+	case <-task.release:
+		return nil
+	case <-ctx.Done():
+		task.mutex.Lock()
+		task.canceled++
+		task.mutex.Unlock()
+		return ctx.Err()
+	}
+}
+
+func (task *blockingTask) counts() (int, int) {
+	task.mutex.Lock()
+	defer task.mutex.Unlock()
+	return task.runs, task.canceled
+}
+
+func waitStarted(t *testing.T, task *blockingTask, run int) {
+	t.Helper()
+	select {
+	case started := <-task.started:
+		if started != run {
+			t.Fatalf("run %d started, expected %d", started, run)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("run %d didn't start", run)
+	}
+}
+
+func noMoreRuns(t *testing.T, task *blockingTask) {
+	t.Helper()
+	select {
+	case run := <-task.started:
+		t.Errorf("unexpected run %d", run)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestOverlapSkip(t *testing.T) {
+	scheduler := newTestScheduler(t)
+	blocking := newBlockingTask()
+	task := Task{Name: "test", Overlap: OverlapSkip, Run: blocking.Run}
+	lock := &taskLock{}
+	scheduler.trigger(task, lock)
+	waitStarted(t, blocking, 1)
+	scheduler.trigger(task, lock)
+	scheduler.trigger(task, lock)
+	noMoreRuns(t, blocking)
+	blocking.release <- struct{}{}
+	noMoreRuns(t, blocking)
+	if err := scheduler.Shutdown(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if runs, canceled := blocking.counts(); runs != 1 || canceled != 0 {
+		t.Errorf("%d runs, %d canceled", runs, canceled)
+	}
+}
+
+func TestOverlapQueue(t *testing.T) {
+	scheduler := newTestScheduler(t)
+	blocking := newBlockingTask()
+	task := Task{Name: "test", Overlap: OverlapQueue, Run: blocking.Run}
+	lock := &taskLock{}
+	scheduler.trigger(task, lock)
+	waitStarted(t, blocking, 1)
+	// at most one run waits
+	scheduler.trigger(task, lock)
+	scheduler.trigger(task, lock)
+	noMoreRuns(t, blocking)
+	blocking.release <- struct{}{}
+	waitStarted(t, blocking, 2)
+	blocking.release <- struct{}{}
+	noMoreRuns(t, blocking)
+	if err := scheduler.Shutdown(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if runs, canceled := blocking.counts(); runs != 2 || canceled != 0 {
+		t.Errorf("%d runs, %d canceled", runs, canceled)
+	}
+}
+
+func TestOverlapCancel(t *testing.T) {
+	scheduler := newTestScheduler(t)
+	blocking := newBlockingTask()
+	task := Task{Name: "test", Overlap: OverlapCancel, Run: blocking.Run}
+	lock := &taskLock{}
+	scheduler.trigger(task, lock)
+	waitStarted(t, blocking, 1)
+	scheduler.trigger(task, lock)
+	// the next run starts once the previous one stopped
+	waitStarted(t, blocking, 2)
+	if runs, canceled := blocking.counts(); runs != 2 || canceled != 1 {
+		t.Errorf("%d runs, %d canceled", runs, canceled)
+	}
+	blocking.release <- struct{}{}
+	if err := scheduler.Shutdown(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	// a canceled run isn't recorded, it is caught up on the next start
+	if lastRun := scheduler.state.LastRun("test"); lastRun.IsZero() {
+		t.Error("the completed run wasn't recorded")
+	}
+}
+
+func TestShutdownCancelsRuns(t *testing.T) {
+	scheduler := newTestScheduler(t)
+	blocking := newBlockingTask()
+	task := Task{Name: "test", Run: blocking.Run}
+	scheduler.trigger(task, &taskLock{})
+	waitStarted(t, blocking, 1)
+	if err := scheduler.Shutdown(50 * time.Millisecond); !errors.Is(err, ErrRunsCanceled) {
+		t.Errorf("shutdown: %v", err)
+	}
+	if _, canceled := blocking.counts(); canceled != 1 {
+		t.Error("the running backup wasn't canceled")
+	}
+	if lastRun := scheduler.state.LastRun("test"); !lastRun.IsZero() {
+		t.Errorf("the canceled run was recorded at %s", lastRun)
+	}
+}
+
+func TestCatchUp(t *testing.T) {
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	tests := map[string]struct {
+		lastRun time.Time
+		catchUp string
+		runs    int
+	}{
+		// the runs of 10-16 and 10-17 were missed, one run catches up both
+		"missed":         {time.Date(2026, 10, 15, 2, 0, 0, 0, time.UTC), CatchUpOnce, 1},
+		"missed skipped": {time.Date(2026, 10, 15, 2, 0, 0, 0, time.UTC), CatchUpSkip, 0},
+		"recorded":       {time.Date(2026, 10, 17, 2, 0, 0, 0, time.UTC), CatchUpOnce, 0},
+		"never run":      {time.Time{}, CatchUpOnce, 0},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			scheduler := newTestScheduler(t)
+			scheduler.clock = func() time.Time { return now }
+			if !test.lastRun.IsZero() {
+				if err := scheduler.state.SetLastRun("test", test.lastRun); err != nil {
+					t.Fatal(err)
+				}
+			}
+			spec, err := Parse("0 2 * * *", "UTC", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			blocking := newBlockingTask()
+			scheduler.Add(Task{Name: "test", Schedule: spec, CatchUp: test.catchUp, Run: blocking.Run})
+			if test.runs == 1 {
+				waitStarted(t, blocking, 1)
+				blocking.release <- struct{}{}
+			}
+			noMoreRuns(t, blocking)
+			if err := scheduler.Shutdown(time.Second); err != nil {
+				t.Fatal(err)
+			}
+			if runs, _ := blocking.counts(); runs != test.runs {
+				t.Errorf("%d runs, expected %d", runs, test.runs)
+			}
+			expected := test.lastRun
+			if test.runs == 1 {
+				expected = now
+			}
+			if lastRun := scheduler.state.LastRun("test"); !lastRun.Equal(expected) {
+				t.Errorf("last run recorded at %s, expected %s", lastRun, expected)
+			}
+		})
+	}
+}
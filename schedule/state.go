@@ -0,0 +1,67 @@
+package schedule
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const stateFile = "schedule.json"
+
+/**
+ * Last run of every task, kept on disk to find the runs missed while the process was down
+ */
+type State struct {
+	path     string
+	mutex    sync.Mutex
+	lastRuns map[string]time.Time
+}
+
+func LoadState(dir string) (*State, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	state := &State{
+		path:     filepath.Join(dir, stateFile),
+		lastRuns: map[string]time.Time{},
+	}
+	content, err := os.ReadFile(state.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(content, &state.lastRuns); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+/**
+ * Zero time when the task never ran
+ */
+func (state *State) LastRun(name string) time.Time {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	return state.lastRuns[name]
+}
+
+func (state *State) SetLastRun(name string, lastRun time.Time) error {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	state.lastRuns[name] = lastRun.UTC()
+
+	content, err := json.MarshalIndent(state.lastRuns, "", "    ")
+	if err != nil {
+		return err
+	}
+	tmp := state.path + ".tmp"
+	if err := os.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, state.path)
+}
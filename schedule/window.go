@@ -0,0 +1,66 @@
+package schedule
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+/**
+ * A daily time range such as 08:00-20:00, the end is excluded.
+ * A range ending before its start wraps around midnight, e.g. 22:00-06:00
+ */
+type Window struct {
+	always bool
+	// minutes since midnight
+	start int
+	end   int
+}
+
+/**
+ * Parse a HH:MM-HH:MM range, an empty expression covers the whole day
+ */
+func ParseWindow(expression string) (Window, error) {
+	expression = strings.TrimSpace(expression)
+	if expression == "" {
+		return Window{always: true}, nil
+	}
+	parts := strings.Split(expression, "-")
+	if len(parts) != 2 {
+		return Window{}, fmt.Errorf("invalid time range %q, expected HH:MM-HH:MM", expression)
+	}
+	start, err := parseClock(parts[0])
+	if err != nil {
+		return Window{}, err
+	}
+	end, err := parseClock(parts[1])
+	if err != nil {
+		return Window{}, err
+	}
+	if start == end {
+		return Window{}, fmt.Errorf("invalid time range %q, start and end are the same", expression)
+	}
+	return Window{start: start, end: end}, nil
+}
+
+func parseClock(value string) (int, error) {
+	clock, err := time.Parse("15:04", strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", strings.TrimSpace(value))
+	}
+	return clock.Hour()*60 + clock.Minute(), nil
+}
+
+/**
+ * Whether t, in its own location, falls in the range
+ */
+func (window Window) Contains(t time.Time) bool {
+	if window.always {
+		return true
+	}
+	minute := t.Hour()*60 + t.Minute()
+	if window.start < window.end {
+		return minute >= window.start && minute < window.end
+	}
+	return minute >= window.start || minute < window.end
+}
@@ -0,0 +1,63 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseWindow(t *testing.T) {
+	for _, expression := range []string{"", " ", "08:00-20:00", "22:00-06:00", " 00:00 - 23:59 "} {
+		if _, err := ParseWindow(expression); err != nil {
+			t.Errorf("%q: %v", expression, err)
+		}
+	}
+	for _, expression := range []string{"08:00", "08:00-20:00-22:00", "8h-20h", "25:00-06:00", "08:00-08:00"} {
+		if _, err := ParseWindow(expression); err == nil {
+			t.Errorf("%q accepted", expression)
+		}
+	}
+}
+
+func TestWindowContains(t *testing.T) {
+	at := func(hour int, minute int) time.Time {
+		return time.Date(2026, 10, 17, hour, minute, 0, 0, time.UTC)
+	}
+	tests := map[string]map[time.Time]bool{
+		"": {at(0, 0): true, at(12, 0): true, at(23, 59): true},
+		"08:00-20:00": {
+			at(7, 59): false, at(8, 0): true, at(12, 0): true, at(19, 59): true, at(20, 0): false, at(0, 0): false,
+		},
+		// spans midnight
+		"22:00-06:00": {
+			at(21, 59): false, at(22, 0): true, at(23, 59): true, at(0, 0): true, at(5, 59): true, at(6, 0): false, at(12, 0): false,
+		},
+		"00:00-01:00": {at(0, 0): true, at(0, 59): true, at(1, 0): false, at(23, 59): false},
+	}
+	for expression, times := range tests {
+		window, err := ParseWindow(expression)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for moment, expected := range times {
+			if got := window.Contains(moment); got != expected {
+				t.Errorf("%q contains %s: %v", expression, moment.Format("15:04"), got)
+			}
+		}
+	}
+}
+
+func TestWindowLocation(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Skip(err)
+	}
+	window, _ := ParseWindow("22:00-06:00")
+	// 21:30 UTC is 23:30 in Paris during summer time
+	moment := time.Date(2026, 7, 1, 21, 30, 0, 0, time.UTC)
+	if window.Contains(moment) {
+		t.Error("21:30 UTC in 22:00-06:00")
+	}
+	if !window.Contains(moment.In(paris)) {
+		t.Error("23:30 in Paris not in 22:00-06:00")
+	}
+}
@@ -3,22 +3,20 @@ package typesensebackup
 import (
 	"archive/tar"
 	"compress/gzip"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"time"
 
 	"playus/server-backup/config"
 	"playus/server-backup/directory"
+	"playus/server-backup/retention"
 
 	"github.com/typesense/typesense-go/typesense"
-
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 )
 
 type StackNode struct {
@@ -55,102 +53,82 @@ func (stack *Stack) GetNext() string {
 }
 
 type TypesenseBackup struct {
-	Key             string
-	Secret          string
-	Region          string
-	Endpoint        string
+	Storage         directory.StorageOptions
 	TargetDir       string
-	Bucket          string
+	Destinations    []string
 	BucketPrefix    string
-	DailyRotation   int
-	WeeklyRotation  int
-	MonthlyRotation int
-	Running         bool
+	Lock            config.LockConfig
+	Retry           directory.RetryPolicy
+	Workers         int
+	Retention       retention.Policy
 	TypeSenseClient *typesense.Client
 }
 
-var (
-	Worker = newTypesenseBackupWorker()
-)
-
-func newTypesenseBackupWorker() *TypesenseBackup {
+func NewWorker(conf *config.Config) *TypesenseBackup {
 	typesenseClient := typesense.NewClient(
-		typesense.WithServer(config.Conf.Get("typesensebackup.typesenseUrl").(string)),
-		typesense.WithAPIKey(config.Conf.Get("typesensebackup.typesenseApiKey").(string)))
+		typesense.WithServer(conf.Typesense.TypesenseUrl),
+		typesense.WithAPIKey(conf.Typesense.TypesenseApiKey))
 	worker := &TypesenseBackup{
-		Key:             config.Conf.Get("typesensebackup.key").(string),
-		Secret:          config.Conf.Get("typesensebackup.secret").(string),
-		Region:          config.Conf.Get("typesensebackup.region").(string),
-		Endpoint:        config.Conf.Get("typesensebackup.endpoint").(string),
-		Bucket:          config.Conf.Get("typesensebackup.bucket").(string),
-		BucketPrefix:    config.Conf.Get("typesensebackup.bucketPrefix").(string),
-		TargetDir:       config.Conf.Get("typesensebackup.targetDir").(string),
-		DailyRotation:   int(config.Conf.Get("typesensebackup.dailyrotation").(int64)),
-		WeeklyRotation:  int(config.Conf.Get("typesensebackup.weeklyrotation").(int64)),
-		MonthlyRotation: int(config.Conf.Get("typesensebackup.monthlyrotation").(int64)),
-		Running:         false,
+		Storage:         directory.NewStorageOptions(conf.Typesense.Storage, conf.Typesense.Throttle),
+		Destinations:    conf.Typesense.Destinations,
+		BucketPrefix:    conf.Typesense.BucketPrefix,
+		TargetDir:       conf.Typesense.TargetDir,
+		Lock:            conf.Typesense.Lock,
+		Retry:           directory.NewRetryPolicy(conf.Typesense.Retry),
+		Workers:         conf.Typesense.Workers,
+		Retention:       directory.NewRetentionPolicy(conf.Typesense.Rotation),
 		TypeSenseClient: typesenseClient,
 	}
 
 	return worker
 }
 
-func (worker *TypesenseBackup) DoBackup() {
-	if worker.Running {
-		return
-	}
+/**
+ * Snapshot typesense and upload the compressed snapshot to every destination
+ */
+func (worker *TypesenseBackup) DoBackup(ctx context.Context) error {
 	if !directory.CheckFileExists(worker.TargetDir) {
 		err := os.MkdirAll(worker.TargetDir, os.ModePerm)
 		if checkErr(err) {
-			return
+			return err
 		}
 	}
 	targetSnapshot := fmt.Sprintf("%s/%s", worker.TargetDir, "typesense-snapshot")
 	success, err := worker.TypeSenseClient.Operations().Snapshot(targetSnapshot)
 	if checkErr(err) {
-		return
+		return err
 	}
-	if success {
-		targetFile := fmt.Sprintf("%s/typesense-backup.tgz", worker.TargetDir)
-		worker.compressDirectory(targetSnapshot, targetFile)
-		session, err := session.NewSession(&aws.Config{
-			Region:      aws.String(worker.Region),
-			Credentials: credentials.NewStaticCredentials(worker.Key, worker.Secret, ""),
-			Endpoint:    aws.String(worker.Endpoint),
-		})
-		if checkErr(err) {
-			return
-		}
-
-		// Create S3 service client
-		s3Client := s3.New(session)
-		if s3Client == nil {
-			return
-		}
-
-		uploader := s3manager.NewUploader(session)
-		if uploader == nil {
-			return
-		}
-		downloader := s3manager.NewDownloader(session)
-		if downloader == nil {
-			return
-		}
-
-		addHandler := directory.NewAddHandler(worker.Bucket, worker.Key, worker.TargetDir, s3Client, uploader, downloader, nil, worker.DailyRotation, worker.WeeklyRotation, worker.MonthlyRotation)
-		addHandler.Handle()
-
-		removeHandler := directory.NewRemoveHandler(worker.Bucket, worker.Key, worker.TargetDir, s3Client, uploader, downloader, worker.DailyRotation, worker.WeeklyRotation, worker.MonthlyRotation)
-		removeHandler.Handle()
+	if !success {
+		return fmt.Errorf("typesense snapshot to %s failed", targetSnapshot)
+	}
+	targetFile := fmt.Sprintf("%s/typesense-backup.tgz", worker.TargetDir)
+	if err := worker.compressDirectory(targetSnapshot, targetFile); err != nil {
+		return err
 	}
+	results := directory.Replicate(ctx, worker.Destinations, worker.BucketPrefix, worker.Storage, directory.LockedRun(worker.BucketPrefix, "typesensebackup", worker.Lock, func(ctx context.Context, storage directory.Storage) error {
+		manifest := directory.NewManifestBuilder("typesensebackup", time.Now(), nil)
+		addHandler := directory.NewAddHandler(storage, worker.BucketPrefix, worker.TargetDir, nil, worker.Retention, worker.Retry, worker.Workers, nil, manifest)
+		addErr := addHandler.Handle(ctx)
+
+		removeHandler := directory.NewRemoveHandler(storage, worker.BucketPrefix, worker.TargetDir, worker.Retention, manifest)
+		return errors.Join(addErr, removeHandler.Handle(ctx))
+	}))
+	directory.PrintReport(worker.BucketPrefix, results)
+	return directory.ReplicationError("typesensebackup", results)
+}
 
+/**
+ * Apply the retention on every destination, see directory.Prune
+ */
+func (worker *TypesenseBackup) DoPrune(ctx context.Context, dryRun bool) error {
+	return directory.Prune(ctx, "typesensebackup", worker.Destinations, worker.BucketPrefix, worker.Storage, worker.Lock, worker.Retention, 0, time.Now, dryRun)
 }
 
-func (worker *TypesenseBackup) compressDirectory(targetDir string, targetFile string) {
+func (worker *TypesenseBackup) compressDirectory(targetDir string, targetFile string) error {
 	file, errcreate := os.Create(targetFile)
 
 	if checkErr(errcreate) {
-		return
+		return errcreate
 	}
 	defer file.Close()
 	// set up the gzip writer
@@ -161,8 +139,9 @@ func (worker *TypesenseBackup) compressDirectory(targetDir string, targetFile st
 
 	_, err := ioutil.ReadDir(targetDir)
 	if err != nil {
-		return
+		return err
 	}
+	var failures error
 	dirsToDelete := Stack{}
 
 	queue := directory.NewQueue()
@@ -172,11 +151,11 @@ func (worker *TypesenseBackup) compressDirectory(targetDir string, targetFile st
 	for !queue.Empty() {
 		nextDir, err := queue.Dequeue()
 		if err != nil {
-			return
+			return err
 		}
 		entries, err := ioutil.ReadDir(nextDir)
 		if err != nil {
-			return
+			return err
 		}
 		if checkErr(err) {
 			continue
@@ -194,8 +173,9 @@ func (worker *TypesenseBackup) compressDirectory(targetDir string, targetFile st
 				continue
 			}
 			if errcompress := Compress(tw, absPath, rel); errcompress != nil {
-				fmt.Printf("error to compress file: %s \n", err)
+				fmt.Printf("error to compress file: %s \n", absPath)
 				checkErr(errcompress)
+				failures = errors.Join(failures, errcompress)
 			}
 		}
 	}
@@ -204,6 +184,7 @@ func (worker *TypesenseBackup) compressDirectory(targetDir string, targetFile st
 		err = os.Remove(dir)
 		checkErr(err)
 	}
+	return failures
 }
 
 func Compress(tw *tar.Writer, p string, targetKey string) error {